@@ -16,7 +16,12 @@
 package driver
 
 import (
+	"context"
+	"crypto/tls"
 	"io"
+	"net"
+	"net/http"
+	"net/url"
 	"regexp"
 	"time"
 
@@ -32,6 +37,21 @@ func PProf(o *Options) error {
 	return internaldriver.PProf(o.InternalOptions())
 }
 
+// FetchProfiles fetches the profiles named by sources, merges them and
+// symbolizes the result, as PProf does for the sources on its command
+// line before generating reports. Sources are local files or URLs, or
+// any other source understood by o.Fetch.
+//
+// o.Fetch, o.Obj and o.Sym override the default mechanisms to fetch
+// and symbolize the profiles, and o.UI receives any warnings, eg about
+// sources that could not be fetched. Flagset and Writer are unused.
+// Like PProf, FetchProfiles saves a copy of profiles fetched from
+// remote sources unless o.NoSave is set. Outstanding fetches are
+// aborted when ctx is cancelled.
+func FetchProfiles(ctx context.Context, sources []string, o *Options) (*profile.Profile, error) {
+	return internaldriver.FetchProfiles(ctx, sources, o.InternalOptions())
+}
+
 func (o *Options) InternalOptions() *plugin.Options {
 	var obj plugin.ObjTool
 	if o.Obj != nil {
@@ -41,13 +61,61 @@ func (o *Options) InternalOptions() *plugin.Options {
 	if o.Sym != nil {
 		sym = &internalSymbolizer{o.Sym}
 	}
+	var stores map[string]plugin.ObjectStore
+	if o.ObjectStores != nil {
+		stores = make(map[string]plugin.ObjectStore, len(o.ObjectStores))
+		for scheme, store := range o.ObjectStores {
+			stores[scheme] = store
+		}
+	}
+	var services map[string]plugin.ProfileService
+	if o.ProfileServices != nil {
+		services = make(map[string]plugin.ProfileService, len(o.ProfileServices))
+		for scheme, service := range o.ProfileServices {
+			services[scheme] = service
+		}
+	}
+	var fetchErrors func([]*plugin.FetchError)
+	if o.FetchErrors != nil {
+		fetchErrors = func(errs []*plugin.FetchError) {
+			ferrs := make([]*FetchError, len(errs))
+			for i, err := range errs {
+				ferrs[i] = &FetchError{err.Source, err.Err}
+			}
+			o.FetchErrors(ferrs)
+		}
+	}
+	var fetchEvents func(*plugin.FetchEvent)
+	if o.FetchEvents != nil {
+		fetchEvents = func(e *plugin.FetchEvent) {
+			o.FetchEvents(&FetchEvent{FetchEventKind(e.Kind), e.Source, e.Bytes, e.Duration, e.Err})
+		}
+	}
 	return &plugin.Options{
-		o.Writer,
-		o.Flagset,
-		o.Fetch,
-		sym,
-		obj,
-		o.UI,
+		Writer:              o.Writer,
+		Flagset:             o.Flagset,
+		Fetch:               o.Fetch,
+		Sym:                 sym,
+		Obj:                 obj,
+		UI:                  o.UI,
+		HTTPHeader:          o.HTTPHeader,
+		HTTPProxy:           o.HTTPProxy,
+		FetchConcurrency:    o.FetchConcurrency,
+		ObjectStores:        stores,
+		PerfConverter:       o.PerfConverter,
+		PerfConverterStdout: o.PerfConverterStdout,
+		FetchErrors:         fetchErrors,
+		NoSave:              o.NoSave,
+		CheckFetchAddr:      o.CheckFetchAddr,
+		TLSConfig:           o.TLSConfig,
+		ProfileServices:     services,
+		JFRConverter:        o.JFRConverter,
+		Transform:           o.Transform,
+		ProfileData:         o.ProfileData,
+		HTTPAuthToken:       o.HTTPAuthToken,
+		FetchEvents:         fetchEvents,
+		TraceConverter:      o.TraceConverter,
+		HTTPTransport:       o.HTTPTransport,
 	}
 }
 
@@ -59,6 +127,106 @@ type Options struct {
 	Sym     Symbolizer
 	Obj     ObjTool
 	UI      UI
+
+	// HTTPHeader is added to every HTTP request made to fetch a
+	// profile, eg to authenticate with the profile server.
+	HTTPHeader http.Header
+
+	// HTTPProxy is the proxy to fetch profiles through. If nil, the
+	// proxy is selected by the HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+	// environment variables.
+	HTTPProxy *url.URL
+
+	// FetchConcurrency is the maximum number of profiles fetched at
+	// once. If 0, it is read from PPROF_FETCH_CONCURRENCY, or else
+	// defaults to 64. Lower values limit memory usage when fetching
+	// many large profiles.
+	FetchConcurrency int
+
+	// ObjectStores maps URL schemes, eg "gs" or "s3", to the object
+	// stores used to fetch profiles from URLs of the form
+	// scheme://bucket/object.
+	ObjectStores map[string]ObjectStore
+
+	// PerfConverter is the tool used to convert perf.data files to
+	// profiles. If empty, it is read from PPROF_PERF_CONVERTER, or
+	// else defaults to perf_to_profile.
+	PerfConverter string
+
+	// PerfConverterStdout is set if PerfConverter can write the
+	// profile to its standard output, when given "-" as the output
+	// file, so that it can be read without a temporary file.
+	PerfConverterStdout bool
+
+	// FetchErrors, if set, is called with the sources that could not
+	// be fetched, even if profiles were fetched from other sources.
+	FetchErrors func([]*FetchError)
+
+	// NoSave disables saving a copy of profiles fetched from remote
+	// sources, as with the -no_save flag.
+	NoSave bool
+
+	// CheckFetchAddr, if set, is called with the host and the resolved
+	// IP address of each connection made to fetch a profile, before it
+	// is established. An error refuses the connection, eg to allow
+	// only some hosts or to deny private networks when fetching
+	// untrusted URLs. Fetches that would go through a proxy are
+	// refused, as only the proxy could be checked, not the profile
+	// host.
+	CheckFetchAddr func(host string, ip net.IP) error
+
+	// TLSConfig, if set, configures the client certificates and the CAs
+	// used to fetch profiles over https, eg for servers requiring
+	// mutual TLS. If nil, it is loaded from the PEM files named by
+	// PPROF_TLS_CERT, PPROF_TLS_KEY and PPROF_TLS_CA.
+	TLSConfig *tls.Config
+
+	// ProfileServices maps URL schemes, eg "grpc", to the services
+	// used to fetch profiles from URLs of the form scheme://host/name,
+	// for programs serving profiles over RPC instead of HTTP.
+	ProfileServices map[string]ProfileService
+
+	// JFRConverter is the tool used to convert Java Flight Recorder
+	// files to profiles. If empty, it is read from PPROF_JFR_CONVERTER,
+	// or else defaults to jfr_to_profile.
+	JFRConverter string
+
+	// Transform, if set, is called with each profile fetched and the
+	// source it was fetched from, before the profiles are merged, eg
+	// to normalize their sample types or file paths so that they merge
+	// correctly. If it returns an error, the source is not used.
+	Transform func(source string, p *profile.Profile) error
+
+	// ProfileData holds the raw profiles for sources already available
+	// in memory, eg collected by the program itself. They are parsed
+	// instead of fetching the sources, and otherwise processed as
+	// fetched profiles.
+	ProfileData map[string][]byte
+
+	// HTTPAuthToken, if set, is called before each HTTP request made
+	// to fetch a profile, including retries, with the URL requested.
+	// The token it returns is sent as a bearer token, eg so that
+	// tokens expiring during long collections are refreshed.
+	HTTPAuthToken func(url string) (string, error)
+
+	// FetchEvents, if set, is called with events tracking the fetch of
+	// each source, eg to log fetches in a structured form rather than
+	// parsing the messages printed through UI. It is called
+	// concurrently for sources fetched in parallel.
+	FetchEvents func(*FetchEvent)
+
+	// TraceConverter is the tool used to convert Go execution traces
+	// to profiles. If empty, it is read from PPROF_TRACE_CONVERTER, or
+	// else defaults to trace_to_profile.
+	TraceConverter string
+
+	// HTTPTransport, if set, sends the HTTP requests made to fetch
+	// profiles, eg to go through a service mesh or trace requests,
+	// instead of the built-in transport configured by HTTPProxy and
+	// TLSConfig. Redirects are still checked, and requests still time
+	// out, but HTTP fetches fail if CheckFetchAddr is also set, as the
+	// connections of the transport cannot be checked.
+	HTTPTransport http.RoundTripper
 }
 
 // Writer provides a mechanism to write data under a certain name,
@@ -109,6 +277,59 @@ type Fetcher interface {
 	Fetch(src string, duration, timeout time.Duration) (*profile.Profile, string, error)
 }
 
+// An ObjectStore reads objects from a cloud storage service, such as
+// Google Cloud Storage or Amazon S3. Implementations are expected to
+// obtain credentials from the ambient environment of the service.
+type ObjectStore interface {
+	// Open returns a reader for the contents of object in bucket.
+	Open(bucket, object string) (io.ReadCloser, error)
+}
+
+// A ProfileService collects profiles from programs exposing them over
+// RPC, such as a gRPC debug profiling service, rather than through the
+// net/http/pprof handlers. No client is bundled with pprof.
+type ProfileService interface {
+	// Profile returns a reader for the named profile, eg "profile" or
+	// "heap", collected by the program at addr. duration is the length
+	// of time to collect time-based profiles for, or 0 for the default
+	// of the service. The request is aborted when ctx is done.
+	Profile(ctx context.Context, addr, name string, duration time.Duration) (io.ReadCloser, error)
+}
+
+// A FetchError is the failure to fetch a profile from a source.
+type FetchError struct {
+	Source string // Source of the profile, as specified by the user
+	Err    error  // Reason for the failure
+}
+
+func (e *FetchError) Error() string {
+	return e.Source + ": " + e.Err.Error()
+}
+
+// A FetchEventKind tells what a FetchEvent reports.
+type FetchEventKind int
+
+const (
+	FetchStarted   FetchEventKind = iota // The fetch of a source started
+	FetchSucceeded                       // The profile was fetched
+	FetchFailed                          // The profile could not be fetched
+)
+
+func (k FetchEventKind) String() string {
+	return plugin.FetchEventKind(k).String()
+}
+
+// A FetchEvent reports the progress of fetching a profile from a
+// source. Every source fetched gets a FetchStarted event, followed by
+// either a FetchSucceeded or a FetchFailed event.
+type FetchEvent struct {
+	Kind     FetchEventKind
+	Source   string        // Source of the profile, as specified by the user
+	Bytes    int64         // Size of the profile fetched, serialized
+	Duration time.Duration // Time taken by the fetch, once it is done
+	Err      error         // Reason for the failure, for FetchFailed
+}
+
 // A Symbolizer introduces symbol information into a profile.
 type Symbolizer interface {
 	Symbolize(mode string, srcs MappingSources, prof *profile.Profile) error
@@ -116,7 +337,10 @@ type Symbolizer interface {
 
 // MappingSources map each profile.Mapping to the source of the profile.
 // The key is either Mapping.File or Mapping.BuildId.
-type MappingSources map[string][]struct {
+type MappingSources map[string][]MappingSource
+
+// A MappingSource is a source a mapping was collected from.
+type MappingSource struct {
 	Source string // URL of the source the mapping was collected from
 	Start  uint64 // delta applied to addresses from this source (to represent Merge adjustments)
 }
@@ -272,9 +496,11 @@ type internalSymbolizer struct {
 }
 
 func (s *internalSymbolizer) Symbolize(mode string, srcs plugin.MappingSources, prof *profile.Profile) error {
-	isrcs := plugin.MappingSources{}
-	for m, s := range srcs {
-		isrcs[m] = s
+	isrcs := MappingSources{}
+	for m, ms := range srcs {
+		for _, src := range ms {
+			isrcs[m] = append(isrcs[m], MappingSource{Source: src.Source, Start: src.Start})
+		}
 	}
-	return s.Symbolize(mode, isrcs, prof)
+	return s.Symbolizer.Symbolize(mode, isrcs, prof)
 }
@@ -0,0 +1,42 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver_test
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/google/pprof/driver"
+)
+
+func ExampleFetchProfiles() {
+	// Merge two local profiles, using the default fetcher, symbolizer
+	// and UI.
+	sources := []string{
+		"../internal/driver/testdata/go.crc32.cpu",
+		"../internal/driver/testdata/go.crc32.cpu",
+	}
+	p, err := driver.FetchProfiles(context.Background(), sources, &driver.Options{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	var total int64
+	for _, s := range p.Sample {
+		total += s.Value[0]
+	}
+	fmt.Println(p.SampleType[0].Type, total)
+	// Output: samples 422
+}
@@ -194,10 +194,11 @@ func (b *Binutils) openELF(name string, start, limit, offset uint64) (plugin.Obj
 			buildID = fmt.Sprintf("%x", id)
 		}
 	}
+	debug := findDebugLink(ef, name)
 	if b.fast || (!b.addr2lineFound && !b.llvmSymbolizerFound) {
-		return &fileNM{file: file{b, name, base, buildID}}, nil
+		return &fileNM{file: file{b, name, base, buildID, debug}}, nil
 	}
-	return &fileAddr2Line{file: file{b, name, base, buildID}}, nil
+	return &fileAddr2Line{file: file{b, name, base, buildID, debug}}, nil
 }
 
 // file implements the binutils.ObjFile interface.
@@ -206,6 +207,18 @@ type file struct {
 	name    string
 	base    uint64
 	buildID string
+
+	// debug is the separate debug file for name, if any, holding its
+	// symbol tables.
+	debug string
+}
+
+// symbolFile returns the file holding the symbol tables for f.
+func (f *file) symbolFile() string {
+	if f.debug != "" {
+		return f.debug
+	}
+	return f.name
 }
 
 func (f *file) Name() string {
@@ -230,7 +243,7 @@ func (f *file) Close() error {
 
 func (f *file) Symbols(r *regexp.Regexp, addr uint64) ([]*plugin.Sym, error) {
 	// Get from nm a list of symbols sorted by address.
-	cmd := exec.Command(f.b.nm, "-n", f.name)
+	cmd := exec.Command(f.b.nm, "-n", f.symbolFile())
 	out, err := cmd.Output()
 	if err != nil {
 		return nil, fmt.Errorf("%v: %v", cmd.Args, err)
@@ -249,7 +262,7 @@ type fileNM struct {
 
 func (f *fileNM) SourceLine(addr uint64) ([]plugin.Frame, error) {
 	if f.addr2linernm == nil {
-		addr2liner, err := newAddr2LinerNM(f.b.nm, f.name, f.base)
+		addr2liner, err := newAddr2LinerNM(f.b.nm, f.symbolFile(), f.base)
 		if err != nil {
 			return nil, err
 		}
@@ -276,18 +289,18 @@ func (f *fileAddr2Line) SourceLine(addr uint64) ([]plugin.Frame, error) {
 		return f.addr2liner.addrInfo(addr)
 	}
 
-	if llvmSymbolizer, err := newLLVMSymbolizer(f.b.llvmSymbolizer, f.name, f.base); err == nil {
+	if llvmSymbolizer, err := newLLVMSymbolizer(f.b.llvmSymbolizer, f.symbolFile(), f.base); err == nil {
 		f.llvmSymbolizer = llvmSymbolizer
 		return f.llvmSymbolizer.addrInfo(addr)
 	}
 
-	if addr2liner, err := newAddr2Liner(f.b.addr2line, f.name, f.base); err == nil {
+	if addr2liner, err := newAddr2Liner(f.b.addr2line, f.symbolFile(), f.base); err == nil {
 		f.addr2liner = addr2liner
 
 		// When addr2line encounters some gcc compiled binaries, it
 		// drops interesting parts of names in anonymous namespaces.
 		// Fallback to NM for better function names.
-		if nm, err := newAddr2LinerNM(f.b.nm, f.name, f.base); err == nil {
+		if nm, err := newAddr2LinerNM(f.b.nm, f.symbolFile(), f.base); err == nil {
 			f.addr2liner.nm = nm
 		}
 		return f.addr2liner.addrInfo(addr)
@@ -15,7 +15,13 @@
 package binutils
 
 import (
+	"debug/elf"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
 	"testing"
 
 	"github.com/google/pprof/internal/plugin"
@@ -150,3 +156,90 @@ func checkAddress(got []plugin.Frame, address uint64, want string) bool {
 	}
 	return got[0].Func == want
 }
+
+// testdata/exe_linux_debuglink is built from exe_linux_debuglink.c with
+//
+//	gcc -g -o exe_linux_debuglink exe_linux_debuglink.c
+//	objcopy --only-keep-debug exe_linux_debuglink exe_linux_debuglink.debug
+//	strip --strip-all exe_linux_debuglink
+//	objcopy --add-gnu-debuglink=exe_linux_debuglink.debug exe_linux_debuglink
+const (
+	debugLinkBinary = "testdata/exe_linux_debuglink"
+	debugLinkTarget = "testdata/exe_linux_debuglink.debug"
+)
+
+func TestFindDebugLink(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "debuglink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	saveDebugDir := globalDebugDir
+	defer func() { globalDebugDir = saveDebugDir }()
+	globalDebugDir = filepath.Join(tmp, "global")
+
+	sameDir, err := filepath.Abs(debugLinkTarget)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyFile(t, debugLinkBinary, filepath.Join(tmp, "subdir", "exe"))
+	copyFile(t, debugLinkTarget, filepath.Join(tmp, "subdir", ".debug", "exe_linux_debuglink.debug"))
+	copyFile(t, debugLinkBinary, filepath.Join(tmp, "global_dir", "exe"))
+	copyFile(t, debugLinkTarget, filepath.Join(globalDebugDir, tmp, "global_dir", "exe_linux_debuglink.debug"))
+	copyFile(t, debugLinkBinary, filepath.Join(tmp, "bad_crc", "exe"))
+	if err := ioutil.WriteFile(filepath.Join(tmp, "bad_crc", "exe_linux_debuglink.debug"), []byte("corrupt"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name, want string
+	}{
+		{debugLinkBinary, sameDir},
+		{filepath.Join(tmp, "subdir", "exe"), filepath.Join(tmp, "subdir", ".debug", "exe_linux_debuglink.debug")},
+		{filepath.Join(tmp, "global_dir", "exe"), filepath.Join(globalDebugDir, tmp, "global_dir", "exe_linux_debuglink.debug")},
+		{filepath.Join(tmp, "bad_crc", "exe"), ""},
+		{debugLinkTarget, ""},
+	} {
+		ef, err := elf.Open(tc.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := findDebugLink(ef, tc.name); got != tc.want {
+			t.Errorf("findDebugLink(%s) = %q, want %q", tc.name, got, tc.want)
+		}
+		ef.Close()
+	}
+}
+
+func TestDebugLinkSymbols(t *testing.T) {
+	if _, err := exec.LookPath("nm"); err != nil {
+		t.Skip("nm not available")
+	}
+	b := &Binutils{}
+	b.SetFastSymbolization(true)
+	f, err := b.Open(debugLinkBinary, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+	syms, err := f.Symbols(regexp.MustCompile("debuglink_target"), 0)
+	if err != nil {
+		t.Fatalf("Symbols: %v", err)
+	}
+	if len(syms) != 1 || syms[0].File != debugLinkBinary {
+		t.Errorf("Symbols: got %v, want debuglink_target in %s", syms, debugLinkBinary)
+	}
+}
+
+func copyFile(t *testing.T, src, dst string) {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dst, data, 0755); err != nil {
+		t.Fatal(err)
+	}
+}
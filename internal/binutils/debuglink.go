@@ -0,0 +1,102 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package binutils
+
+import (
+	"bytes"
+	"debug/elf"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// globalDebugDir is the global directory searched for debug files. It
+// is a variable so it can be redefined during testing.
+var globalDebugDir = "/usr/lib/debug"
+
+// findDebugLink returns the separate debug file named by the
+// .gnu_debuglink section of ef, the ELF file at name. As done by gdb,
+// the debug file is searched for in the directory of name, in its
+// .debug subdirectory, and under the global debug directory, and must
+// match the CRC recorded in the section. It returns "" if ef has no
+// debug link or no matching debug file is found.
+func findDebugLink(ef *elf.File, name string) string {
+	s := ef.Section(".gnu_debuglink")
+	if s == nil {
+		return ""
+	}
+	data, err := s.Data()
+	if err != nil {
+		return ""
+	}
+	// The section holds a NUL terminated file name, padded to a
+	// multiple of 4 bytes, followed by the CRC32 of the debug file.
+	end := bytes.IndexByte(data, 0)
+	if end <= 0 {
+		return ""
+	}
+	link := string(data[:end])
+	crcOffset := (end + 4) &^ 3
+	if len(data) < crcOffset+4 {
+		return ""
+	}
+	crc := ef.ByteOrder.Uint32(data[crcOffset:])
+
+	dir, err := filepath.Abs(filepath.Dir(name))
+	if err != nil {
+		return ""
+	}
+	for _, candidate := range []string{
+		filepath.Join(dir, link),
+		filepath.Join(dir, ".debug", link),
+		filepath.Join(globalDebugDir, dir, link),
+	} {
+		if sameFile(candidate, name) {
+			continue
+		}
+		if c, err := fileCRC(candidate); err == nil && c == crc {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// fileCRC returns the CRC32 of the contents of the file at name.
+func fileCRC(name string) (uint32, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	h := crc32.NewIEEE()
+	if _, err := io.Copy(h, f); err != nil {
+		return 0, err
+	}
+	return h.Sum32(), nil
+}
+
+// sameFile reports whether a and b name the same existing file.
+func sameFile(a, b string) bool {
+	fa, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	fb, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(fa, fb)
+}
@@ -0,0 +1,10 @@
+#include <stdio.h>
+
+int debuglink_target(int n) {
+  return n * 2;
+}
+
+int main(void) {
+  printf("%d\n", debuglink_target(21));
+  return 0;
+}
@@ -0,0 +1,141 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/google/pprof/internal/plugin"
+	"github.com/google/pprof/profile"
+)
+
+// isArchive reports whether path names a tar or zip archive, which is
+// read as a collection of profiles.
+func isArchive(path string) bool {
+	for _, suffix := range []string{".tar", ".tar.gz", ".tgz", ".zip"} {
+		if strings.HasSuffix(path, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchArchive reads all the profiles in the archive at path, and
+// merges them as if they were fetched from separate sources. Entries
+// that are not profiles, or decompress to more than maxSize bytes, are
+// skipped with a warning.
+func fetchArchive(path string, maxSize int64, ui plugin.UI) (*profile.Profile, error) {
+	var profiles []*profile.Profile
+	var names []string
+	add := func(name string, r io.Reader) error {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("%s: %s: %v", path, name, err)
+		}
+		p, err := parseProfileData(data, maxSize)
+		if err != nil {
+			ui.PrintErr("Skipping ", path, ": ", name, ": ", err)
+			return nil
+		}
+		profiles = append(profiles, p)
+		names = append(names, path+": "+name)
+		return nil
+	}
+
+	var err error
+	if strings.HasSuffix(path, ".zip") {
+		err = readZip(path, add)
+	} else {
+		err = readTar(path, add)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(profiles) == 0 {
+		return nil, fmt.Errorf("%s: no profiles found in archive", path)
+	}
+	p, _, err := combineProfiles(profiles, names, nil, nil, nil)
+	return p, err
+}
+
+// readTar calls add with the name and contents of each regular file in
+// the tar archive at path, which may be gzipped.
+func readTar(path string, add func(name string, r io.Reader) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if !strings.HasSuffix(path, ".tar") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		if !hdr.FileInfo().Mode().IsRegular() {
+			continue
+		}
+		if err := add(hdr.Name, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// readZip calls add with the name and contents of each file in the zip
+// archive at path.
+func readZip(path string, add func(name string, r io.Reader) error) error {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	for _, zf := range zr.File {
+		if !zf.Mode().IsRegular() {
+			continue
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			return fmt.Errorf("%s: %s: %v", path, zf.Name, err)
+		}
+		err = add(zf.Name, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
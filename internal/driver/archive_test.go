@@ -0,0 +1,139 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/pprof/internal/proftest"
+	"github.com/google/pprof/profile"
+)
+
+type archiveEntry struct {
+	name string
+	data []byte
+}
+
+func TestFetchArchive(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/go.crc32.cpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := profile.ParseData(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wantTotal int64
+	for _, s := range want.Sample {
+		wantTotal += 2 * s.Value[1]
+	}
+
+	dir, err := ioutil.TempDir("", "pprof")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	entries := []archiveEntry{
+		{"profiles/cpu1.pb.gz", data},
+		{"README", []byte("not a profile\n")},
+		{"profiles/cpu2.pb.gz", data},
+	}
+	for _, name := range []string{"profiles.tar", "profiles.tar.gz", "profiles.tgz", "profiles.zip"} {
+		path := filepath.Join(dir, name)
+		if strings.HasSuffix(name, ".zip") {
+			writeZip(t, path, entries)
+		} else {
+			writeTar(t, path, entries)
+		}
+
+		// The junk entry is skipped with a warning.
+		p, _, _, err := fetch(context.Background(), path, 0, 0, &source{}, &proftest.TestUI{T: t, Ignore: 1})
+		if err != nil {
+			t.Fatalf("%s: fetch: %v", name, err)
+		}
+		var total int64
+		for _, s := range p.Sample {
+			total += s.Value[1]
+		}
+		if total != wantTotal {
+			t.Errorf("%s: got total %d, want %d for two profiles", name, total, wantTotal)
+		}
+	}
+
+	path := filepath.Join(dir, "junk.tar")
+	writeTar(t, path, entries[1:2])
+	if _, _, _, err := fetch(context.Background(), path, 0, 0, &source{}, &proftest.TestUI{T: t, Ignore: 1}); err == nil {
+		t.Errorf("fetch(%s): want error for archive without profiles", path)
+	}
+}
+
+// writeTar writes entries to a tar archive at path, gzipped unless
+// path ends in .tar.
+func writeTar(t *testing.T, path string, entries []archiveEntry) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var w io.Writer = f
+	if !strings.HasSuffix(path, ".tar") {
+		gz := gzip.NewWriter(f)
+		defer gz.Close()
+		w = gz
+	}
+	tw := tar.NewWriter(w)
+	defer tw.Close()
+	if err := tw.WriteHeader(&tar.Header{Name: "profiles/", Typeflag: tar.TypeDir, Mode: 0755}); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if err := tw.WriteHeader(&tar.Header{Name: e.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(e.data))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(e.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// writeZip writes entries to a zip archive at path.
+func writeZip(t *testing.T, path string, entries []archiveEntry) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	defer zw.Close()
+	for _, e := range entries {
+		w, err := zw.Create(e.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(e.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
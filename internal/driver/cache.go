@@ -0,0 +1,104 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/pprof/internal/plugin"
+	"github.com/google/pprof/profile"
+)
+
+// profileCache is an on-disk cache of profiles fetched over HTTP,
+// keyed by their URL, which includes the profile duration.
+type profileCache struct {
+	dir string
+	ttl time.Duration
+
+	// refresh skips cache lookups, but still stores fetched profiles.
+	refresh bool
+}
+
+// newProfileCache returns a cache holding profiles for ttl. The cache
+// is stored in PPROF_CACHE_DIR, which defaults to a cache directory
+// under the temp dir selected by setTmpDir.
+func newProfileCache(ttl time.Duration, refresh bool, ui plugin.UI) (*profileCache, error) {
+	dir := os.Getenv("PPROF_CACHE_DIR")
+	if dir == "" {
+		tmpDir, err := setTmpDir(ui)
+		if err != nil {
+			return nil, err
+		}
+		dir = filepath.Join(tmpDir, "cache")
+	}
+	return &profileCache{dir: dir, ttl: ttl, refresh: refresh}, nil
+}
+
+// path returns the name of the file caching the profile for url.
+func (c *profileCache) path(url string) string {
+	return filepath.Join(c.dir, fmt.Sprintf("%x.pb.gz", sha256.Sum256([]byte(url))))
+}
+
+// get returns the cached profile for url, or nil if there is no
+// cached profile younger than the cache TTL.
+func (c *profileCache) get(url string) *profile.Profile {
+	if c.refresh {
+		return nil
+	}
+	path := c.path(url)
+	fi, err := os.Stat(path)
+	if err != nil || time.Since(fi.ModTime()) > c.ttl {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	p, err := profile.Parse(f)
+	if err != nil {
+		return nil
+	}
+	return p
+}
+
+// put stores p in the cache for url. The profile is written to a
+// temporary file first, so that a failed write never leaves a partial
+// profile in the cache.
+func (c *profileCache) put(url string, p *profile.Profile) error {
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(c.dir, "tmp.")
+	if err != nil {
+		return err
+	}
+	err = p.Write(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), c.path(url))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
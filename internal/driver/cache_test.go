@@ -0,0 +1,102 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/pprof/internal/proftest"
+)
+
+func TestProfileCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pprof-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	savedHTTPGet := httpGet
+	defer func() { httpGet = savedHTTPGet }()
+	var requests int
+	httpGet = func(ctx context.Context, source string, timeout time.Duration, opts httpOptions) (*http.Response, error) {
+		requests++
+		return stubHTTPGet(ctx, source, timeout, opts)
+	}
+
+	cache := &profileCache{dir: dir, ttl: time.Hour}
+	s := &source{Cache: cache}
+	ui := &proftest.TestUI{T: t}
+	const src = "http://localhost/profile?file=cppbench.cpu"
+	grab := func() error {
+		_, msrc, remote, err := grabProfile(context.Background(), s, src, 1, nil, testObj{}, ui)
+		if err == nil && (!remote || len(msrc) == 0) {
+			t.Errorf("grabProfile(%s): want mapping sources for a remote profile", src)
+		}
+		return err
+	}
+
+	for i, want := range []int{1, 1} {
+		if err := grab(); err != nil {
+			t.Fatalf("grabProfile: %v", err)
+		}
+		if requests != want {
+			t.Errorf("fetch %d: got %d requests, want %d", i, requests, want)
+		}
+	}
+
+	cache.refresh = true
+	if err := grab(); err != nil {
+		t.Fatalf("grabProfile: %v", err)
+	}
+	if requests != 2 {
+		t.Errorf("refresh: got %d requests, want 2", requests)
+	}
+	cache.refresh = false
+
+	// Expired profiles are fetched again.
+	sourceURL, _ := adjustURL(src, 0, 0)
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(cache.path(sourceURL), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := grab(); err != nil {
+		t.Fatalf("grabProfile: %v", err)
+	}
+	if requests != 3 {
+		t.Errorf("expired: got %d requests, want 3", requests)
+	}
+
+	// Failed fetches are not cached.
+	const bad = "http://localhost/profile?file=missing"
+	if _, _, _, err := grabProfile(context.Background(), s, bad, 1, nil, testObj{}, ui); err == nil {
+		t.Fatalf("grabProfile(%s): want error", bad)
+	}
+	badURL, _ := adjustURL(bad, 0, 0)
+	if _, err := os.Stat(cache.path(badURL)); !os.IsNotExist(err) {
+		t.Errorf("failed fetch of %s was cached", bad)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("got %d files in the cache, want 1", len(files))
+	}
+}
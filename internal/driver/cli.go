@@ -15,12 +15,21 @@
 package driver
 
 import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"fmt"
+	"net/http"
+	"net/url"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/pprof/internal/binutils"
 	"github.com/google/pprof/internal/plugin"
+	"github.com/google/pprof/profile"
 )
 
 type source struct {
@@ -31,7 +40,174 @@ type source struct {
 
 	Seconds   int
 	Timeout   int
+	Retries   int
 	Symbolize string
+	// SymbolizeFilter, if set, restricts symbolization to the mappings
+	// whose file or build id it matches, leaving the others raw.
+	SymbolizeFilter *regexp.Regexp
+
+	// MaxProfileSize is the maximum size in bytes of a profile fetched
+	// over HTTP, or 0 for no limit.
+	MaxProfileSize int64
+	// MaxDecompressedSize is the maximum size in bytes of a profile
+	// once decompressed, or 0 for no limit.
+	MaxDecompressedSize int64
+
+	// SourceTimeouts overrides Timeout, in seconds, for the sources
+	// it contains.
+	SourceTimeouts map[string]int
+
+	// SourceBinaryPaths holds the paths to search for the binaries of
+	// the profiles fetched from the sources it contains, before
+	// PPROF_BINARY_PATH, as a list of directories like it.
+	SourceBinaryPaths map[string]string
+
+	// PeriodOverride, if set, is the period of the merged profile,
+	// overriding those of the sources.
+	PeriodOverride *periodOverride
+	// NormalizeSources scales the profiles of all sources to the same
+	// total before merging, so that they contribute equally.
+	NormalizeSources bool
+
+	// RangeLast, if set, requests the profile data for this last
+	// duration from remote sources, with from and to parameters.
+	RangeLast time.Duration
+
+	// MappingFiles maps the files of mappings to the local binaries to
+	// use for them instead of searching for binaries. Unless
+	// ForceMappingFiles is set, the binaries must match the build id of
+	// the mappings.
+	MappingFiles      map[string]string
+	ForceMappingFiles bool
+	// BinaryDigests maps build ids, or else base names, of binaries to
+	// the SHA256 digests in hex the binaries used for them must have.
+	BinaryDigests map[string]string
+	// StripPaths are the path prefixes to rewrite in the file names of
+	// functions, eg to share profiles without absolute paths.
+	StripPaths []pathPrefix
+
+	// SourceGroups is the file defining the groups of sources that
+	// sources of the form @name expand to.
+	SourceGroups string
+
+	// Scales and BaseScales hold the factors to scale each of Sources
+	// and Base by, if set. They default to 1 and -1 respectively.
+	Scales     []float64
+	BaseScales []float64
+
+	// HTTPHeader is added to every HTTP request made to fetch a
+	// profile. It must not be reported to the user.
+	HTTPHeader http.Header
+	// HTTPAuthToken returns the bearer token for each HTTP request,
+	// if set. Its tokens must not be reported either.
+	HTTPAuthToken func(url string) (string, error)
+	// HTTPTransport, if set, sends the HTTP requests for profiles
+	// instead of the built-in transport, ignoring HTTPProxy and
+	// TLSConfig.
+	HTTPTransport http.RoundTripper
+	// FetchEvents is called with events tracking the fetch of each
+	// source, if set.
+	FetchEvents func(*plugin.FetchEvent)
+	// HTTPProxy overrides the proxy selected from the environment.
+	HTTPProxy *url.URL
+	// CheckFetchAddr refuses HTTP connections to some addresses.
+	CheckFetchAddr addrCheck
+	// TLSConfig holds the client certificates and CAs for fetching
+	// profiles over https, if set.
+	TLSConfig *tls.Config
+	// FetchConcurrency is the maximum number of profiles fetched at once.
+	FetchConcurrency int
+	// MemoryBudget is the approximate size in bytes of the merged
+	// profile past which no more chunks of sources are fetched, or 0
+	// for no limit.
+	MemoryBudget int64
+	// FetchStagger is the maximum random delay before each fetch of a
+	// time-based profile, to spread out concurrent fetches.
+	FetchStagger time.Duration
+	// Cache holds profiles fetched over HTTP, if caching is enabled.
+	Cache *profileCache
+	// PerfConverter is the tool converting perf.data files to profiles,
+	// and PerfConverterStdout is set if it can write them to stdout.
+	PerfConverter       string
+	PerfConverterStdout bool
+	// JFRConverter is the tool converting Java Flight Recorder files
+	// to profiles.
+	JFRConverter string
+	// TraceConverter is the tool converting Go execution traces to
+	// profiles.
+	TraceConverter string
+	// Transform is applied to each profile fetched before merging, if
+	// set.
+	Transform func(source string, p *profile.Profile) error
+	// ProfileData holds raw profiles to parse instead of fetching
+	// their sources.
+	ProfileData map[string][]byte
+
+	// KeepSeparate keeps the fetched profiles separate, to be selected
+	// as datasets in interactive mode, in addition to merging them.
+	KeepSeparate bool
+
+	// SourceLabels labels the samples of each profile with its source.
+	SourceLabels bool
+
+	// MappingSourcesByRange keys the sources of mappings without a
+	// build id by their file, offset and size, rather than only their
+	// file.
+	MappingSourcesByRange bool
+
+	// KeepMappingSources leaves the source URLs set as the file of
+	// mappings without a build id or file after symbolization.
+	KeepMappingSources bool
+
+	// FetchComments records the sources and time of the fetch as
+	// comments in the saved profile.
+	FetchComments bool
+
+	// NoPrune keeps the frames that profiles mark as uninteresting in
+	// their drop_frames, eg runtime frames, instead of removing them.
+	NoPrune bool
+	// RemoteBinaries looks up the binaries of mappings with a build id
+	// only on symbol servers and debuginfod, never searching locally.
+	RemoteBinaries bool
+	// Offline refuses remote sources, and only uses binaries already
+	// downloaded from symbol servers and debuginfod.
+	Offline bool
+	// FetchTimings reports the time taken to fetch each source.
+	FetchTimings bool
+	// FetchSummary is the file to write a JSON summary of the fetch
+	// of each source and of the merged profile to, if set.
+	FetchSummary string
+
+	// StrictFetch fails the fetch if any source cannot be fetched,
+	// instead of merging the profiles from the other sources.
+	StrictFetch bool
+
+	// NoSave disables saving a copy of profiles fetched from remote
+	// sources.
+	NoSave bool
+	// InMemory keeps fetched profiles only in memory for the session:
+	// they are neither saved nor cached, and nothing is written to the
+	// temp dir. Cache is not set in this mode.
+	InMemory bool
+	// SaveName is the template for the names of saved profiles, and
+	// SaveTag the tag it may include, as expanded by savedName.
+	SaveName string
+	SaveTag  string
+
+	// DryRun lists the sources that would be fetched instead of
+	// fetching them.
+	DryRun bool
+
+	// PrecheckURL is a health check URL to GET before fetching each
+	// profile, either absolute or relative to the profile source.
+	PrecheckURL string
+
+	// ServeSaved is the address to serve saved profiles on, instead
+	// of fetching a profile.
+	ServeSaved string
+	// MergeOnly is the file to write the merged profiles of the local
+	// files in Sources to, instead of generating reports.
+	MergeOnly string
 }
 
 // Parse parses the command lines through the specified flags package
@@ -41,11 +217,17 @@ func parseFlags(o *plugin.Options) (*source, []string, error) {
 	flag := o.Flagset
 	// Comparisons.
 	flagBase := flag.StringList("base", "", "Source for base profile for comparison")
+	flagScale := flag.StringList("scale", "", "Factor to scale each profile by")
+	flagBaseScale := flag.StringList("base_scale", "", "Factor to scale each base profile by")
 	// Internal options.
 	flagSymbolize := flag.String("symbolize", "", "Options for profile symbolization")
+	flagSymbolizeFilter := flag.String("symbolize_filter", "", "Only symbolize the mappings whose file or build id matches this regexp")
 	flagBuildID := flag.String("buildid", "", "Override build id for first mapping")
 	// CPU profile options
 	flagSeconds := flag.Int("seconds", -1, "Length of time for dynamic profiles")
+	flagPeriod := flag.String("period", "", "Period of the merged profile, as value or type/unit=value, overriding those of the sources")
+	flagNormalizeSources := flag.Bool("normalize_sources", false, "Scale each source to the same total before merging, so that all contribute equally")
+	flagRange := flag.String("range", "", "Time range of the profile data to request from continuous profiling servers, as \"last 5m\"")
 	// Heap profile options
 	flagInUseSpace := flag.Bool("inuse_space", false, "Display in-use memory size")
 	flagInUseObjects := flag.Bool("inuse_objects", false, "Display in-use object counts")
@@ -58,6 +240,38 @@ func parseFlags(o *plugin.Options) (*source, []string, error) {
 	flagTools := flag.String("tools", os.Getenv("PPROF_TOOLS"), "Path for object tool pathnames")
 
 	flagTimeout := flag.Int("timeout", -1, "Timeout in seconds for fetching a profile")
+	flagSourceTimeout := flag.StringList("source_timeout", "", "Timeout in seconds for fetching a single profile, as source=seconds")
+	flagSourceBinaryPath := flag.StringList("source_binary_path", "", "Path to search for the binaries of a single profile first, as source=path")
+	flagMappingFile := flag.StringList("mapping_file", "", "Local binary to use for the mappings of a file, as file=binary")
+	flagForceMappingFiles := flag.Bool("force_mapping_files", false, "Use the binaries given by -mapping_file even if their build id does not match")
+	flagBinarySHA256 := flag.StringList("binary_sha256", "", "SHA256 digest the binary for a build id or base name must have, as key=digest")
+	flagStripPath := flag.StringList("strip_path", "", "Path prefix to strip from source file names, or to replace as prefix=replacement")
+	flagMaxProfileSize := flag.Int("max_profile_size", 0, "Maximum size in bytes of a profile fetched over HTTP, 0 for no limit")
+	flagMemoryBudget := flag.Int("memory_budget", 0, "Approximate size in bytes of the merged profile past which to stop fetching sources, 0 for no limit")
+	flagMaxDecompressedSize := flag.Int("max_decompressed_size", defaultMaxDecompressedSize, "Maximum size in bytes of a profile once decompressed, 0 for no limit")
+	flagFetchStagger := flag.Int("fetch_stagger", 0, "Maximum random delay in milliseconds before fetching each time-based profile")
+	flagRetries := flag.Int("retries", 2, "Retries for transient failures fetching a profile over HTTP")
+	flagCacheTTL := flag.Int("cache_ttl", 0, "Seconds to cache profiles fetched over HTTP")
+	flagCacheRefresh := flag.Bool("cache_refresh", false, "Refetch cached profiles")
+	flagKeepSeparate := flag.Bool("keep_separate", false, "Keep fetched profiles separate in interactive mode")
+	flagMappingSourcesByRange := flag.Bool("mapping_sources_by_range", false, "Tell apart binaries without build id by mapping offset and size when symbolizing remotely")
+	flagSourceLabels := flag.Bool("source_labels", false, "Label samples with the source they were fetched from")
+	flagStrictFetch := flag.Bool("strict_fetch", false, "Fail if any profile cannot be fetched, instead of merging the others")
+	flagNoPrune := flag.Bool("no_prune", false, "Keep the frames profiles mark as uninteresting, eg runtime frames")
+	flagRemoteBinaries := flag.Bool("remote_binaries", false, "Look up binaries with a build id only on symbol servers and debuginfod, not locally")
+	flagOffline := flag.Bool("offline", false, "Refuse any network access, only reading local profiles and binaries")
+	flagFetchSummary := flag.String("fetch_summary", "", "File to write a JSON summary of the fetched sources and merged profile to")
+	flagFetchTimings := flag.Bool("fetch_timings", false, "Report the time taken to fetch each profile, slowest first")
+	flagDryRun := flag.Bool("dry_run", false, "List the URLs and timeouts to fetch profiles from, without fetching them")
+	flagNoSave := flag.Bool("no_save", false, "Do not save a copy of profiles fetched from remote sources")
+	flagInMemory := flag.Bool("in_memory", false, "Keep fetched profiles in memory only, without saving or caching them on disk")
+	flagSaveName := flag.String("save_name", os.Getenv("PPROF_SAVE_NAME"), "Template for the names of saved profiles, with {binary}, {types} and {tag}")
+	flagSaveTag := flag.String("save_tag", "", "Tag to include in the names of saved profiles, eg a commit or experiment")
+	flagFetchComments := flag.Bool("fetch_comments", true, "Record the sources and time of fetching in saved profiles")
+	flagSourceGroups := flag.String("source_groups", os.Getenv("PPROF_SOURCE_GROUPS"), "File defining the groups of sources to fetch for sources of the form @name")
+	flagPrecheckURL := flag.String("precheck_url", "", "Health check URL that must return 200 before fetching a profile")
+	flagServeSaved := flag.String("serve_saved", "", "Serve saved profiles over HTTP on [host]:port")
+	flagMergeOnly := flag.String("merge_only", "", "Merge the local profile files given as sources into this file, and exit")
 
 	// Flags used during command processing
 	installedFlags := installFlags(flag)
@@ -79,9 +293,15 @@ func parseFlags(o *plugin.Options) (*source, []string, error) {
 			flag.ExtraUsage() +
 			usageMsgVars)
 	})
+	if *flagServeSaved != "" {
+		return &source{ServeSaved: *flagServeSaved}, nil, nil
+	}
 	if len(args) == 0 {
 		return nil, nil, fmt.Errorf("no profile source specified")
 	}
+	if *flagMergeOnly != "" {
+		return &source{Sources: args, MergeOnly: *flagMergeOnly, MaxDecompressedSize: int64(*flagMaxDecompressedSize)}, nil, nil
+	}
 
 	var execName string
 	// Recognize first argument as an executable or buildid override.
@@ -121,13 +341,105 @@ func parseFlags(o *plugin.Options) (*source, []string, error) {
 		pprofVariables.set("mean", "true")
 	}
 
+	header := o.HTTPHeader
+	if header == nil {
+		var err error
+		if header, err = parseHTTPHeader(os.Getenv("PPROF_HTTP_HEADERS")); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	tlsConfig := o.TLSConfig
+	if tlsConfig == nil {
+		var err error
+		if tlsConfig, err = loadTLSConfig(os.Getenv("PPROF_TLS_CERT"), os.Getenv("PPROF_TLS_KEY"), os.Getenv("PPROF_TLS_CA")); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	concurrency := o.FetchConcurrency
+	if env := os.Getenv("PPROF_FETCH_CONCURRENCY"); concurrency == 0 && env != "" {
+		var err error
+		if concurrency, err = strconv.Atoi(env); err != nil {
+			return nil, nil, fmt.Errorf("invalid PPROF_FETCH_CONCURRENCY %q: %v", env, err)
+		}
+		if concurrency < 1 {
+			return nil, nil, fmt.Errorf("invalid PPROF_FETCH_CONCURRENCY %q: must be at least 1", env)
+		}
+	}
+	if concurrency < 0 {
+		return nil, nil, fmt.Errorf("invalid fetch concurrency %d: must be at least 1", concurrency)
+	}
+
+	perfConverter := o.PerfConverter
+	if perfConverter == "" {
+		perfConverter = os.Getenv("PPROF_PERF_CONVERTER")
+	}
+	jfrConverter := o.JFRConverter
+	if jfrConverter == "" {
+		jfrConverter = os.Getenv("PPROF_JFR_CONVERTER")
+	}
+	traceConverter := o.TraceConverter
+	if traceConverter == "" {
+		traceConverter = os.Getenv("PPROF_TRACE_CONVERTER")
+	}
+
 	source := &source{
 		Sources:   args,
 		ExecName:  execName,
 		BuildID:   *flagBuildID,
 		Seconds:   *flagSeconds,
 		Timeout:   *flagTimeout,
+		Retries:   *flagRetries,
 		Symbolize: *flagSymbolize,
+
+		MaxProfileSize:      int64(*flagMaxProfileSize),
+		MemoryBudget:        int64(*flagMemoryBudget),
+		MaxDecompressedSize: int64(*flagMaxDecompressedSize),
+		SourceGroups:        *flagSourceGroups,
+		FetchStagger:        time.Duration(*flagFetchStagger) * time.Millisecond,
+
+		HTTPHeader:            header,
+		HTTPAuthToken:         o.HTTPAuthToken,
+		HTTPTransport:         o.HTTPTransport,
+		FetchEvents:           o.FetchEvents,
+		HTTPProxy:             o.HTTPProxy,
+		CheckFetchAddr:        o.CheckFetchAddr,
+		TLSConfig:             tlsConfig,
+		FetchConcurrency:      concurrency,
+		PrecheckURL:           *flagPrecheckURL,
+		SourceLabels:          *flagSourceLabels,
+		MappingSourcesByRange: *flagMappingSourcesByRange,
+		KeepSeparate:          *flagKeepSeparate || hasBraces(args),
+		NormalizeSources:      *flagNormalizeSources,
+		FetchComments:         *flagFetchComments,
+		NoSave:                o.NoSave || *flagNoSave,
+		InMemory:              *flagInMemory,
+		SaveName:              *flagSaveName,
+		SaveTag:               *flagSaveTag,
+		DryRun:                *flagDryRun,
+		FetchTimings:          *flagFetchTimings,
+		NoPrune:               *flagNoPrune,
+		RemoteBinaries:        *flagRemoteBinaries,
+		Offline:               *flagOffline,
+		FetchSummary:          *flagFetchSummary,
+		StrictFetch:           *flagStrictFetch,
+		PerfConverter:         perfConverter,
+		JFRConverter:          jfrConverter,
+		TraceConverter:        traceConverter,
+		Transform:             o.Transform,
+		ProfileData:           o.ProfileData,
+
+		PerfConverterStdout: o.PerfConverterStdout || os.Getenv("PPROF_PERF_CONVERTER_STDOUT") != "",
+		KeepMappingSources:  os.Getenv("PPROF_KEEP_MAPPING_SOURCES") != "",
+	}
+
+	if *flagCacheTTL > 0 && !*flagInMemory {
+		cache, err := newProfileCache(time.Duration(*flagCacheTTL)*time.Second, *flagCacheRefresh, o.UI)
+		if err != nil {
+			return nil, nil, err
+		}
+		source.Cache = cache
 	}
 
 	for _, s := range *flagBase {
@@ -135,6 +447,45 @@ func parseFlags(o *plugin.Options) (*source, []string, error) {
 			source.Base = append(source.Base, *s)
 		}
 	}
+	if source.Scales, err = parseScales("scale", *flagScale); err != nil {
+		return nil, nil, err
+	}
+	if source.BaseScales, err = parseScales("base_scale", *flagBaseScale); err != nil {
+		return nil, nil, err
+	}
+	if source.SourceTimeouts, err = parseSourceTimeouts(*flagSourceTimeout); err != nil {
+		return nil, nil, err
+	}
+	if source.SourceBinaryPaths, err = parseSourceBinaryPaths(*flagSourceBinaryPath); err != nil {
+		return nil, nil, err
+	}
+	if *flagSymbolizeFilter != "" {
+		if source.SymbolizeFilter, err = regexp.Compile(*flagSymbolizeFilter); err != nil {
+			return nil, nil, fmt.Errorf("invalid -symbolize_filter: %v", err)
+		}
+	}
+	if source.PeriodOverride, err = parsePeriod(*flagPeriod); err != nil {
+		return nil, nil, err
+	}
+	if source.RangeLast, err = parseRange(*flagRange); err != nil {
+		return nil, nil, err
+	}
+	if source.RangeLast > 0 && source.Seconds > 0 {
+		return nil, nil, fmt.Errorf("-range cannot be combined with -seconds")
+	}
+	if source.MappingFiles, err = parseMappingFiles(*flagMappingFile); err != nil {
+		return nil, nil, err
+	}
+	source.ForceMappingFiles = *flagForceMappingFiles
+	if source.BinaryDigests, err = parseBinaryDigests(*flagBinarySHA256); err != nil {
+		return nil, nil, err
+	}
+	if source.StripPaths, err = parseStripPaths(*flagStripPath); err != nil {
+		return nil, nil, err
+	}
+	if strings.ContainsAny(source.SaveName, `/\`) {
+		return nil, nil, fmt.Errorf("invalid -save_name %q, must not contain path separators", source.SaveName)
+	}
 
 	if bu, ok := o.Obj.(*binutils.Binutils); ok {
 		bu.SetTools(*flagTools)
@@ -240,32 +591,327 @@ func outputFormat(bcmd map[string]*bool, acmd map[string]*string) (cmd []string,
 	return cmd, nil
 }
 
+// parseScales parses the values of a scale flag.
+func parseScales(flag string, values []*string) ([]float64, error) {
+	var scales []float64
+	for _, v := range values {
+		if *v == "" {
+			continue
+		}
+		scale, err := strconv.ParseFloat(*v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -%s %q: %v", flag, *v, err)
+		}
+		scales = append(scales, scale)
+	}
+	return scales, nil
+}
+
+// parseSourceBinaryPaths parses the values of the source_binary_path
+// flag, of the form source=path.
+func parseSourceBinaryPaths(values []*string) (map[string]string, error) {
+	var paths map[string]string
+	for _, v := range values {
+		if *v == "" {
+			continue
+		}
+		// Split at the last '=', as the source may be a URL with a query.
+		i := strings.LastIndex(*v, "=")
+		if i <= 0 || i == len(*v)-1 {
+			return nil, fmt.Errorf("invalid -source_binary_path %q, want source=path", *v)
+		}
+		if paths == nil {
+			paths = make(map[string]string)
+		}
+		paths[(*v)[:i]] = (*v)[i+1:]
+	}
+	return paths, nil
+}
+
+// parseSourceTimeouts parses the values of the source_timeout flag,
+// of the form source=seconds.
+func parseSourceTimeouts(values []*string) (map[string]int, error) {
+	var timeouts map[string]int
+	for _, v := range values {
+		if *v == "" {
+			continue
+		}
+		// Split at the last '=', as the source may be a URL with a query.
+		i := strings.LastIndex(*v, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid -source_timeout %q, want source=seconds", *v)
+		}
+		timeout, err := strconv.Atoi((*v)[i+1:])
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid -source_timeout %q, want a positive number of seconds", *v)
+		}
+		if timeouts == nil {
+			timeouts = make(map[string]int)
+		}
+		timeouts[(*v)[:i]] = timeout
+	}
+	return timeouts, nil
+}
+
+// parseMappingFiles parses the values of the mapping_file flag, of the
+// form file=binary. Giving different binaries for the same file is an
+// error.
+func parseMappingFiles(values []*string) (map[string]string, error) {
+	var files map[string]string
+	for _, v := range values {
+		if *v == "" {
+			continue
+		}
+		i := strings.Index(*v, "=")
+		if i <= 0 || i == len(*v)-1 {
+			return nil, fmt.Errorf("invalid -mapping_file %q, want file=binary", *v)
+		}
+		file, binary := (*v)[:i], (*v)[i+1:]
+		if prev, ok := files[file]; ok && prev != binary {
+			return nil, fmt.Errorf("conflicting -mapping_file for %s: %s and %s", file, prev, binary)
+		}
+		if files == nil {
+			files = make(map[string]string)
+		}
+		files[file] = binary
+	}
+	return files, nil
+}
+
+// parsePeriod parses the value of the period flag, of the form value
+// or type/unit=value, eg cpu/nanoseconds=10000000.
+func parsePeriod(v string) (*periodOverride, error) {
+	if v == "" {
+		return nil, nil
+	}
+	o := &periodOverride{}
+	value := v
+	if i := strings.LastIndex(v, "="); i >= 0 {
+		t := strings.SplitN(v[:i], "/", 2)
+		if len(t) != 2 || t[0] == "" || t[1] == "" {
+			return nil, fmt.Errorf("invalid -period %q, want value or type/unit=value", v)
+		}
+		o.typ = &profile.ValueType{Type: t[0], Unit: t[1]}
+		value = v[i+1:]
+	}
+	period, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || period <= 0 {
+		return nil, fmt.Errorf("invalid -period %q, want a positive value", v)
+	}
+	o.period = period
+	return o, nil
+}
+
+// parseRange parses the value of the range flag, of the form
+// "last duration", eg "last 5m", returning the duration.
+func parseRange(v string) (time.Duration, error) {
+	if v == "" {
+		return 0, nil
+	}
+	fields := strings.Fields(v)
+	if len(fields) != 2 || fields[0] != "last" {
+		return 0, fmt.Errorf("invalid -range %q, want last duration, eg last 5m", v)
+	}
+	d, err := time.ParseDuration(fields[1])
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid -range %q, want a positive duration, eg last 5m", v)
+	}
+	return d, nil
+}
+
+// parseBinaryDigests parses the values of the binary_sha256 flag, of
+// the form key=digest, where key is a build id or the base name of a
+// binary and digest its SHA256 digest in hex.
+func parseBinaryDigests(values []*string) (map[string]string, error) {
+	var digests map[string]string
+	for _, v := range values {
+		if *v == "" {
+			continue
+		}
+		i := strings.LastIndex(*v, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid -binary_sha256 %q, want key=digest", *v)
+		}
+		key, digest := (*v)[:i], strings.ToLower((*v)[i+1:])
+		if b, err := hex.DecodeString(digest); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("invalid -binary_sha256 digest for %s: want %d hex digits", key, 2*sha256.Size)
+		}
+		if prev, ok := digests[key]; ok && prev != digest {
+			return nil, fmt.Errorf("conflicting -binary_sha256 for %s: %s and %s", key, prev, digest)
+		}
+		if digests == nil {
+			digests = make(map[string]string)
+		}
+		digests[key] = digest
+	}
+	return digests, nil
+}
+
+// parseStripPaths parses the values of the strip_path flag, of the form
+// prefix or prefix=replacement.
+func parseStripPaths(values []*string) ([]pathPrefix, error) {
+	var prefixes []pathPrefix
+	for _, v := range values {
+		if *v == "" {
+			continue
+		}
+		prefix, replacement := *v, ""
+		if i := strings.Index(*v, "="); i >= 0 {
+			prefix, replacement = (*v)[:i], (*v)[i+1:]
+		}
+		if prefix = strings.TrimSuffix(prefix, "/"); prefix == "" {
+			return nil, fmt.Errorf("invalid -strip_path %q, want prefix or prefix=replacement", *v)
+		}
+		prefixes = append(prefixes, pathPrefix{prefix, replacement})
+	}
+	return prefixes, nil
+}
+
 var usageMsgHdr = "usage: pprof [options] [-base source] [binary] <source> ...\n"
 
 var usageMsgSrc = "\n\n" +
 	"  Source options:\n" +
 	"    -seconds              Duration for time-based profile collection\n" +
+	"    -range \"last 5m\"      Request the last 5m of data from continuous profiling\n" +
+	"                          servers, with from and to parameters in Unix seconds\n" +
 	"    -timeout              Timeout in seconds for profile collection\n" +
+	"    -source_timeout source=seconds\n" +
+	"                          Timeout for a single source, overriding -timeout\n" +
+	"    -source_binary_path source=path\n" +
+	"                          Search path for the binaries of a single source,\n" +
+	"                          searched before PPROF_BINARY_PATH\n" +
+	"    -retries              Retries after connection errors or 5xx responses\n" +
+	"    -max_profile_size     Maximum size in bytes of a profile fetched over HTTP\n" +
+	"    -memory_budget        Approximate size in bytes of the merged profile in\n" +
+	"                          memory past which to stop fetching more sources\n" +
+	"    -max_decompressed_size\n" +
+	"                          Maximum size in bytes of a profile once decompressed,\n" +
+	"                          guarding against gzip bombs (default 1GiB)\n" +
+	"    -fetch_stagger ms     Spread out fetches of time-based profiles by up to ms\n" +
+	"                          milliseconds each, eg to spare load balancers\n" +
+	"    -cache_ttl            Seconds to reuse profiles fetched over HTTP\n" +
+	"    -cache_refresh        Refetch profiles instead of using cached ones\n" +
 	"    -buildid              Override build id for main binary\n" +
+	"    -period [type/unit=]value\n" +
+	"                          Period of the merged profile, for sources sampled at\n" +
+	"                          different rates, eg cpu/nanoseconds=10000000\n" +
+	"    -normalize_sources    Scale sources to the same total before merging, to\n" +
+	"                          average them regardless of their durations\n" +
+	"    -mapping_file file=binary\n" +
+	"                          Use binary for the mappings of file, eg for binaries\n" +
+	"                          renamed or moved since the profile was collected\n" +
+	"    -force_mapping_files  Use -mapping_file binaries despite build id mismatches\n" +
+	"    -remote_binaries      Only look up binaries with a build id by build id on\n" +
+	"                          symbol servers and debuginfod, skipping local search\n" +
+	"    -binary_sha256 key=digest\n" +
+	"                          Only use binaries with this SHA256 digest for the\n" +
+	"                          build id or base name key\n" +
+	"    -strip_path prefix[=replacement]\n" +
+	"                          Strip prefix from source file names, or replace it,\n" +
+	"                          eg -strip_path=$HOME=~, before sharing profiles\n" +
 	"    -base source          Source of profile to use as baseline\n" +
+	"    -scale factor         Scale each profile, eg to normalize durations\n" +
+	"                          Repeat once per profile source, defaults to 1\n" +
+	"    -base_scale factor    Scale each base profile, defaults to -1\n" +
+	"    -keep_separate        Keep profiles separate, see the dataset command\n" +
+	"    -source_labels        Label samples with source=<host:port or file>\n" +
+	"                          Not applied to -base profiles\n" +
+	"    -mapping_sources_by_range\n" +
+	"                          Symbolize binaries without build id separately\n" +
+	"                          by offset and size, not only by path\n" +
+	"    -source_groups file   File of groups of sources to fetch for @name sources\n" +
+	"                          with lines of the form name: source1 source2 ...\n" +
+	"                          default: $HOME/pprof/source_groups\n" +
+	"    -precheck_url url     Skip sources whose health check does not return 200\n" +
+	"                          url may be a path, eg /healthz, on the source host\n" +
+	"    -no_prune             Keep frames profiles mark as uninteresting, eg to\n" +
+	"                          debug the runtime scheduler or garbage collector\n" +
+	"    -no_save              Do not save a copy of remote profiles\n" +
+	"    -in_memory            Keep profiles in memory only, without saving or\n" +
+	"                          caching them, eg on ephemeral containers\n" +
+	"    -save_name template   Name saved profiles after template, which may include\n" +
+	"                          {binary}, {types} and {tag}\n" +
+	"                          default: pprof.{binary}.{types}.{tag}\n" +
+	"    -save_tag tag         Tag to include in saved profile names\n" +
+	"    -dry_run              List the URLs and timeouts to fetch, without fetching\n" +
+	"    -fetch_timings        Report the time taken to fetch each profile\n" +
+	"    -fetch_summary file   Write a JSON summary of the fetch to file, eg for CI\n" +
+	"    -strict_fetch         Fail if any source cannot be fetched, eg for benchmarks\n" +
+	"    -offline              Refuse remote sources and symbol downloads, only using\n" +
+	"                          local files and binaries already downloaded\n" +
+	"    -fetch_comments=false\n" +
+	"                          Do not record sources and fetch time in saved profiles\n" +
 	"    profile.pb.gz         Profile in compressed protobuf format\n" +
 	"    legacy_profile        Profile in legacy pprof format\n" +
+	"    -                     Profile read from standard input\n" +
+	"    data:;base64,...      Small profile inlined in a data URL\n" +
+	"    @name                 Group of sources defined in -source_groups\n" +
+	"    @file:path            Sources listed in path, one per line\n" +
+	"    profiles.tar.gz       Archive of profiles to merge, also .tar, .tgz or .zip\n" +
 	"    http://host/profile   URL for profile handler to retrieve\n" +
+	"    host/debug/pprof/{profile,heap}\n" +
+	"                          Sources for each alternative in braces, kept\n" +
+	"                          separate as with -keep_separate\n" +
+	"    unix:///path/to/socket:/profile\n" +
+	"                          Profile handler served on a Unix domain socket\n" +
 	"    -symbolize=           Controls source of symbol information\n" +
 	"      none                  Do not attempt symbolization\n" +
 	"      local                 Examine only local binaries\n" +
 	"      fastlocal             Only get function names from local binaries\n" +
 	"      remote                Do not examine local binaries\n" +
 	"      force                 Force re-symbolization\n" +
+	"    -symbolize_filter regexp\n" +
+	"                          Only symbolize mappings whose file or build id\n" +
+	"                          matches regexp, eg to speed up huge profiles\n" +
 	"    Binary                  Local path or build id of binary for symbolization\n"
 
 var usageMsgVars = "\n\n" +
 	"  Misc options:\n" +
 	"   -tools                 Search path for object tools\n" +
+	"   -serve_saved           Serve saved profiles over HTTP on [host]:port\n" +
+	"                          host defaults to localhost\n" +
+	"   -merge_only file       Merge the local profile files given as sources into\n" +
+	"                          file, without symbolizing them, and exit\n" +
 	"\n" +
 	"  Environment Variables:\n" +
-	"   PPROF_TMPDIR       Location for temporary files (default $HOME/pprof)\n" +
+	"   PPROF_TMPDIR       Location for temporary files (default $HOME/pprof,\n" +
+	"                      or $XDG_CACHE_HOME/pprof on Linux if set)\n" +
 	"   PPROF_TOOLS        Search path for object-level tools\n" +
 	"   PPROF_BINARY_PATH  Search path for local binary files\n" +
 	"                      default: $HOME/pprof/binaries\n" +
-	"                      finds binaries by $name and $buildid/$name\n"
+	"                      finds binaries by $name and $buildid/$name\n" +
+	"   PPROF_SYMBOL_SERVER\n" +
+	"                      URL template to download binaries missing locally\n" +
+	"                      from, with {buildid} and {basename} substituted\n" +
+	"   PPROF_SYMBOL_CACHE_DIR\n" +
+	"                      Location for binaries from PPROF_SYMBOL_SERVER\n" +
+	"                      default: $HOME/pprof/symbols\n" +
+	"   PPROF_CACHE_DIR    Location for profiles cached with -cache_ttl\n" +
+	"                      default: $PPROF_TMPDIR/cache\n" +
+	"   PPROF_FETCH_CONCURRENCY\n" +
+	"                      Maximum number of profiles fetched at once\n" +
+	"                      default: 64\n" +
+	"   PPROF_PERF_CONVERTER\n" +
+	"                      Tool converting perf.data files to profiles\n" +
+	"                      default: perf_to_profile\n" +
+	"   PPROF_PERF_CONVERTER_STDOUT\n" +
+	"                      If set, the converter writes to stdout given -\n" +
+	"   PPROF_JFR_CONVERTER\n" +
+	"                      Tool converting Java Flight Recorder files\n" +
+	"                      default: jfr_to_profile\n" +
+	"   PPROF_TRACE_CONVERTER\n" +
+	"                      Tool converting Go execution traces\n" +
+	"                      default: trace_to_profile\n" +
+	"   PPROF_HTTP_HEADERS Headers for fetching profiles over HTTP\n" +
+	"                      newline separated, eg 'Authorization: Bearer token'\n" +
+	"   PPROF_TLS_CERT, PPROF_TLS_KEY\n" +
+	"                      Client certificate and key PEM files for https\n" +
+	"   PPROF_TLS_CA       CA PEM file to verify https servers with\n" +
+	"   GODEBUG=http2client=0\n" +
+	"                      Fetch over HTTP/1.1 only, not negotiating HTTP/2\n" +
+	"   PPROF_SAVE_NAME    Template for saved profile names, see -save_name\n" +
+	"   PPROF_SOURCE_GROUPS\n" +
+	"                      File of groups of sources, see -source_groups\n" +
+	"   PPROF_KEEP_MAPPING_SOURCES\n" +
+	"                      If set, unsymbolized mappings without a file keep\n" +
+	"                      the URL of their source as file, for debugging\n"
@@ -161,6 +161,15 @@ var pprofVariables = variables{
 		" auto will scale each value independently to the most natural unit.")},
 	"compact_labels": &variable{boolKind, "f", "", "Show minimal headers"},
 	"source_path":    &variable{stringKind, "", "", "Search path for source files"},
+	"colors": &variable{stringKind, "default", "", helpText(
+		"Color scheme for graph reports",
+		"Use one of default, viridis, grayscale (for printing) or",
+		"colorblind (orange/blue, safe for color blind users).")},
+	"cluster_by": &variable{stringKind, "", "", helpText(
+		"Group graph nodes by package or dir",
+		"On graph reports, enclose nodes in boxed clusters labeled",
+		"with the package (package) or source directory (dir) of",
+		"their function. Ignored by other report formats.")},
 
 	// Filtering options
 	"nodecount": &variable{intKind, "-1", "", helpText(
@@ -193,6 +202,15 @@ var pprofVariables = variables{
 		"Only show nodes matching regexp",
 		"If set, only show nodes that match this location.",
 		"Matching includes the function name, filename or object name.")},
+	"only_mapping": &variable{stringKind, "", "", helpText(
+		"Restricts to samples with a frame in a mapping matching regexp",
+		"Discard samples that do not include a location in a mapping",
+		"whose object file name matches this regexp.",
+		"Use only_mapping_leaf to only consider the leaf frame.")},
+	"only_mapping_leaf": &variable{boolKind, "f", "", helpText(
+		"Apply only_mapping to the leaf frame only",
+		"If set, a sample qualifies for only_mapping only if its leaf",
+		"location is in a matching mapping, instead of any frame.")},
 	"tagfocus": &variable{stringKind, "", "", helpText(
 		"Restrict to samples with tags in range or matched by regexp",
 		"Discard samples that do not include a node with a tag matching this regexp.")},
@@ -209,6 +227,11 @@ var pprofVariables = variables{
 	"divide_by": &variable{floatKind, "1", "", helpText(
 		"Ratio to divide all samples before visualization",
 		"Divide all samples values by a constant, eg the number of processors or jobs.")},
+	"graph_ratio": &variable{stringKind, "", "", helpText(
+		"Show graph values as the ratio of two sample types",
+		"Takes the form typeA/typeB, eg alloc_space/alloc_objects to",
+		"display bytes per allocation on each node of a graph.",
+		"Nodes with no samples of typeB are shown with a value of 0.")},
 	"mean": &variable{boolKind, "f", "", helpText(
 		"Average sample value over first value (count)",
 		"For memory profiles, report average memory per allocation.",
@@ -0,0 +1,124 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/pprof/internal/plugin"
+)
+
+// debuginfodTimeout is the timeout for downloads from debuginfod servers.
+const debuginfodTimeout = 60 * time.Second
+
+var buildIDRx = regexp.MustCompile("^[0-9a-fA-F]+$")
+
+// debuginfodFile returns the path of the debug file for buildID, as
+// served by the debuginfod servers listed in DEBUGINFOD_URLS. Debug
+// files are downloaded once into the debuginfod client cache, and only
+// looked up in the cache if offline is set. It returns "" if
+// DEBUGINFOD_URLS is not set or no server has the file.
+func debuginfodFile(buildID string, proxy *url.URL, offline bool, ui plugin.UI) string {
+	servers := strings.Fields(os.Getenv("DEBUGINFOD_URLS"))
+	if len(servers) == 0 || !buildIDRx.MatchString(buildID) {
+		return ""
+	}
+	path := filepath.Join(debuginfodCacheDir(), strings.ToLower(buildID), "debuginfo")
+	if _, err := os.Stat(path); err == nil {
+		return path
+	}
+	if offline {
+		return ""
+	}
+	for _, server := range servers {
+		found, err := downloadDebugInfo(server, buildID, path, proxy)
+		if err != nil {
+			ui.PrintErr("debuginfod ", server, ": ", err)
+			continue
+		}
+		if found {
+			return path
+		}
+	}
+	return ""
+}
+
+// debuginfodCacheDir returns the directory of the debuginfod client
+// cache, following the conventions of the debuginfod client library.
+func debuginfodCacheDir() string {
+	if dir := os.Getenv("DEBUGINFOD_CACHE_PATH"); dir != "" {
+		return dir
+	}
+	if dir := os.Getenv("XDG_CACHE_HOME"); dir != "" {
+		return filepath.Join(dir, "debuginfod_client")
+	}
+	return filepath.Join(os.Getenv("HOME"), ".cache", "debuginfod_client")
+}
+
+// downloadDebugInfo downloads the debug file for buildID from server
+// into path. It reports whether the server has the file.
+func downloadDebugInfo(server, buildID, path string, proxy *url.URL) (bool, error) {
+	source := strings.TrimSuffix(server, "/") + "/buildid/" + buildID + "/debuginfo"
+	return downloadFile(source, path, debuginfodTimeout, proxy)
+}
+
+// downloadFile downloads the file at source into path. It reports
+// whether the server has the file.
+func downloadFile(source, path string, timeout time.Duration, proxy *url.URL) (bool, error) {
+	resp, err := httpGet(context.Background(), source, timeout, httpOptions{proxy: proxy})
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("server response: %s", resp.Status)
+	}
+
+	// Download into a temporary file, so that a failed download does
+	// not leave a truncated file in the cache.
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return false, err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), "tmp.")
+	if err != nil {
+		return false, err
+	}
+	_, err = io.Copy(f, resp.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return false, err
+	}
+	return true, nil
+}
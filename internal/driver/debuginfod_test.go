@@ -0,0 +1,94 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/pprof/internal/plugin"
+	"github.com/google/pprof/internal/proftest"
+	"github.com/google/pprof/profile"
+)
+
+func TestDebuginfod(t *testing.T) {
+	savedHTTPGet := httpGet
+	defer func() { httpGet = savedHTTPGet }()
+	httpGet = getURL
+
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/buildid/abcde10003/debuginfo" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("abcde10003"))
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "debuginfod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, env := range []string{"DEBUGINFOD_URLS", "DEBUGINFOD_CACHE_PATH", "PPROF_BINARY_PATH"} {
+		defer os.Setenv(env, os.Getenv(env))
+	}
+	os.Setenv("DEBUGINFOD_URLS", "http://127.0.0.1:0 "+ts.URL)
+	os.Setenv("DEBUGINFOD_CACHE_PATH", dir)
+	os.Setenv("PPROF_BINARY_PATH", dir)
+
+	cached := filepath.Join(dir, "abcde10003", "debuginfo")
+	for i, tc := range []struct {
+		buildID, want string
+		msgCount      int
+	}{
+		// The unreachable server and the resolved build id are reported.
+		{"abcde10003", cached, 2},
+		// Cached debug files are not downloaded again.
+		{"abcde10003", cached, 1},
+		{"abcde10004", "/usr/bin/binary", 1},
+	} {
+		p := &profile.Profile{
+			Mapping: []*profile.Mapping{{File: "/usr/bin/binary", BuildID: tc.buildID}},
+		}
+		locateBinaries(p, &source{}, "", binarySearchPath(), debugObj{}, &proftest.TestUI{T: t, Ignore: tc.msgCount})
+		if got := p.Mapping[0].File; got != tc.want {
+			t.Errorf("%d: %s: got file %s, want %s", i, tc.buildID, got, tc.want)
+		}
+	}
+	if requests != 2 {
+		t.Errorf("got %d requests to the debuginfod server, want 2", requests)
+	}
+}
+
+// debugObj opens files holding their own build id.
+type debugObj struct {
+	testObj
+}
+
+func (debugObj) Open(file string, start, limit, offset uint64) (plugin.ObjFile, error) {
+	buildID, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return testFile{file, string(buildID)}, nil
+}
@@ -18,12 +18,16 @@
 package driver
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
+	"strings"
 
 	"github.com/google/pprof/internal/plugin"
 	"github.com/google/pprof/internal/report"
@@ -44,8 +48,31 @@ func PProf(eo *plugin.Options) error {
 		return err
 	}
 
-	p, err := fetchProfiles(src, o)
-	if err != nil {
+	if src.ServeSaved != "" {
+		return serveSaved(src.ServeSaved, o.UI)
+	}
+	if src.MergeOnly != "" {
+		return mergeOnly(src, o)
+	}
+
+	ctx, stop := interruptContext()
+	var p *profile.Profile
+	var datasets []dataset
+	if src.KeepSeparate && cmd == nil && !src.DryRun {
+		if datasets, err = fetchSeparateProfiles(ctx, src, o); err == nil {
+			if p, err = mergeDatasets(datasets, src.PeriodOverride, o.UI); err != nil {
+				// Profiles of different types, eg fetched with
+				// host/debug/pprof/{profile,heap}, are only
+				// available separately.
+				o.UI.PrintErr("Cannot merge the profiles, starting with dataset 1: ", err)
+				p, err = datasets[0].p, nil
+			}
+		}
+	} else {
+		p, err = fetchProfiles(ctx, src, o)
+	}
+	stop()
+	if err != nil || src.DryRun {
 		return err
 	}
 
@@ -53,7 +80,41 @@ func PProf(eo *plugin.Options) error {
 		return generateReport(p, cmd, pprofVariables, o)
 	}
 
-	return interactive(p, o)
+	return interactive(p, datasets, src, o)
+}
+
+// mergeDatasets returns a profile merging all datasets, leaving them
+// unchanged. They are combined by combineProfiles as fetched profiles
+// are, with the period override of period, if set, and warnings
+// through ui.
+func mergeDatasets(datasets []dataset, period *periodOverride, ui plugin.UI) (*profile.Profile, error) {
+	profiles := make([]*profile.Profile, len(datasets))
+	names := make([]string, len(datasets))
+	for i, d := range datasets {
+		profiles[i], names[i] = d.p.Copy(), d.addr
+	}
+	p, _, err := combineProfiles(profiles, names, nil, period, ui)
+	return p, err
+}
+
+// interruptContext returns a context that is cancelled when the
+// process receives an interrupt, so that a Ctrl-C aborts outstanding
+// fetches. Calling stop restores the default interrupt handling.
+func interruptContext() (ctx context.Context, stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	go func() {
+		select {
+		case <-c:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(c)
+		cancel()
+	}
 }
 
 func generateReport(p *profile.Profile, cmd []string, vars variables, o *plugin.Options) error {
@@ -91,6 +152,12 @@ func generateReport(p *profile.Profile, cmd []string, vars variables, o *plugin.
 		panic("unexpected nil command")
 	}
 	ropt.OutputFormat = c.format
+	if err := applyGraphRatio(p, ropt, vars["graph_ratio"].value); err != nil {
+		return err
+	}
+	// Only stream rows when writing to a terminal, leaving piped
+	// output as it is.
+	ropt.Stream = w == os.Stdout && (o.UI.IsTerminal() || interactiveMode)
 	post := c.postProcess
 	if len(cmd) == 2 {
 		s, err := regexp.Compile(cmd[1])
@@ -116,7 +183,17 @@ func generateReport(p *profile.Profile, cmd []string, vars variables, o *plugin.
 	}
 
 	if post == nil {
-		return report.Generate(w, rpt, o.Obj)
+		if !ropt.Stream {
+			return report.Generate(w, rpt, o.Obj)
+		}
+		// The report flushes the header once the ranking is done,
+		// and then each row as it is formatted.
+		bw := bufio.NewWriter(w)
+		err := report.Generate(bw, rpt, o.Obj)
+		if ferr := bw.Flush(); err == nil {
+			err = ferr
+		}
+		return err
 	}
 
 	// Capture output into buffer and send to postprocessing command.
@@ -162,6 +239,7 @@ func applyCommandOverrides(cmd []string, v variables) variables {
 	if focus == false {
 		v.set("focus", "")
 		v.set("ignore", "")
+		v.set("only_mapping", "")
 	}
 	if tagfocus == false {
 		v.set("tagfocus", "")
@@ -224,6 +302,18 @@ func reportOptions(p *profile.Profile, vars variables) (*report.Options, error)
 		return nil, fmt.Errorf("zero divisor specified")
 	}
 
+	switch cb := vars["cluster_by"].value; cb {
+	case "", "package", "dir":
+	default:
+		return nil, fmt.Errorf("unrecognized cluster_by value %q, must be package or dir", cb)
+	}
+
+	switch cs := vars["colors"].value; cs {
+	case "default", "viridis", "grayscale", "colorblind":
+	default:
+		return nil, fmt.Errorf("unrecognized colors value %q, must be one of default, viridis, grayscale or colorblind", cs)
+	}
+
 	ropt := &report.Options{
 		CumSort:             vars["cum"].boolValue(),
 		CallTree:            vars["call_tree"].boolValue(),
@@ -242,7 +332,9 @@ func reportOptions(p *profile.Profile, vars variables) (*report.Options, error)
 		SampleType:        stype,
 		SampleUnit:        sample.Unit,
 
-		OutputUnit: vars["unit"].value,
+		OutputUnit:  vars["unit"].value,
+		ClusterBy:   vars["cluster_by"].value,
+		ColorScheme: vars["colors"].value,
 
 		SourcePath: vars["source_path"].stringValue(),
 	}
@@ -274,6 +366,36 @@ func sampleFormat(p *profile.Profile, sampleIndex string, mean bool) (value, mea
 	return
 }
 
+// applyGraphRatio configures graph reports to use the ratio of two
+// sample types, specified as "typeA/typeB", as the value of each node
+// and edge. It has no effect on other report formats.
+func applyGraphRatio(p *profile.Profile, ropt *report.Options, ratio string) error {
+	if ratio == "" || ropt.OutputFormat != report.Dot {
+		return nil
+	}
+	if ropt.SampleMeanDivisor != nil {
+		return fmt.Errorf("graph_ratio cannot be combined with mean")
+	}
+	types := strings.Split(ratio, "/")
+	if len(types) != 2 || types[0] == "" || types[1] == "" {
+		return fmt.Errorf("graph_ratio %q must be of the form typeA/typeB", ratio)
+	}
+	num, err := locateSampleIndex(p, types[0])
+	if err != nil {
+		return err
+	}
+	div, err := locateSampleIndex(p, types[1])
+	if err != nil {
+		return err
+	}
+	ropt.SampleValue = valueExtractor(num)
+	ropt.SampleMeanDivisor = valueExtractor(div)
+	ropt.SampleRatio = true
+	ropt.SampleType = p.SampleType[num].Type + "/" + p.SampleType[div].Type
+	ropt.SampleUnit = p.SampleType[num].Unit
+	return nil
+}
+
 func valueExtractor(ix int) sampleValueFunc {
 	return func(v []int64) int64 {
 		return v[ix]
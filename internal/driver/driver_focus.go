@@ -36,10 +36,16 @@ func applyFocus(prof *profile.Profile, v variables, ui plugin.UI) error {
 	tagfocus, err := compileTagFilter("tagfocus", v["tagfocus"].value, ui, err)
 	tagignore, err := compileTagFilter("tagignore", v["tagignore"].value, ui, err)
 	prunefrom, err := compileRegexOption("prune_from", v["prune_from"].value, err)
+	onlymapping, err := compileRegexOption("only_mapping", v["only_mapping"].value, err)
 	if err != nil {
 		return err
 	}
 
+	if onlymapping != nil {
+		om := prof.FilterSamplesByMapping(onlymapping, v["only_mapping_leaf"].boolValue())
+		warnNoMatches(om, "OnlyMapping", ui)
+	}
+
 	fm, im, hm, hnm := prof.FilterSamplesByName(focus, ignore, hide, show)
 	warnNoMatches(focus == nil || fm, "Focus", ui)
 	warnNoMatches(ignore == nil || im, "Ignore", ui)
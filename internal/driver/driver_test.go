@@ -16,6 +16,7 @@ package driver
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -27,6 +28,7 @@ import (
 
 	"github.com/google/pprof/internal/plugin"
 	"github.com/google/pprof/internal/proftest"
+	"github.com/google/pprof/internal/report"
 	"github.com/google/pprof/internal/symbolz"
 	"github.com/google/pprof/profile"
 )
@@ -83,6 +85,8 @@ func TestParse(t *testing.T) {
 
 		f := baseFlags()
 		f.args = []string{tc.source}
+		// Keep the expected outputs independent of the time of fetching.
+		f.bools["fetch_comments"] = false
 
 		flags := strings.Split(tc.flags, ",")
 
@@ -965,6 +969,37 @@ func TestTagFilter(t *testing.T) {
 	}
 }
 
+func TestGraphRatio(t *testing.T) {
+	for _, tc := range []struct {
+		ratio, wantType string
+		format          int
+		wantErr         bool
+	}{
+		{"", "", report.Dot, false},
+		{"inuse_space/inuse_objects", "", report.Text, false},
+		{"inuse_space/inuse_objects", "inuse_space/inuse_objects", report.Dot, false},
+		{"1/0", "inuse_space/inuse_objects", report.Dot, false},
+		{"inuse_space", "", report.Dot, true},
+		{"inuse_space/unknown", "", report.Dot, true},
+	} {
+		ropt := &report.Options{OutputFormat: tc.format}
+		err := applyGraphRatio(heapProfile(), ropt, tc.ratio)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("applyGraphRatio(%q): want error, got none", tc.ratio)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("applyGraphRatio(%q): %v", tc.ratio, err)
+			continue
+		}
+		if ropt.SampleType != tc.wantType || ropt.SampleRatio != (tc.wantType != "") {
+			t.Errorf("applyGraphRatio(%q), want type %q, got %q (ratio=%v)", tc.ratio, tc.wantType, ropt.SampleType, ropt.SampleRatio)
+		}
+	}
+}
+
 func TestSymbolzAfterMerge(t *testing.T) {
 	baseVars := pprofVariables
 	pprofVariables = baseVars.makeCopy()
@@ -987,7 +1022,7 @@ func TestSymbolzAfterMerge(t *testing.T) {
 
 	o.Fetch = testFetcher{}
 	o.Sym = testSymbolzSymbolizer{}
-	p, err := fetchProfiles(src, o)
+	p, err := fetchProfiles(context.Background(), src, o)
 	if err != nil {
 		t.Fatalf("fetchProfiles: %v", err)
 	}
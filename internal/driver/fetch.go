@@ -15,16 +15,36 @@
 package driver
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
+	"math/rand"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/google/pprof/internal/measurement"
@@ -32,66 +52,105 @@ import (
 	"github.com/google/pprof/profile"
 )
 
+// FetchProfiles fetches the profiles in sources, merges them and
+// symbolizes the result like pprof does for the sources on its command
+// line, with the default values of its flags. Unset options in o are
+// set to their defaults.
+func FetchProfiles(ctx context.Context, sources []string, o *plugin.Options) (*profile.Profile, error) {
+	o = setDefaults(o)
+	s := &source{
+		Sources: sources,
+		Seconds: -1,
+		Timeout: -1,
+		Retries: 2,
+
+		MaxDecompressedSize: defaultMaxDecompressedSize,
+
+		HTTPHeader:          o.HTTPHeader,
+		HTTPAuthToken:       o.HTTPAuthToken,
+		HTTPTransport:       o.HTTPTransport,
+		FetchEvents:         o.FetchEvents,
+		HTTPProxy:           o.HTTPProxy,
+		CheckFetchAddr:      o.CheckFetchAddr,
+		TLSConfig:           o.TLSConfig,
+		FetchConcurrency:    o.FetchConcurrency,
+		PerfConverter:       o.PerfConverter,
+		PerfConverterStdout: o.PerfConverterStdout,
+		JFRConverter:        o.JFRConverter,
+		TraceConverter:      o.TraceConverter,
+		Transform:           o.Transform,
+		ProfileData:         o.ProfileData,
+		FetchComments:       true,
+		NoSave:              o.NoSave,
+	}
+	return fetchProfiles(ctx, s, o)
+}
+
 // fetchProfiles fetches and symbolizes the profiles specified by s.
 // It will merge all the profiles it is able to retrieve, even if
 // there are some failures. It will return an error if it is unable to
-// fetch any profiles.
-func fetchProfiles(s *source, o *plugin.Options) (*profile.Profile, error) {
-	sources := make([]profileSource, 0, len(s.Sources)+len(s.Base))
-	for _, src := range s.Sources {
-		sources = append(sources, profileSource{
-			addr:   src,
-			source: s,
-			scale:  1,
-		})
+// fetch any profiles. If s.DryRun is set, it only lists the sources
+// to fetch, and returns a nil profile. Outstanding fetches are aborted
+// if ctx is cancelled.
+func fetchProfiles(ctx context.Context, s *source, o *plugin.Options) (*profile.Profile, error) {
+	sources, err := profileSources(s, o.UI)
+	if err != nil {
+		return nil, err
 	}
-	for _, src := range s.Base {
-		sources = append(sources, profileSource{
-			addr:   src,
-			source: s,
-			scale:  -1,
-		})
+	if s.DryRun {
+		listSources(sources, o.UI)
+		return nil, nil
+	}
+	// Fail before fetching if a remote profile could not be saved.
+	persist := !s.NoSave && !s.InMemory
+	if persist && hasRemoteSource(sources) {
+		if err := checkTmpDir(o.UI); err != nil {
+			return nil, err
+		}
 	}
-	p, msrcs, save, cnt, err := chunkedGrab(sources, o.Fetch, o.Obj, o.UI)
+	p, msrcs, save, cnt, err := chunkedGrab(ctx, sources, s.FetchConcurrency, o.Fetch, o.Obj, o.UI)
 	if err != nil {
 		return nil, err
 	}
-	if cnt == 0 {
-		return nil, fmt.Errorf("failed to fetch any profiles")
+	reportFetchErrors(sources, o.FetchErrors)
+	if s.FetchSummary != "" {
+		if err := writeFetchSummary(s.FetchSummary, sources, p, o.Writer); err != nil {
+			o.UI.PrintErr("Could not write fetch summary: ", err)
+		}
+	}
+	if err := checkFetched(sources, cnt, p, o.UI); err != nil {
+		return nil, err
 	}
-	if want, got := len(sources), cnt; want != got {
-		o.UI.PrintErr(fmt.Sprintf("fetched %d profiles out of %d", got, want))
+	warnZeroSamples(p, s, o.UI)
+	if s.FetchTimings {
+		reportFetchTimings(sources, o.UI)
 	}
 
 	// Symbolize the merged profile.
-	if err := o.Sym.Symbolize(s.Symbolize, msrcs, p); err != nil {
+	if err := symbolize(o.Sym, s, msrcs, p); err != nil {
 		return nil, err
 	}
-	p.RemoveUninteresting()
-	unsourceMappings(p)
+	if !s.NoPrune {
+		p.RemoveUninteresting()
+	}
+	unsourceMappings(p, s.KeepMappingSources)
+	stripPaths(p, s.StripPaths)
 
-	// Save a copy of the merged profile if there is at least one remote source.
-	if save {
+	// Save a copy of the merged profile if there is at least one remote
+	// source, unless disabled.
+	if save && persist {
 		dir, err := setTmpDir(o.UI)
 		if err != nil {
 			return nil, err
 		}
 
-		prefix := "pprof."
-		if len(p.Mapping) > 0 && p.Mapping[0].File != "" {
-			prefix += filepath.Base(p.Mapping[0].File) + "."
-		}
-		for _, s := range p.SampleType {
-			prefix += s.Type + "."
-		}
-
-		tempFile, err := newTempFile(dir, prefix, ".pb.gz")
-		if err == nil {
-			if err = p.Write(tempFile); err == nil {
-				o.UI.PrintErr("Saved profile in ", tempFile.Name())
-			}
+		prefix := savedName(s.SaveName, s.SaveTag, p)
+		if s.FetchComments {
+			p.Comments = append(p.Comments, fetchComments(s, time.Now())...)
 		}
-		if err != nil {
+		if name, err := saveFile(dir, prefix, ".pb.gz", p.Write); err == nil {
+			o.UI.PrintErr("Saved profile in ", name)
+		} else {
 			o.UI.PrintErr("Could not save profile: ", err)
 		}
 	}
@@ -103,87 +162,743 @@ func fetchProfiles(s *source, o *plugin.Options) (*profile.Profile, error) {
 	return p, nil
 }
 
+// defaultSavedName is the template for the names of saved profiles,
+// as expanded by savedName.
+const defaultSavedName = "pprof.{binary}.{types}.{tag}"
+
+var (
+	unsafeTagRx   = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+	repeatedDotRx = regexp.MustCompile(`\.\.+`)
+)
+
+// savedName returns the prefix of the name to save p under, ending
+// with a dot. It expands template, or defaultSavedName if empty,
+// replacing {binary} with the base name of the main binary, {types}
+// with the sample types and {tag} with tag, where any characters other
+// than letters, digits, '_', '.' and '-' are replaced with '_'. Empty
+// fields are dropped along with their separating dots.
+func savedName(template, tag string, p *profile.Profile) string {
+	if template == "" {
+		template = defaultSavedName
+	}
+	var binary string
+	if len(p.Mapping) > 0 && p.Mapping[0].File != "" {
+		binary = filepath.Base(p.Mapping[0].File)
+	}
+	name := strings.NewReplacer(
+		"{binary}", binary,
+		"{types}", savedTypes(p),
+		"{tag}", strings.Trim(unsafeTagRx.ReplaceAllString(tag, "_"), "."),
+	).Replace(template)
+	return strings.TrimSuffix(repeatedDotRx.ReplaceAllString(name, "."), ".") + "."
+}
+
+// maxSavedTypes is the number of sample types named by savedTypes.
+const maxSavedTypes = 2
+
+// savedTypes returns the sample types of p for the names of saved
+// profiles: the first maxSavedTypes distinct ones, separated by dots,
+// followed by "+N" if N more are left out.
+func savedTypes(p *profile.Profile) string {
+	var types []string
+	seen := make(map[string]bool)
+	for _, st := range p.SampleType {
+		if !seen[st.Type] {
+			seen[st.Type] = true
+			types = append(types, st.Type)
+		}
+	}
+	if len(types) > maxSavedTypes {
+		types = append(types[:maxSavedTypes], fmt.Sprintf("+%d", len(types)-maxSavedTypes))
+	}
+	return strings.Join(types, ".")
+}
+
+// fetchComments returns the comments recording where and when the
+// profiles specified by s were fetched. Credentials in the sources are
+// left out, as the comments are saved with the profile.
+func fetchComments(s *source, now time.Time) []string {
+	var comments []string
+	for _, src := range s.Sources {
+		comments = append(comments, "Source: "+stripUserinfo(src))
+	}
+	for _, src := range s.Base {
+		comments = append(comments, "Base: "+stripUserinfo(src))
+	}
+	if s.Seconds > 0 {
+		comments = append(comments, fmt.Sprintf("Seconds: %d", s.Seconds))
+	}
+	if s.Timeout > 0 {
+		comments = append(comments, fmt.Sprintf("Timeout: %ds", s.Timeout))
+	}
+	return append(comments, "Fetched at: "+now.UTC().Format(time.RFC3339))
+}
+
+// dataset is a profile fetched from a single source.
+type dataset struct {
+	addr string
+	p    *profile.Profile
+}
+
+// fetchSeparateProfiles fetches and symbolizes the profiles specified
+// by s like fetchProfiles, but returns each profile separately instead
+// of merging them. Profiles fetched separately are not saved.
+func fetchSeparateProfiles(ctx context.Context, s *source, o *plugin.Options) ([]dataset, error) {
+	sources, err := profileSources(s, o.UI)
+	if err != nil {
+		return nil, err
+	}
+	grabbed, err := separateGrab(ctx, sources, s.FetchConcurrency, o.Fetch, o.Obj, o.UI)
+	if err != nil {
+		return nil, err
+	}
+	reportFetchErrors(sources, o.FetchErrors)
+	if err := checkFetched(sources, len(grabbed), nil, o.UI); err != nil {
+		return nil, err
+	}
+
+	datasets := make([]dataset, len(grabbed))
+	for i, g := range grabbed {
+		if err := symbolize(o.Sym, s, g.msrc, g.p); err != nil {
+			return nil, err
+		}
+		if !s.NoPrune {
+			g.p.RemoveUninteresting()
+		}
+		unsourceMappings(g.p, s.KeepMappingSources)
+		stripPaths(g.p, s.StripPaths)
+		if err := g.p.CheckValid(); err != nil {
+			return nil, fmt.Errorf("%s: %v", stripUserinfo(g.addr), err)
+		}
+		datasets[i] = dataset{stripUserinfo(g.addr), g.p}
+	}
+	return datasets, nil
+}
+
+// profileSources returns the list of profiles to fetch for s, with
+// source groups expanded.
+func profileSources(s *source, ui plugin.UI) ([]profileSource, error) {
+	var stdins int
+	for _, src := range append(append([]string(nil), s.Sources...), s.Base...) {
+		if src == stdinSource {
+			stdins++
+		}
+	}
+	if stdins > 1 {
+		return nil, fmt.Errorf("standard input can only be read for one source, got %q %d times", stdinSource, stdins)
+	}
+	scales, err := sourceScales(s.Sources, s.Scales, 1)
+	if err != nil {
+		return nil, err
+	}
+	baseScales, err := sourceScales(s.Base, s.BaseScales, -1)
+	if err != nil {
+		return nil, err
+	}
+	groups := &sourceGroups{file: s.SourceGroups}
+	addrs, scales, err := groups.expand(s.Sources, scales)
+	if err != nil {
+		return nil, err
+	}
+	baseAddrs, baseScales, err := groups.expand(s.Base, baseScales)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if addrs, err = rangeSources(addrs, s.Seconds, s.RangeLast, now); err != nil {
+		return nil, err
+	}
+	if baseAddrs, err = rangeSources(baseAddrs, s.Seconds, s.RangeLast, now); err != nil {
+		return nil, err
+	}
+	if s.Offline {
+		if err := checkOffline(addrs); err != nil {
+			return nil, err
+		}
+		if err := checkOffline(baseAddrs); err != nil {
+			return nil, err
+		}
+	}
+	sources := make([]profileSource, 0, len(addrs)+len(baseAddrs))
+	sources = appendUniqueSources(sources, s, addrs, scales, ui)
+	sources = appendUniqueSources(sources, s, baseAddrs, baseScales, ui)
+	return sources, nil
+}
+
+// appendUniqueSources appends a profileSource for each of addrs to
+// sources, scaled by the corresponding entry in scales. URLs that
+// refer to the same profile as an earlier one in addrs are dropped
+// with a warning, so that the profile is not fetched and counted
+// twice. Local files may be repeated on purpose and are kept.
+func appendUniqueSources(sources []profileSource, s *source, addrs []string, scales []float64, ui plugin.UI) []profileSource {
+	seen := make(map[string]string)
+	for i, addr := range addrs {
+		if key := remoteSourceKey(addr); key != "" {
+			if first, ok := seen[key]; ok {
+				ui.PrintErr("Ignoring duplicate source ", stripUserinfo(addr), ", same as ", stripUserinfo(first))
+				continue
+			}
+			seen[key] = addr
+		}
+		sources = append(sources, profileSource{
+			addr:   addr,
+			source: s,
+			scale:  scales[i],
+		})
+	}
+	return sources
+}
+
+// checkOffline returns an error for the first of addrs that adjustURL
+// makes a URL, as these cannot be fetched in offline mode.
+func checkOffline(addrs []string) error {
+	for _, addr := range addrs {
+		if sourceURL, _ := adjustURL(addr, 0, 0); sourceURL != "" {
+			return fmt.Errorf("offline mode: refusing to fetch remote source %s", stripUserinfo(sourceURL))
+		}
+	}
+	return nil
+}
+
+// listSources prints the URL and timeout each of sources would be
+// fetched with, or that it is read locally.
+func listSources(sources []profileSource, ui plugin.UI) {
+	for _, s := range sources {
+		duration := time.Duration(s.source.Seconds) * time.Second
+		if sourceURL, timeout := adjustURL(s.addr, duration, sourceTimeout(s.source, s.addr)); sourceURL != "" {
+			ui.Print(fmt.Sprintf("%s (timeout %v)", stripUserinfo(sourceURL), timeout))
+		} else {
+			ui.Print(stripUserinfo(s.addr) + " (local)")
+		}
+	}
+}
+
+// hasRemoteSource reports whether any of sources is a URL.
+func hasRemoteSource(sources []profileSource) bool {
+	for _, s := range sources {
+		if remoteSourceKey(s.addr) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteSourceKey returns the normalized URL of a remote profile
+// source, used to identify duplicate sources, or "" for other sources.
+// URLs are normalized as by adjustURL, and trailing slashes in their
+// path are ignored.
+func remoteSourceKey(source string) string {
+	sourceURL, _ := adjustURL(source, 0, 0)
+	if sourceURL == "" {
+		return ""
+	}
+	u, err := url.Parse(sourceURL)
+	if err != nil {
+		return ""
+	}
+	u.Path = strings.TrimRight(u.Path, "/")
+	u.RawPath = ""
+	return u.String()
+}
+
+// checkFetched returns an error if no profile was fetched out of
+// sources, and warns about the sources that failed otherwise. If p, the
+// merged profile, is set, the warning includes the samples and total
+// value of p and an estimate of the value lost with the failed sources.
+func checkFetched(sources []profileSource, fetched int, p *profile.Profile, ui plugin.UI) error {
+	if fetched == 0 {
+		return fmt.Errorf("failed to fetch any profiles")
+	}
+	if want, got := len(sources), fetched; want != got {
+		msg := fmt.Sprintf("fetched %d profiles out of %d", got, want)
+		skipped := countSkipped(sources)
+		if skipped > 0 {
+			msg += fmt.Sprintf(" (%d skipped)", skipped)
+		}
+		if failed := want - got - skipped; p != nil && failed > 0 {
+			msg += ": " + partialMergeStats(p, got, failed)
+		}
+		ui.PrintErr(msg)
+	}
+	return nil
+}
+
+// partialMergeStats describes the samples and total value of the
+// default sample type of p, merged from fetched sources, and the value
+// likely missing from it as failed sources did not contribute, assuming
+// they would have contributed as much as the average fetched source.
+func partialMergeStats(p *profile.Profile, fetched, failed int) string {
+	msg := fmt.Sprintf("%d samples", len(p.Sample))
+	index, err := locateSampleIndex(p, "")
+	if err != nil || index < 0 {
+		return msg
+	}
+	var total int64
+	for _, s := range p.Sample {
+		total += s.Value[index]
+	}
+	st := p.SampleType[index]
+	missing := total * int64(failed) / int64(fetched)
+	pct := 100 * float64(failed) / float64(fetched+failed)
+	return fmt.Sprintf("%s, %s %s; about %s (%.0f%%) missing from failed sources", msg, measurement.Label(total, st.Unit), st.Type, measurement.Label(missing, st.Unit), pct)
+}
+
+// warnZeroSamples warns if every sample value of p, merged from the
+// sources in s, is zero, as when a base profile cancels out the profile
+// it is subtracted from or a scale factor is 0. The resulting reports
+// would otherwise be empty with no explanation.
+func warnZeroSamples(p *profile.Profile, s *source, ui plugin.UI) {
+	for _, s := range p.Sample {
+		for _, v := range s.Value {
+			if v != 0 {
+				return
+			}
+		}
+	}
+	var causes []string
+	if len(s.Base) > 0 {
+		causes = append(causes, "a -base profile equal to the profile")
+	}
+	for _, scale := range append(append([]float64(nil), s.Scales...), s.BaseScales...) {
+		if scale == 0 {
+			causes = append(causes, "a -scale factor of 0")
+			break
+		}
+	}
+	if len(causes) == 0 {
+		return
+	}
+	ui.PrintErr("all sample values are zero after merging, possibly due to " + strings.Join(causes, " or "))
+}
+
+// sourceScales returns the factor to scale each of addrs by: those in
+// scales, if set, or else def for all of them.
+func sourceScales(addrs []string, scales []float64, def float64) ([]float64, error) {
+	if len(scales) == 0 {
+		scales = make([]float64, len(addrs))
+		for i := range scales {
+			scales[i] = def
+		}
+		return scales, nil
+	}
+	if len(scales) != len(addrs) {
+		return nil, fmt.Errorf("got %d scale factors for %d profile sources", len(scales), len(addrs))
+	}
+	return scales, nil
+}
+
 // chunkedGrab fetches the profiles described in source and merges them into
 // a single profile. It fetches a chunk of profiles concurrently, with a maximum
-// chunk size to limit its memory usage.
-func chunkedGrab(sources []profileSource, fetch plugin.Fetcher, obj plugin.ObjTool, ui plugin.UI) (*profile.Profile, plugin.MappingSources, bool, int, error) {
-	const chunkSize = 64
+// chunk size to limit its memory usage; a chunkSize of 0 selects
+// defaultChunkSize. The next chunk is fetched while the
+// previous one is being merged, but no more than one chunk is held waiting
+// to be merged at any time. Once the merged profile exceeds the memory
+// budget of the sources, if any, the remaining sources are skipped.
+func chunkedGrab(ctx context.Context, sources []profileSource, chunkSize int, fetch plugin.Fetcher, obj plugin.ObjTool, ui plugin.UI) (*profile.Profile, plugin.MappingSources, bool, int, error) {
+	if chunkSize < 1 {
+		chunkSize = defaultChunkSize
+	}
+
+	// Fetch stage: grab chunks in order and hand them over to the merge
+	// stage. The channel is unbuffered so that fetching stops once a
+	// chunk is ready and the merge stage is still busy.
+	progress := newFetchProgress(ui, len(sources))
+	fetchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	chunks := make(chan grabbedChunk)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(chunks)
+		for start := 0; start < len(sources); start += chunkSize {
+			end := start + chunkSize
+			if end > len(sources) {
+				end = len(sources)
+			}
+			var c grabbedChunk
+			c.p, c.msrc, c.save, c.count, c.err = concurrentGrab(fetchCtx, sources[start:end], fetch, obj, ui, progress)
+			c.name = chunkName(sources[start:end])
+			c.end = end
+			select {
+			case chunks <- c:
+			case <-done:
+				return
+			}
+			if c.err != nil {
+				return
+			}
+		}
+	}()
 
+	// Merge stage: combine the chunks into the accumulated profile.
 	var p *profile.Profile
 	var msrc plugin.MappingSources
 	var save bool
 	var count int
+	var name string
+	budget := sourcesMemoryBudget(sources)
 
-	for start := 0; start < len(sources); start += chunkSize {
-		end := start + chunkSize
-		if end > len(sources) {
-			end = len(sources)
-		}
-		chunkP, chunkMsrc, chunkSave, chunkCount, chunkErr := concurrentGrab(sources[start:end], fetch, obj, ui)
+	for c := range chunks {
 		switch {
-		case chunkErr != nil:
-			return nil, nil, false, 0, chunkErr
-		case chunkP == nil:
+		case c.err != nil:
+			return nil, nil, false, 0, c.err
+		case c.p == nil:
 			continue
 		case p == nil:
-			p, msrc, save, count = chunkP, chunkMsrc, chunkSave, chunkCount
+			p, msrc, save, count, name = c.p, c.msrc, c.save, c.count, c.name
 		default:
-			p, msrc, chunkErr = combineProfiles([]*profile.Profile{p, chunkP}, []plugin.MappingSources{msrc, chunkMsrc})
-			if chunkErr != nil {
-				return nil, nil, false, 0, chunkErr
+			var err error
+			p, msrc, err = combineProfiles([]*profile.Profile{p, c.p}, []string{name, c.name}, []plugin.MappingSources{msrc, c.msrc}, sourcesPeriod(sources), ui)
+			if err != nil {
+				return nil, nil, false, 0, err
 			}
-			if chunkSave {
+			if c.save {
 				save = true
 			}
-			count += chunkCount
+			count += c.count
 		}
+		if size := profileMemory(p); budget > 0 && size > budget && c.end < len(sources) {
+			// Wait for the fetch stage to stop before updating the
+			// sources it has not merged.
+			cancel()
+			for range chunks {
+			}
+			for i := range sources[c.end:] {
+				s := &sources[c.end+i]
+				s.p, s.msrc, s.total, s.err = nil, nil, 0, &skippedError{"memory budget exceeded"}
+			}
+			ui.PrintErr(fmt.Sprintf("merged profile takes about %s, over the memory budget of %s; skipping the %d remaining sources", measurement.Label(size, "bytes"), measurement.Label(budget, "bytes"), len(sources)-c.end))
+			break
+		}
+	}
+	// Scale normalized profiles back to the mean total of the sources.
+	if mean := meanTotal(sources); p != nil && mean > 0 {
+		p.Scale(mean / normalizedTotal)
 	}
 	return p, msrc, save, count, nil
 }
 
-// concurrentGrab fetches multiple profiles concurrently
-func concurrentGrab(sources []profileSource, fetch plugin.Fetcher, obj plugin.ObjTool, ui plugin.UI) (*profile.Profile, plugin.MappingSources, bool, int, error) {
-	wg := sync.WaitGroup{}
-	wg.Add(len(sources))
-	for i := range sources {
-		go func(s *profileSource) {
-			defer wg.Done()
-			s.p, s.msrc, s.remote, s.err = grabProfile(s.source, s.addr, s.scale, fetch, obj, ui)
-		}(&sources[i])
+// normalizedTotal is the total that -normalize_sources scales each
+// profile to before merging, large enough for rounding errors to be
+// negligible.
+const normalizedTotal = 1e9
+
+// normalizeTotal scales p so that the total of its default sample
+// value is normalizedTotal, keeping its sign, and returns the absolute
+// total it had before. Profiles with a zero total are left unchanged.
+func normalizeTotal(p *profile.Profile) int64 {
+	index, _ := locateSampleIndex(p, "")
+	if index < 0 {
+		return 0
+	}
+	var total int64
+	for _, s := range p.Sample {
+		total += s.Value[index]
+	}
+	if total < 0 {
+		total = -total
+	}
+	if total != 0 {
+		p.Scale(normalizedTotal / float64(total))
+	}
+	return total
+}
+
+// meanTotal returns the mean of the totals recorded for sources by
+// normalizeTotal, ignoring those that are zero, or 0 if there are none.
+func meanTotal(sources []profileSource) float64 {
+	var sum float64
+	var n int
+	for _, s := range sources {
+		if s.total != 0 {
+			sum += float64(s.total)
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	return sum / float64(n)
+}
+
+// chunkName describes the profiles fetched from sources, for errors
+// merging them with those of other chunks: by the first source fetched
+// successfully, and the number of others.
+func chunkName(sources []profileSource) string {
+	var name string
+	var others int
+	for _, s := range sources {
+		switch {
+		case s.err != nil:
+		case name == "":
+			name = s.addr
+		default:
+			others++
+		}
+	}
+	if others > 0 {
+		name += fmt.Sprintf(" and %d other sources", others)
+	}
+	return name
+}
+
+// defaultChunkSize is the number of profiles fetched concurrently by
+// chunkedGrab unless configured otherwise.
+const defaultChunkSize = 64
+
+// grabbedChunk is the result of fetching a chunk of profiles, passed
+// from the fetch stage to the merge stage of chunkedGrab.
+type grabbedChunk struct {
+	p     *profile.Profile
+	msrc  plugin.MappingSources
+	save  bool
+	count int
+	name  string // Description of the sources, as given by chunkName.
+	end   int    // Index of the first source after the chunk.
+	err   error
+}
+
+// sourcesMemoryBudget returns the memory budget of the merged profile
+// of sources, or 0 if there is none.
+func sourcesMemoryBudget(sources []profileSource) int64 {
+	if len(sources) == 0 || sources[0].source == nil {
+		return 0
+	}
+	return sources[0].source.MemoryBudget
+}
+
+// Approximate sizes in bytes of the samples and locations of a profile
+// in memory, and of each value and location of a sample, used by
+// profileMemory.
+const (
+	sampleMemory      = 128
+	locationMemory    = 192
+	sampleValueMemory = 8
+)
+
+// profileMemory estimates the size in bytes of p in memory from its
+// number of samples and locations, which dominate it.
+func profileMemory(p *profile.Profile) int64 {
+	size := locationMemory * int64(len(p.Location))
+	for _, s := range p.Sample {
+		size += sampleMemory + sampleValueMemory*int64(len(s.Value)+len(s.Location))
+	}
+	return size
+}
+
+// concurrentGrab fetches multiple profiles concurrently with
+// concurrentFetch, and merges them.
+func concurrentGrab(ctx context.Context, sources []profileSource, fetch plugin.Fetcher, obj plugin.ObjTool, ui plugin.UI, progress *fetchProgress) (*profile.Profile, plugin.MappingSources, bool, int, error) {
+	if err := concurrentFetch(ctx, sources, fetch, obj, ui, progress); err != nil {
+		return nil, nil, false, 0, err
 	}
-	wg.Wait()
 
 	var save bool
 	profiles := make([]*profile.Profile, 0, len(sources))
+	names := make([]string, 0, len(sources))
 	msrcs := make([]plugin.MappingSources, 0, len(sources))
 	for i := range sources {
 		s := &sources[i]
-		if err := s.err; err != nil {
-			ui.PrintErr(s.addr + ": " + err.Error())
+		if s.err != nil {
 			continue
 		}
 		save = save || s.remote
+		if s.source != nil && s.source.NormalizeSources {
+			s.total = normalizeTotal(s.p)
+		}
 		profiles = append(profiles, s.p)
+		names = append(names, s.addr)
 		msrcs = append(msrcs, s.msrc)
-		*s = profileSource{}
+		s.p, s.msrc = nil, nil
 	}
 
 	if len(profiles) == 0 {
 		return nil, nil, false, 0, nil
 	}
 
-	p, msrc, err := combineProfiles(profiles, msrcs)
+	p, msrc, err := combineProfiles(profiles, names, msrcs, sourcesPeriod(sources), ui)
 	if err != nil {
 		return nil, nil, false, 0, err
 	}
 	return p, msrc, save, len(profiles), nil
 }
 
-func combineProfiles(profiles []*profile.Profile, msrcs []plugin.MappingSources) (*profile.Profile, plugin.MappingSources, error) {
+// grabbedProfile is a profile fetched by separateGrab, along with the
+// sources of its mappings.
+type grabbedProfile struct {
+	addr string
+	p    *profile.Profile
+	msrc plugin.MappingSources
+}
+
+// separateGrab fetches the profiles described in sources like
+// chunkedGrab, but returns them separately instead of merging them.
+// Since all profiles are held in memory at once, chunkSize only limits
+// the number of concurrent fetches.
+func separateGrab(ctx context.Context, sources []profileSource, chunkSize int, fetch plugin.Fetcher, obj plugin.ObjTool, ui plugin.UI) ([]grabbedProfile, error) {
+	if chunkSize < 1 {
+		chunkSize = defaultChunkSize
+	}
+	progress := newFetchProgress(ui, len(sources))
+	var grabbed []grabbedProfile
+	for start := 0; start < len(sources); start += chunkSize {
+		end := start + chunkSize
+		if end > len(sources) {
+			end = len(sources)
+		}
+		if err := concurrentFetch(ctx, sources[start:end], fetch, obj, ui, progress); err != nil {
+			return nil, err
+		}
+		for i := start; i < end; i++ {
+			s := &sources[i]
+			if s.err != nil {
+				continue
+			}
+			grabbed = append(grabbed, grabbedProfile{s.addr, s.p, s.msrc})
+			s.p, s.msrc = nil, nil
+		}
+	}
+	return grabbed, nil
+}
+
+// concurrentFetch fetches multiple profiles concurrently into sources,
+// and reports the ones that failed. It stops launching fetches once ctx
+// is cancelled, and then returns its error. If the sources require all
+// of them to be fetched, the first failure aborts the other fetches and
+// is returned instead of being reported. Each completed fetch is
+// reported to progress, which may be nil.
+func concurrentFetch(ctx context.Context, sources []profileSource, fetch plugin.Fetcher, obj plugin.ObjTool, ui plugin.UI, progress *fetchProgress) error {
+	fetchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var mu sync.Mutex
+	var strictErr error
+
+	wg := sync.WaitGroup{}
+	for i := range sources {
+		if fetchCtx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(s *profileSource) {
+			defer wg.Done()
+			if s.err = staggerStart(fetchCtx, s.source); s.err == nil {
+				reportFetchEvent(s, plugin.FetchStarted)
+				start := time.Now()
+				s.p, s.msrc, s.remote, s.err = grabProfile(fetchCtx, s.source, s.addr, s.scale, fetch, obj, ui)
+				s.elapsed = time.Since(start)
+				if s.err == nil && (s.source.FetchSummary != "" || s.source.FetchEvents != nil) {
+					s.size = profileSize(s.p)
+				}
+				if s.err == nil {
+					reportFetchEvent(s, plugin.FetchSucceeded)
+				} else {
+					reportFetchEvent(s, plugin.FetchFailed)
+				}
+			}
+			if s.err != nil && s.source.StrictFetch {
+				mu.Lock()
+				if strictErr == nil && fetchCtx.Err() == nil {
+					strictErr = fmt.Errorf("%s: %v", stripUserinfo(s.addr), s.err)
+					cancel()
+				}
+				mu.Unlock()
+			}
+			progress.done()
+		}(&sources[i])
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if strictErr != nil {
+		return strictErr
+	}
+
+	for _, s := range sources {
+		if s.err != nil {
+			ui.PrintErr(stripUserinfo(s.addr) + ": " + s.err.Error())
+		}
+	}
+	return nil
+}
+
+// reportFetchEvent passes an event of the given kind for s to the
+// FetchEvents function of its options, if set.
+func reportFetchEvent(s *profileSource, kind plugin.FetchEventKind) {
+	report := s.source.FetchEvents
+	if report == nil {
+		return
+	}
+	e := &plugin.FetchEvent{Kind: kind, Source: s.addr}
+	switch kind {
+	case plugin.FetchSucceeded:
+		e.Bytes, e.Duration = s.size, s.elapsed
+	case plugin.FetchFailed:
+		e.Duration, e.Err = s.elapsed, s.err
+	}
+	report(e)
+}
+
+// fetchProgress reports the number of profiles fetched so far, at
+// most once every progressInterval.
+type fetchProgress struct {
+	ui    plugin.UI
+	total int
+
+	mu      sync.Mutex
+	fetched int
+	last    time.Time
+}
+
+// progressInterval is the minimum time between progress reports; it is
+// a variable so it can be shortened during testing.
+var progressInterval = time.Second
+
+// newFetchProgress returns a progress reporter for fetching total
+// profiles. It returns nil, which reports nothing, if ui is not a
+// terminal so that scripted output is not cluttered.
+func newFetchProgress(ui plugin.UI, total int) *fetchProgress {
+	if !ui.IsTerminal() {
+		return nil
+	}
+	return &fetchProgress{ui: ui, total: total, last: time.Now()}
+}
+
+// done records a completed fetch, and reports progress if enough time
+// has passed since the last report.
+func (f *fetchProgress) done() {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fetched++
+	if f.fetched == f.total || time.Since(f.last) < progressInterval {
+		return
+	}
+	f.last = time.Now()
+	f.ui.PrintErr(fmt.Sprintf("fetched %d/%d profiles", f.fetched, f.total))
+}
+
+// combineProfiles merges profiles, along with their mapping sources
+// msrcs. Profiles are described by names in errors, if set. If ui is
+// set, it is warned about profiles collected too far apart, as checked
+// by checkClockSkew.
+func combineProfiles(profiles []*profile.Profile, names []string, msrcs []plugin.MappingSources, period *periodOverride, ui plugin.UI) (*profile.Profile, plugin.MappingSources, error) {
 	// Merge profiles.
+	if err := checkSampleTypes(profiles, names); err != nil {
+		return nil, nil, err
+	}
 	if err := measurement.ScaleProfiles(profiles); err != nil {
 		return nil, nil, err
 	}
+	if ui != nil {
+		checkClockSkew(profiles, ui)
+		checkDefaultSampleTypes(profiles, ui)
+	}
+	if period != nil {
+		overridePeriod(profiles, period, ui)
+	}
 
 	p, err := profile.Merge(profiles)
 	if err != nil {
@@ -200,24 +915,250 @@ func combineProfiles(profiles []*profile.Profile, msrcs []plugin.MappingSources)
 	return p, msrc, nil
 }
 
+// checkSampleTypes returns an error if profiles do not have the same
+// sample types, and thus cannot be merged, naming each distinct set of
+// sample types and the first profile that has it. Profiles are
+// described by names, or by their position if names is not set. Only
+// the types are compared, as units are converted by ScaleProfiles.
+func checkSampleTypes(profiles []*profile.Profile, names []string) error {
+	if len(profiles) == 0 || compatibleSampleTypes(profiles) {
+		return nil
+	}
+	var kinds []string
+	seen := make(map[string]bool)
+	for i, p := range profiles {
+		types := make([]string, len(p.SampleType))
+		for j, st := range p.SampleType {
+			types[j] = st.Type + "/" + st.Unit
+		}
+		kind := strings.Join(types, ",")
+		if seen[kind] {
+			continue
+		}
+		seen[kind] = true
+		name := fmt.Sprintf("profile %d", i+1)
+		if i < len(names) {
+			name = names[i]
+		}
+		kinds = append(kinds, fmt.Sprintf("[%s] from %s", kind, name))
+	}
+	return fmt.Errorf("cannot merge profiles with different sample types: %s", strings.Join(kinds, ", "))
+}
+
+// compatibleSampleTypes reports whether profiles all have sample types
+// of the same types in the same order, regardless of their units.
+func compatibleSampleTypes(profiles []*profile.Profile) bool {
+	first := profiles[0].SampleType
+	for _, p := range profiles[1:] {
+		if len(p.SampleType) != len(first) {
+			return false
+		}
+		for i, st := range p.SampleType {
+			if st.Type != first[i].Type {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// maxClockSkew is the largest difference between the collection times
+// of merged profiles that is not reported by checkClockSkew.
+const maxClockSkew = 5 * time.Minute
+
+// checkClockSkew warns if profiles, about to be merged, were collected
+// more than maxClockSkew apart, as their sources likely have
+// inconsistent clocks. Profiles with no collection time are ignored.
+func checkClockSkew(profiles []*profile.Profile, ui plugin.UI) {
+	var earliest, latest int64
+	for _, p := range profiles {
+		if p.TimeNanos == 0 {
+			continue
+		}
+		if earliest == 0 || p.TimeNanos < earliest {
+			earliest = p.TimeNanos
+		}
+		if p.TimeNanos > latest {
+			latest = p.TimeNanos
+		}
+	}
+	if skew := time.Duration(latest - earliest); skew > maxClockSkew {
+		ui.PrintErr(fmt.Sprintf("profiles were collected up to %v apart, their sources appear to have inconsistent clocks; using the earliest time", skew))
+	}
+}
+
+// periodOverride is the period, and optionally the period type, that
+// merged profiles are set to, as given with -period, rather than those
+// Merge picks from the sources.
+type periodOverride struct {
+	typ    *profile.ValueType // Period type, or nil to keep that of the sources.
+	period int64
+}
+
+func (o *periodOverride) String() string {
+	if o.typ == nil {
+		return strconv.FormatInt(o.period, 10)
+	}
+	return fmt.Sprintf("%s/%s=%d", o.typ.Type, o.typ.Unit, o.period)
+}
+
+// sourcesPeriod returns the period override of sources, which share
+// their options, if any.
+func sourcesPeriod(sources []profileSource) *periodOverride {
+	if len(sources) == 0 || sources[0].source == nil {
+		return nil
+	}
+	return sources[0].source.PeriodOverride
+}
+
+// overridePeriod sets the period of profiles, about to be merged, to
+// that of o, warning through ui, if set, if the profiles disagreed on
+// their periods.
+func overridePeriod(profiles []*profile.Profile, o *periodOverride, ui plugin.UI) {
+	var periods []string
+	seen := make(map[string]bool)
+	for _, p := range profiles {
+		period := (&periodOverride{p.PeriodType, p.Period}).String()
+		if !seen[period] {
+			periods = append(periods, period)
+			seen[period] = true
+		}
+		if o.typ != nil {
+			p.PeriodType = &profile.ValueType{Type: o.typ.Type, Unit: o.typ.Unit}
+		}
+		p.Period = o.period
+	}
+	if len(periods) > 1 && ui != nil {
+		ui.PrintErr(fmt.Sprintf("profiles have different periods %s; using %s from -period", strings.Join(periods, ", "), o))
+	}
+}
+
+// checkDefaultSampleTypes warns if profiles, about to be merged, have
+// different default sample types, eg heap profiles captured for
+// alloc_space and for inuse_space. The merged profile keeps the first
+// one set, so the default follows the order of the sources.
+func checkDefaultSampleTypes(profiles []*profile.Profile, ui plugin.UI) {
+	var first string
+	var others []string
+	seen := make(map[string]bool)
+	for _, p := range profiles {
+		switch t := p.DefaultSampleType; {
+		case t == "":
+		case first == "":
+			first = t
+			seen[t] = true
+		case !seen[t]:
+			others = append(others, t)
+			seen[t] = true
+		}
+	}
+	if len(others) > 0 {
+		ui.PrintErr(fmt.Sprintf("profiles have different default sample types %s and %s; using %s from the first source, use -sample_index to select another", first, strings.Join(others, ", "), first))
+	}
+}
+
 type profileSource struct {
 	addr   string
 	source *source
 	scale  float64
 
-	p      *profile.Profile
-	msrc   plugin.MappingSources
-	remote bool
-	err    error
+	p       *profile.Profile
+	msrc    plugin.MappingSources
+	remote  bool
+	err     error
+	elapsed time.Duration // Wall-clock time taken to fetch p.
+	size    int64         // Size of p, if needed for the fetch summary.
+	total   int64         // Total of p before -normalize_sources, if set.
+}
+
+// reportFetchErrors passes the sources that failed to be fetched, if
+// any, to report.
+func reportFetchErrors(sources []profileSource, report func([]*plugin.FetchError)) {
+	if report == nil {
+		return
+	}
+	var errs []*plugin.FetchError
+	for _, s := range sources {
+		if s.err != nil {
+			errs = append(errs, &plugin.FetchError{Source: s.addr, Err: s.err})
+		}
+	}
+	if len(errs) > 0 {
+		report(errs)
+	}
+}
+
+// reportFetchTimings prints the time taken to fetch each of sources,
+// slowest first. For time-based profiles fetched remotely, it is split
+// into the time spent collecting the profile on the server and the
+// remaining time, spent connecting and transferring the profile.
+func reportFetchTimings(sources []profileSource, ui plugin.UI) {
+	sorted := make([]profileSource, 0, len(sources))
+	for _, s := range sources {
+		if s.elapsed > 0 {
+			sorted = append(sorted, s)
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].elapsed > sorted[j].elapsed
+	})
+	lines := []string{"Fetch timings, slowest first: total, collection, transfer"}
+	for _, s := range sorted {
+		collection := collectionTime(s)
+		line := fmt.Sprintf("%10v %10v %10v  %s", s.elapsed.Round(time.Millisecond), collection.Round(time.Millisecond), (s.elapsed - collection).Round(time.Millisecond), stripUserinfo(s.addr))
+		if s.err != nil {
+			line += " (failed)"
+		}
+		lines = append(lines, line)
+	}
+	ui.PrintErr(strings.Join(lines, "\n"))
+}
+
+// collectionTime returns the part of the time taken to fetch s spent
+// by the server collecting a time-based profile, as requested by
+// -seconds or the seconds parameter of its URL.
+func collectionTime(s profileSource) time.Duration {
+	if !s.remote {
+		return 0
+	}
+	d := time.Duration(s.source.Seconds) * time.Second
+	if d <= 0 {
+		sourceURL, _ := adjustURL(s.addr, 0, 0)
+		if u, err := url.Parse(sourceURL); err == nil {
+			if secs, err := strconv.Atoi(u.Query().Get("seconds")); err == nil {
+				d = time.Duration(secs) * time.Second
+			}
+		}
+	}
+	if d < 0 {
+		return 0
+	}
+	if d > s.elapsed {
+		return s.elapsed
+	}
+	return d
+}
+
+// countSkipped returns the number of sources that were skipped
+// on purpose by grabProfile.
+func countSkipped(sources []profileSource) int {
+	var n int
+	for _, s := range sources {
+		if _, ok := s.err.(*skippedError); ok {
+			n++
+		}
+	}
+	return n
 }
 
 // setTmpDir prepares the directory to use to save profiles retrieved
-// remotely. It is selected from PPROF_TMPDIR, defaults to $HOME/pprof.
+// remotely. It is selected from PPROF_TMPDIR, defaults to the first of
+// tmpDirs that can be created.
 func setTmpDir(ui plugin.UI) (string, error) {
 	if profileDir := os.Getenv("PPROF_TMPDIR"); profileDir != "" {
 		return profileDir, nil
 	}
-	for _, tmpDir := range []string{os.Getenv("HOME") + "/pprof", os.TempDir()} {
+	for _, tmpDir := range tmpDirs(runtime.GOOS) {
 		if err := os.MkdirAll(tmpDir, 0755); err != nil {
 			ui.PrintErr("Could not use temp dir ", tmpDir, ": ", err.Error())
 			continue
@@ -227,23 +1168,81 @@ func setTmpDir(ui plugin.UI) (string, error) {
 	return "", fmt.Errorf("failed to identify temp dir")
 }
 
+// tmpDirs returns the directories to try, in order, to save profiles
+// when PPROF_TMPDIR is not set, on the operating system goos. On Linux,
+// $XDG_CACHE_HOME/pprof comes first if XDG_CACHE_HOME is set, following
+// the XDG base directory specification.
+func tmpDirs(goos string) []string {
+	var dirs []string
+	if cache := os.Getenv("XDG_CACHE_HOME"); cache != "" && goos == "linux" {
+		dirs = append(dirs, filepath.Join(cache, "pprof"))
+	}
+	return append(dirs, os.Getenv("HOME")+"/pprof", os.TempDir())
+}
+
+// sourceTimeout returns the timeout for fetching source, either from
+// s.SourceTimeouts or s.Timeout. A timeout that is not positive lets
+// adjustURL pick one based on the profile duration.
+func sourceTimeout(s *source, source string) time.Duration {
+	if t, ok := s.SourceTimeouts[source]; ok {
+		return time.Duration(t) * time.Second
+	}
+	return time.Duration(s.Timeout) * time.Second
+}
+
+// checkTmpDir returns an error if profiles cannot be saved in the
+// directory returned by setTmpDir, checked by creating and removing a
+// probe file in it.
+func checkTmpDir(ui plugin.UI) error {
+	dir, err := setTmpDir(ui)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".pprof-probe")
+	if err != nil {
+		return fmt.Errorf("cannot save profiles in %s, set PPROF_TMPDIR or use -no_save: %v", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
 // grabProfile fetches a profile. Returns the profile, sources for the
 // profile mappings, a bool indicating if the profile was fetched
 // remotely, and an error.
-func grabProfile(s *source, source string, scale float64, fetcher plugin.Fetcher, obj plugin.ObjTool, ui plugin.UI) (p *profile.Profile, msrc plugin.MappingSources, remote bool, err error) {
+func grabProfile(ctx context.Context, s *source, source string, scale float64, fetcher plugin.Fetcher, obj plugin.ObjTool, ui plugin.UI) (p *profile.Profile, msrc plugin.MappingSources, remote bool, err error) {
 	var src string
-	duration, timeout := time.Duration(s.Seconds)*time.Second, time.Duration(s.Timeout)*time.Second
+	duration, timeout := time.Duration(s.Seconds)*time.Second, sourceTimeout(s, source)
+	if data, ok := s.ProfileData[source]; ok {
+		// The profile is already in memory, so there is nothing to
+		// fetch. Remote sources are still used to symbolize it.
+		if p, err = parseProfileData(data, s.MaxDecompressedSize); err != nil {
+			err = fmt.Errorf("parsing profile data for %s: %v", source, err)
+			return
+		}
+		src, _ = adjustURL(source, duration, timeout)
+		src = stripUserinfo(src)
+		fetcher = nil
+	} else if s.PrecheckURL != "" {
+		if err = precheck(ctx, s.PrecheckURL, source, sourceHTTPOptions(s)); err != nil {
+			return
+		}
+	}
 	if fetcher != nil {
 		p, src, err = fetcher.Fetch(source, duration, timeout)
 		if err != nil {
 			return
 		}
 	}
+	var fetched bool
+	var v httpValidators
 	if err != nil || p == nil {
-		// Fetch the profile over HTTP or from a file.
-		p, src, err = fetch(source, duration, timeout, ui)
-		if err != nil {
-			return
+		// Fetch the profile from the cache, over HTTP or from a file.
+		if p, src = cachedProfile(s, source, duration, ui); p == nil {
+			p, src, v, err = fetch(ctx, source, duration, timeout, s, ui)
+			if err != nil {
+				return
+			}
+			fetched = true
 		}
 	}
 
@@ -251,33 +1250,105 @@ func grabProfile(s *source, source string, scale float64, fetcher plugin.Fetcher
 		return
 	}
 
-	// Apply local changes to the profile.
+	// Only cache valid profiles, before any local changes.
+	if fetched && src != "" && s.Cache != nil {
+		if err := s.Cache.put(src, p); err != nil {
+			ui.PrintErr("Could not cache profile: ", err)
+		}
+	}
+
+	if s.Transform != nil {
+		if err = s.Transform(source, p); err != nil {
+			err = fmt.Errorf("transform: %v", err)
+			return
+		}
+		if err = p.CheckValid(); err != nil {
+			err = fmt.Errorf("transform: %v", err)
+			return
+		}
+	}
+
+	// Apply local changes to the profile. Base profiles are not
+	// labeled, so that they apply to the samples from every source.
+	if s.SourceLabels && scale > 0 {
+		labelSamples(p, sourceLabelKey, sourceLabel(source))
+	}
 	p.Scale(scale)
 
 	// Update the binary locations from command line and paths.
-	locateBinaries(p, s, obj, ui)
+	locateBinaries(p, s, source, binarySearchPath(), obj, ui)
 
 	// Collect the source URL for all mappings.
 	if src != "" {
-		msrc = collectMappingSources(p, src)
+		msrc = collectMappingSources(p, src, v, s.MappingSourcesByRange)
 		remote = true
 	}
 	return
 }
 
-// collectMappingSources saves the mapping sources of a profile.
-func collectMappingSources(p *profile.Profile, source string) plugin.MappingSources {
+// cachedProfile returns the profile cached for source, if it is a URL,
+// along with that URL. It returns a nil profile if caching is disabled
+// or the profile is not cached.
+func cachedProfile(s *source, source string, duration time.Duration, ui plugin.UI) (*profile.Profile, string) {
+	if s.Cache == nil {
+		return nil, ""
+	}
+	sourceURL, _ := adjustURL(source, duration, 0)
+	if sourceURL == "" {
+		return nil, ""
+	}
+	sourceURL = stripUserinfo(sourceURL)
+	p := s.Cache.get(sourceURL)
+	if p == nil {
+		return nil, ""
+	}
+	ui.Print("Using cached profile for " + sourceURL)
+	return p, sourceURL
+}
+
+// sourceLabelKey is the label used to record the source of samples.
+const sourceLabelKey = "source"
+
+// sourceLabel returns the value identifying source in sample labels:
+// the host and port for URLs, or else the source itself.
+func sourceLabel(source string) string {
+	if sourceURL, _ := adjustURL(source, 0, 0); sourceURL != "" {
+		if u, err := url.Parse(sourceURL); err == nil && u.Host != "" {
+			return u.Host
+		}
+	}
+	return source
+}
+
+// labelSamples sets the label key to value on all samples of p.
+func labelSamples(p *profile.Profile, key, value string) {
+	for _, s := range p.Sample {
+		if s.Label == nil {
+			s.Label = make(map[string][]string)
+		}
+		s.Label[key] = []string{value}
+	}
+}
+
+// collectMappingSources saves the mapping sources of a profile. If
+// byRange is set, mappings with a file but no build id are keyed by
+// plugin.MappingRangeKey, so that binaries at the same path from
+// different sources are symbolized separately unless Merge combines them.
+func collectMappingSources(p *profile.Profile, source string, v httpValidators, byRange bool) plugin.MappingSources {
 	ms := plugin.MappingSources{}
 	for _, m := range p.Mapping {
-		src := struct {
-			Source string
-			Start  uint64
-		}{
-			source, m.Start,
+		src := plugin.MappingSource{
+			Source:       source,
+			Start:        m.Start,
+			ETag:         v.etag,
+			LastModified: v.lastModified,
 		}
 		key := m.BuildID
 		if key == "" {
 			key = m.File
+			if byRange && key != "" {
+				key = plugin.MappingRangeKey(m)
+			}
 		}
 		if key == "" {
 			// If there is no build id or source file, use the source as the
@@ -293,9 +1364,65 @@ func collectMappingSources(p *profile.Profile, source string) plugin.MappingSour
 	return ms
 }
 
+// mappingSourceURLs returns the URLs of the sources that m, a mapping
+// of a merged profile, was collected from according to msrc, sorted and
+// without duplicates. It helps find the hosts running a binary that
+// could not be symbolized.
+func mappingSourceURLs(msrc plugin.MappingSources, m *profile.Mapping) []string {
+	seen := make(map[string]bool)
+	var urls []string
+	for _, src := range msrc.Lookup(m) {
+		if !seen[src.Source] {
+			seen[src.Source] = true
+			urls = append(urls, src.Source)
+		}
+	}
+	sort.Strings(urls)
+	return urls
+}
+
+// symbolize symbolizes p with sym in the mode given by s. If s has a
+// SymbolizeFilter, only the mappings it matches and their locations are
+// passed to sym, leaving the other locations as they are.
+func symbolize(sym plugin.Symbolizer, s *source, msrcs plugin.MappingSources, p *profile.Profile) error {
+	if s.SymbolizeFilter == nil {
+		return sym.Symbolize(s.Symbolize, msrcs, p)
+	}
+	match := make(map[*profile.Mapping]bool)
+	for _, m := range p.Mapping {
+		match[m] = s.SymbolizeFilter.MatchString(m.File) || m.BuildID != "" && s.SymbolizeFilter.MatchString(m.BuildID)
+	}
+	// Symbolize a shallow copy of p holding only the matching mappings.
+	// The symbolizer updates their locations in place and appends the
+	// functions it finds to the copy, which are copied back to p.
+	q := *p
+	q.Mapping, q.Location = nil, nil
+	for _, m := range p.Mapping {
+		if match[m] {
+			q.Mapping = append(q.Mapping, m)
+		}
+	}
+	if len(q.Mapping) == 0 {
+		return nil
+	}
+	for _, l := range p.Location {
+		if match[l.Mapping] {
+			q.Location = append(q.Location, l)
+		}
+	}
+	err := sym.Symbolize(s.Symbolize, msrcs, &q)
+	p.Function = q.Function
+	return err
+}
+
 // unsourceMappings iterates over the mappings in a profile and replaces file
 // set to the remote source URL by collectMappingSources back to empty string.
-func unsourceMappings(p *profile.Profile) {
+// If keep is set, the URLs are left in place to show where unsymbolized
+// mappings came from.
+func unsourceMappings(p *profile.Profile, keep bool) {
+	if keep {
+		return
+	}
 	for _, m := range p.Mapping {
 		if m.BuildID == "" {
 			if u, err := url.Parse(m.File); err == nil && u.IsAbs() {
@@ -305,14 +1432,49 @@ func unsourceMappings(p *profile.Profile) {
 	}
 }
 
+// pathPrefix is a prefix of source file names to replace, as set with
+// -strip_path.
+type pathPrefix struct {
+	prefix, replacement string
+}
+
+// stripPaths rewrites the file names of the functions in p starting
+// with any of prefixes, as a whole path component, using the first that
+// matches. Matching prefixes are removed, along with the slash after
+// them, unless they have a replacement.
+func stripPaths(p *profile.Profile, prefixes []pathPrefix) {
+	if len(prefixes) == 0 {
+		return
+	}
+	for _, fn := range p.Function {
+		for _, pp := range prefixes {
+			rest := strings.TrimPrefix(fn.Filename, pp.prefix)
+			if rest == fn.Filename || (rest != "" && rest[0] != '/') {
+				continue
+			}
+			if pp.replacement == "" {
+				rest = strings.TrimPrefix(rest, "/")
+			}
+			fn.Filename = pp.replacement + rest
+			break
+		}
+	}
+}
+
 // locateBinaries searches for binary files listed in the profile and, if found,
-// updates the profile accordingly.
-func locateBinaries(p *profile.Profile, s *source, obj plugin.ObjTool, ui plugin.UI) {
-	// Construct search path to examine
-	searchPath := os.Getenv("PPROF_BINARY_PATH")
-	if searchPath == "" {
-		// Use $HOME/pprof/binaries as default directory for local symbolization binaries
-		searchPath = filepath.Join(os.Getenv("HOME"), "pprof", "binaries")
+// updates the profile accordingly. Binaries not found locally are looked up
+// by build id on the symbol server in PPROF_SYMBOL_SERVER, and then on the
+// debuginfod servers in DEBUGINFOD_URLS, if set. In offline mode, only the
+// binaries already downloaded from them are used. Binaries whose SHA256
+// digest differs from the one expected in s.BinaryDigests are skipped.
+// If s.RemoteBinaries is set, the binaries of mappings with a build id
+// are only looked up by build id, skipping the local search. Local
+// binaries are searched for in searchPath, a list of directories like
+// PPROF_BINARY_PATH, after the path of source in s.SourceBinaryPaths,
+// if any.
+func locateBinaries(p *profile.Profile, s *source, source, searchPath string, obj plugin.ObjTool, ui plugin.UI) {
+	if path := s.SourceBinaryPaths[source]; path != "" {
+		searchPath = path + string(filepath.ListSeparator) + searchPath
 	}
 
 mapping:
@@ -331,115 +1493,999 @@ mapping:
 		if m.File != "" {
 			baseName = filepath.Base(m.File)
 		}
-
-		for _, path := range filepath.SplitList(searchPath) {
-			var fileNames []string
-			if m.BuildID != "" {
-				fileNames = []string{filepath.Join(path, m.BuildID, baseName)}
-				if matches, err := filepath.Glob(filepath.Join(path, m.BuildID, "*")); err == nil {
-					fileNames = append(fileNames, matches...)
-				}
+		verified := func(name string) bool {
+			if err := checkBinaryDigest(name, m.BuildID, baseName, s.BinaryDigests); err != nil {
+				ui.PrintErr("Ignoring " + name + ": " + err.Error())
+				return false
 			}
-			if baseName != "" {
-				fileNames = append(fileNames, filepath.Join(path, baseName))
+			return true
+		}
+		if name, ok := s.MappingFiles[m.File]; ok && verified(name) {
+			if useMappingFile(m, name, s.ForceMappingFiles, obj, ui) {
+				continue
 			}
-			for _, name := range fileNames {
-				if f, err := obj.Open(name, m.Start, m.Limit, m.Offset); err == nil {
+		}
+
+		// Files with the build id of the mapping are preferred over
+		// files found by name whose build id is unknown. Files with
+		// another build id, eg left behind by an earlier deployment,
+		// are skipped, warning only about the first one.
+		paths := filepath.SplitList(searchPath)
+		if s.RemoteBinaries && m.BuildID != "" {
+			paths = nil
+		}
+		var fallback string
+		var warned bool
+		for _, path := range paths {
+			for _, name := range binaryCandidates(path, m.BuildID, baseName) {
+				f, err := obj.Open(name, m.Start, m.Limit, m.Offset)
+				if err != nil {
+					continue
+				}
+				fileBuildID := f.BuildID()
+				switch {
+				case m.BuildID == "" || fileBuildID == m.BuildID:
+					if !verified(name) {
+						break
+					}
 					defer f.Close()
-					fileBuildID := f.BuildID()
-					if m.BuildID != "" && m.BuildID != fileBuildID {
-						ui.PrintErr("Ignoring local file " + name + ": build-id mismatch (" + m.BuildID + " != " + fileBuildID + ")")
-					} else {
-						m.File = name
-						continue mapping
+					m.File = name
+					continue mapping
+				case fileBuildID == "":
+					if fallback == "" && verified(name) {
+						fallback = name
 					}
+				case !warned:
+					ui.PrintErr("Ignoring local file " + name + ": build-id mismatch (" + m.BuildID + " != " + fileBuildID + ")")
+					warned = true
+				}
+				f.Close()
+			}
+		}
+		if fallback != "" {
+			m.File = fallback
+			continue
+		}
+
+		// Fall back to the binary from the symbol server, or else to
+		// the debug file from a debuginfod server.
+		if m.BuildID == "" {
+			continue
+		}
+		if name := symbolServerFile(m.BuildID, baseName, s.HTTPProxy, s.Offline, ui); name != "" {
+			if f, err := obj.Open(name, m.Start, m.Limit, m.Offset); err == nil {
+				defer f.Close()
+				if fileBuildID := f.BuildID(); fileBuildID != m.BuildID {
+					ui.PrintErr("Ignoring symbol server file " + name + ": build-id mismatch (" + m.BuildID + " != " + fileBuildID + ")")
+					os.Remove(name)
+				} else if verified(name) {
+					ui.PrintErr("Resolved build id " + m.BuildID + " with symbol server")
+					m.File = name
+					continue
+				}
+			}
+		}
+		if name := debuginfodFile(m.BuildID, s.HTTPProxy, s.Offline, ui); name != "" {
+			if f, err := obj.Open(name, m.Start, m.Limit, m.Offset); err == nil {
+				defer f.Close()
+				if f.BuildID() == m.BuildID && verified(name) {
+					ui.PrintErr("Resolved build id " + m.BuildID + " with debuginfod")
+					m.File = name
+				}
+			}
+		}
+	}
+}
+
+// checkBinaryDigest returns an error if the SHA256 digest of the file
+// name differs from the one digests expects for buildID, or else for
+// baseName. Files without an expected digest are not checked.
+func checkBinaryDigest(name, buildID, baseName string, digests map[string]string) error {
+	want, ok := "", false
+	if buildID != "" {
+		want, ok = digests[buildID]
+	}
+	if !ok && baseName != "" {
+		want, ok = digests[baseName]
+	}
+	if !ok {
+		return nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != want {
+		return fmt.Errorf("sha256 mismatch (%s != %s)", want, got)
+	}
+	return nil
+}
+
+// useMappingFile sets the file of m to name, the binary given for it
+// with -mapping_file, and reports whether it did. The binary is not used
+// if it cannot be opened, or if its build id does not match that of m
+// unless force is set.
+func useMappingFile(m *profile.Mapping, name string, force bool, obj plugin.ObjTool, ui plugin.UI) bool {
+	f, err := obj.Open(name, m.Start, m.Limit, m.Offset)
+	if err != nil {
+		ui.PrintErr("Ignoring mapping file " + name + ": " + err.Error())
+		return false
+	}
+	defer f.Close()
+	if fileBuildID := f.BuildID(); m.BuildID != "" && fileBuildID != m.BuildID && !force {
+		ui.PrintErr("Ignoring mapping file " + name + ": build-id mismatch (" + m.BuildID + " != " + fileBuildID + "), see -force_mapping_files")
+		return false
+	}
+	m.File = name
+	return true
+}
+
+// binaryCandidates returns the files in the directory path that may
+// hold the binary with buildID and baseName, most specific first.
+func binaryCandidates(path, buildID, baseName string) []string {
+	var fileNames []string
+	if buildID != "" {
+		fileNames = []string{filepath.Join(path, buildID, baseName)}
+		if matches, err := filepath.Glob(filepath.Join(path, buildID, "*")); err == nil {
+			for _, match := range matches {
+				if match != fileNames[0] {
+					fileNames = append(fileNames, match)
 				}
 			}
 		}
 	}
+	if baseName != "" {
+		fileNames = append(fileNames, filepath.Join(path, baseName))
+	}
+	return fileNames
+}
+
+// binarySearchPath returns the list of directories to examine for
+// binaries, separated by filepath.ListSeparator.
+func binarySearchPath() string {
+	searchPath := os.Getenv("PPROF_BINARY_PATH")
+	if searchPath == "" {
+		// Use $HOME/pprof/binaries as default directory for local symbolization binaries
+		searchPath = filepath.Join(os.Getenv("HOME"), "pprof", "binaries")
+	}
+	return searchPath
+}
+
+// skippedError reports a profile source that was skipped on purpose,
+// rather than failing to be fetched.
+type skippedError struct {
+	reason string
+}
+
+func (e *skippedError) Error() string {
+	return "skipped: " + e.reason
+}
+
+// precheckTimeout is the timeout for health checks issued by precheck.
+const precheckTimeout = 10 * time.Second
+
+// precheck verifies that the host of a profile source is healthy by
+// issuing a GET to its health check URL, derived from check by
+// precheckURL, with opts applied as in fetchURL. It returns a
+// *skippedError if the check does not return 200. Sources that are not
+// URLs are not checked.
+func precheck(ctx context.Context, check, source string, opts httpOptions) error {
+	checkURL := precheckURL(check, source)
+	if checkURL == "" {
+		return nil
+	}
+	name := stripUserinfo(checkURL)
+	opts, err := opts.withAuthToken(name)
+	if err != nil {
+		return &skippedError{fmt.Sprintf("health check %s: %v", name, err)}
+	}
+	resp, err := httpGet(ctx, checkURL, precheckTimeout, opts)
+	if err != nil {
+		return &skippedError{fmt.Sprintf("health check %s: %v", name, err)}
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &skippedError{fmt.Sprintf("health check %s: %s", name, resp.Status)}
+	}
+	return nil
+}
+
+// precheckURL returns the health check URL for a profile source. If
+// check is an absolute URL it is used as is; otherwise it is resolved
+// against the URL of the source, eg "/healthz" checks the same host
+// the profile is fetched from. It returns "" if source is not a URL.
+func precheckURL(check, source string) string {
+	sourceURL, _ := adjustURL(source, 0, 0)
+	if sourceURL == "" {
+		return ""
+	}
+	u, err := url.Parse(sourceURL)
+	if err != nil {
+		return ""
+	}
+	ref, err := url.Parse(check)
+	if err != nil {
+		return ""
+	}
+	return u.ResolveReference(ref).String()
 }
 
 // fetch fetches a profile from source, within the timeout specified,
 // producing messages through the ui. It returns the profile and the
 // url of the actual source of the profile for remote profiles.
-func fetch(source string, duration, timeout time.Duration, ui plugin.UI) (p *profile.Profile, src string, err error) {
+func fetch(ctx context.Context, source string, duration, timeout time.Duration, s *source, ui plugin.UI) (p *profile.Profile, src string, v httpValidators, err error) {
 	var f io.ReadCloser
 
 	if sourceURL, timeout := adjustURL(source, duration, timeout); sourceURL != "" {
-		ui.Print("Fetching profile over HTTP from " + sourceURL)
+		// Credentials in the URL are only sent with the request, and
+		// never shown or recorded in the profile.
+		src = stripUserinfo(sourceURL)
+		ui.Print("Fetching profile over HTTP from " + src)
 		if duration > 0 {
 			ui.Print(fmt.Sprintf("Please wait... (%v)", duration))
 		}
-		f, err = fetchURL(sourceURL, timeout)
-		src = sourceURL
+		f, v, err = fetchURL(ctx, sourceURL, timeout, s.Retries, s.MaxProfileSize, sourceHTTPOptions(s))
+	} else if source == stdinSource {
+		f = ioutil.NopCloser(os.Stdin)
+	} else if isDataURL(source) {
+		f, err = decodeDataURL(source)
+	} else if isArchive(source) {
+		p, err = fetchArchive(source, s.MaxDecompressedSize, ui)
+		return
 	} else if isPerfFile(source) {
-		f, err = convertPerfData(source, ui)
+		f, err = convertPerfData(source, s.PerfConverter, s.PerfConverterStdout, ui)
+	} else if isJFRFile(source) {
+		f, err = convertJFR(source, s.JFRConverter, ui)
+	} else if isTraceFile(source) {
+		f, err = convertTrace(source, s.TraceConverter, ui)
 	} else {
 		f, err = os.Open(source)
 	}
 	if err == nil {
 		defer f.Close()
-		p, err = profile.Parse(f)
+		var data []byte
+		if data, err = ioutil.ReadAll(f); err == nil {
+			p, err = parseProfileData(data, s.MaxDecompressedSize)
+		}
 	}
 	return
 }
 
-// fetchURL fetches a profile from a URL using HTTP.
-func fetchURL(source string, timeout time.Duration) (io.ReadCloser, error) {
-	resp, err := httpGet(source, timeout)
-	if err != nil {
-		return nil, fmt.Errorf("http fetch %s: %v", source, err)
-	}
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("server response: %s", resp.Status)
-	}
+// stdinSource is the source to read a profile from standard input.
+const stdinSource = "-"
+
+// maxDataURLSize is the maximum size in bytes of a profile decoded from
+// a data: URL, which is meant for small profiles pasted in bug reports.
+const maxDataURLSize = 1 << 20
 
-	return resp.Body, nil
+// isDataURL reports whether source is a data: URL holding a profile.
+func isDataURL(source string) bool {
+	return strings.HasPrefix(source, "data:")
 }
 
-// isPerfFile checks if a file is in perf.data format. It also returns false
-// if it encounters an error during the check.
-func isPerfFile(path string) bool {
-	sourceFile, openErr := os.Open(path)
-	if openErr != nil {
-		return false
+// decodeDataURL returns a reader for the payload of the data: URL
+// source, of the form data:[<mediatype>][;base64],<data>. The media
+// type is ignored.
+func decodeDataURL(source string) (io.ReadCloser, error) {
+	i := strings.Index(source, ",")
+	if i < 0 {
+		return nil, fmt.Errorf("malformed data URL: missing comma")
 	}
-	defer sourceFile.Close()
-
-	// If the file is the output of a perf record command, it should begin
-	// with the string PERFILE2.
-	perfHeader := []byte("PERFILE2")
-	actualHeader := make([]byte, len(perfHeader))
-	if _, readErr := sourceFile.Read(actualHeader); readErr != nil {
-		return false
+	params, payload := source[len("data:"):i], source[i+1:]
+	var data []byte
+	if strings.HasSuffix(params, ";base64") {
+		payload = strings.TrimRight(payload, "=")
+		if base64.RawStdEncoding.DecodedLen(len(payload)) > maxDataURLSize {
+			return nil, fmt.Errorf("data URL exceeds %d bytes", maxDataURLSize)
+		}
+		var err error
+		if data, err = base64.RawStdEncoding.DecodeString(payload); err != nil {
+			return nil, fmt.Errorf("malformed data URL: %v", err)
+		}
+	} else {
+		unescaped, err := url.PathUnescape(payload)
+		if err != nil {
+			return nil, fmt.Errorf("malformed data URL: %v", err)
+		}
+		if len(unescaped) > maxDataURLSize {
+			return nil, fmt.Errorf("data URL exceeds %d bytes", maxDataURLSize)
+		}
+		data = []byte(unescaped)
 	}
-	return bytes.Equal(actualHeader, perfHeader)
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
 }
 
-// convertPerfData converts the file at path which should be in perf.data format
-// using the perf_to_profile tool and returns the file containing the
-// profile.proto formatted data.
-func convertPerfData(perfPath string, ui plugin.UI) (*os.File, error) {
-	ui.Print(fmt.Sprintf(
-		"Converting %s to a profile.proto... (May take a few minutes)",
-		perfPath))
-	profile, err := newTempFile(os.TempDir(), "pprof_", ".pb.gz")
+// defaultMaxDecompressedSize is the default maximum size in bytes of a
+// decompressed profile. It is far larger than real profiles, but stops
+// a gzip bomb from exhausting memory.
+const defaultMaxDecompressedSize = 1 << 30
+
+// parseProfileData parses a profile from data, which may be gzipped,
+// or gzipped twice as served by some endpoints. If maxSize is
+// positive, decompressing data to more than maxSize bytes is aborted
+// with an error rather than exhausting memory.
+func parseProfileData(data []byte, maxSize int64) (*profile.Profile, error) {
+	data, err := decompressProfile(data, maxSize)
 	if err != nil {
 		return nil, err
 	}
-	deferDeleteTempFile(profile.Name())
-	cmd := exec.Command("perf_to_profile", perfPath, profile.Name())
-	if err := cmd.Run(); err != nil {
-		profile.Close()
-		return nil, fmt.Errorf("failed to convert perf.data file. Try github.com/google/perf_data_converter: %v", err)
+	return profile.ParseData(data)
+}
+
+// decompressProfile returns data with all its gzip layers removed,
+// returning an error if any of them decompresses to more than maxSize
+// bytes, if positive. Other data is returned unchanged.
+func decompressProfile(data []byte, maxSize int64) ([]byte, error) {
+	for isGzip(data) {
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("decompressing profile: %v", err)
+		}
+		var r io.Reader = gz
+		if maxSize > 0 {
+			// Read one byte past the limit, to tell if the data exceeds it.
+			r = io.LimitReader(gz, maxSize+1)
+		}
+		if data, err = ioutil.ReadAll(r); err != nil {
+			return nil, fmt.Errorf("decompressing profile: %v", err)
+		}
+		if maxSize > 0 && int64(len(data)) > maxSize {
+			return nil, fmt.Errorf("decompressing profile: exceeds max size of %d bytes, see -max_decompressed_size", maxSize)
+		}
 	}
-	return profile, nil
+	return data, nil
 }
 
-// adjustURL validates if a profile source is a URL and returns an
-// cleaned up URL and the timeout to use for retrieval over HTTP.
+// isGzip reports whether data starts with the gzip magic number.
+func isGzip(data []byte) bool {
+	return len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b
+}
+
+// fetchURL fetches a profile from a URL using HTTP as configured by
+// opts. Connections refused by the address check of opts are not
+// attempted. The encodings decodeBody can decode are requested with
+// withAcceptEncoding, and profiles sent with a Content-Encoding are
+// decoded by decodeBody. If maxSize is positive, reading more than
+// maxSize bytes of the decoded profile returns an error.
+//
+// Connection errors and 5xx responses are retried up to retries
+// times, with jittered exponential backoff, as are 401 responses if
+// opts has a token function, to refresh an expired token. No retry is
+// attempted if it would not start within timeout of the first attempt,
+// and each attempt only gets the remainder of the timeout. Responses
+// with status 202 (Accepted), for profiles that are not ready yet, and
+// 429 (Too Many Requests), from rate limiting servers, are requested
+// again after the delay in their Retry-After header, or with
+// exponential backoff, until the timeout; they do not count as
+// retries. Cancelling ctx aborts the request and any pending retry.
+//
+// The validators of the response are returned along with the profile,
+// which is checked against the checksum trailers of the response by
+// checksumBody. Credentials in the userinfo of source are sent as
+// basic auth by getURL, and left out of errors.
+func fetchURL(ctx context.Context, source string, timeout time.Duration, retries int, maxSize int64, opts httpOptions) (io.ReadCloser, httpValidators, error) {
+	name := stripUserinfo(source)
+	deadline := time.Now().Add(timeout)
+	opts = opts.withAcceptEncoding()
+	for attempt, polls := 0, 0; ; {
+		attemptOpts, err := opts.withAuthToken(name)
+		if err != nil {
+			return nil, httpValidators{}, fmt.Errorf("http fetch %s: %v", name, err)
+		}
+		resp, err := httpGet(ctx, source, timeout, attemptOpts)
+		// Poll again for profiles that are not ready yet, and wait as
+		// long as rate limiting servers ask.
+		if err == nil && (resp.StatusCode == http.StatusAccepted || resp.StatusCode == http.StatusTooManyRequests) {
+			resp.Body.Close()
+			delay := pollDelay(resp.Header.Get("Retry-After"), polls)
+			polls++
+			if timeout = deadline.Sub(time.Now()) - delay; timeout <= 0 {
+				if resp.StatusCode == http.StatusTooManyRequests {
+					return nil, httpValidators{}, fmt.Errorf("http fetch %s: rate limited, insufficient timeout to retry after %v", name, delay)
+				}
+				return nil, httpValidators{}, fmt.Errorf("http fetch %s: profile not ready before timeout", name)
+			}
+			if err := sleep(ctx, delay); err != nil {
+				return nil, httpValidators{}, err
+			}
+			continue
+		}
+		if err == nil && resp.StatusCode == http.StatusOK {
+			if err := checkContentType(resp); err != nil {
+				resp.Body.Close()
+				return nil, httpValidators{}, err
+			}
+			encoding := resp.Header.Get("Content-Encoding")
+			body, err := decodeBody(ctx, checksumBody(resp), encoding)
+			if err != nil {
+				return nil, httpValidators{}, fmt.Errorf("http fetch %s: %v", name, err)
+			}
+			if maxSize > 0 {
+				// The Content-Length of compressed responses is their
+				// compressed size, so only the decoded bytes are counted.
+				if resp.ContentLength > maxSize && encoding == "" && !resp.Uncompressed {
+					body.Close()
+					return nil, httpValidators{}, &profileSizeError{maxSize}
+				}
+				body = &limitedBody{body, maxSize, maxSize}
+			}
+			return body, httpValidators{resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")}, nil
+		}
+		if err == nil {
+			resp.Body.Close()
+			err = fmt.Errorf("server response: %s", resp.Status)
+			// A token that expired is refreshed on the next attempt.
+			if resp.StatusCode < 500 && !(resp.StatusCode == http.StatusUnauthorized && opts.token != nil) {
+				return nil, httpValidators{}, err
+			}
+		} else {
+			var denied *addrDeniedError
+			if errors.As(err, &denied) {
+				return nil, httpValidators{}, denied
+			}
+			var redirect *redirectError
+			refused := errors.As(err, &redirect)
+			err = fmt.Errorf("http fetch %s: %v", name, err)
+			if refused {
+				// Retrying would be refused again.
+				return nil, httpValidators{}, err
+			}
+		}
+		if attempt >= retries {
+			return nil, httpValidators{}, err
+		}
+		delay := retryDelay(attempt)
+		attempt++
+		if timeout = deadline.Sub(time.Now()) - delay; timeout <= 0 {
+			return nil, httpValidators{}, err
+		}
+		if err := sleep(ctx, delay); err != nil {
+			return nil, httpValidators{}, err
+		}
+	}
+}
+
+// httpValidators are the validators of an HTTP response, recorded in
+// the mapping sources of the profile it holds.
+type httpValidators struct {
+	etag, lastModified string
+}
+
+// withAuthToken returns opts with the bearer token returned by its
+// token function for source as the Authorization field of its header,
+// leaving the header of opts unchanged. It returns opts itself if it
+// has no token function.
+func (opts httpOptions) withAuthToken(source string) (httpOptions, error) {
+	if opts.token == nil {
+		return opts, nil
+	}
+	t, err := opts.token(source)
+	if err != nil {
+		return httpOptions{}, fmt.Errorf("auth token: %v", err)
+	}
+	h := opts.header.Clone()
+	if h == nil {
+		h = make(http.Header)
+	}
+	h.Set("Authorization", "Bearer "+t)
+	opts.header = h
+	return opts, nil
+}
+
+// withAcceptEncoding returns opts with an Accept-Encoding field in its
+// header listing the encodings decodeBody can decode, leaving the
+// header of opts unchanged. zstd is only listed if zstdCommand is
+// installed. It returns opts itself if its header already has an
+// Accept-Encoding field.
+func (opts httpOptions) withAcceptEncoding() httpOptions {
+	if opts.header.Get("Accept-Encoding") != "" {
+		return opts
+	}
+	h := opts.header.Clone()
+	if h == nil {
+		h = make(http.Header)
+	}
+	// Setting the field keeps the transport from decompressing gzipped
+	// responses itself, so decodeBody decodes them too.
+	h.Set("Accept-Encoding", "gzip")
+	if lookZstd() == nil {
+		h.Set("Accept-Encoding", "zstd, gzip")
+	}
+	opts.header = h
+	return opts
+}
+
+// zstdCommand is the command decompressing zstd streams, which the
+// standard library cannot decode. It is an optional dependency: zstd
+// is only requested from servers if it is installed.
+const zstdCommand = "zstd"
+
+// lookZstd returns an error if zstdCommand is not installed; it is a
+// variable so it can be replaced during testing.
+var lookZstd = func() error {
+	_, err := exec.LookPath(zstdCommand)
+	return err
+}
+
+// decodeBody returns a reader for body decoded from the given
+// Content-Encoding, closing body if it is not returned. Gzipped
+// profiles are decompressed as they are read, so that their size is
+// that of the profile rather than of the response. Profiles compressed
+// with zstd are decompressed by zstdCommand as they are read, which is
+// killed if ctx is cancelled, and which must be installed.
+func decodeBody(ctx context.Context, body io.ReadCloser, encoding string) (io.ReadCloser, error) {
+	switch encoding = strings.ToLower(strings.TrimSpace(encoding)); encoding {
+	case "", "identity":
+		return body, nil
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			body.Close()
+			return nil, fmt.Errorf("decompressing gzip response: %v", err)
+		}
+		return gzipBody{gz, body}, nil
+	case "zstd":
+		// Servers may send zstd without being asked for it.
+		if err := lookZstd(); err != nil {
+			body.Close()
+			return nil, fmt.Errorf("cannot decompress zstd response: the %s command is not installed: %v", zstdCommand, err)
+		}
+		cmd := exec.CommandContext(ctx, zstdCommand, "-d", "-c", "-q")
+		cmd.Stdin = body
+		r := &converterOutput{cmd: cmd, in: body, action: "decompress zstd response"}
+		cmd.Stderr = &r.stderr
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			body.Close()
+			return nil, err
+		}
+		r.out = out
+		if err := cmd.Start(); err != nil {
+			body.Close()
+			return nil, fmt.Errorf("failed to decompress zstd response with %s: %v", zstdCommand, err)
+		}
+		return r, nil
+	default:
+		body.Close()
+		return nil, fmt.Errorf("unsupported Content-Encoding %q", encoding)
+	}
+}
+
+// gzipBody is a response body decompressed by a gzip.Reader, closing
+// the response body when closed.
+type gzipBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (b gzipBody) Close() error {
+	b.Reader.Close()
+	return b.body.Close()
+}
+
+// sleep waits for d, returning early with the error of ctx if ctx is
+// cancelled.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// profileSizeError is the error for a profile larger than the maximum
+// size allowed.
+type profileSizeError struct {
+	max int64
+}
+
+func (e *profileSizeError) Error() string {
+	return fmt.Sprintf("profile exceeds max size of %d bytes", e.max)
+}
+
+// limitedBody is a response body returning a profileSizeError once
+// more than max bytes are read from it.
+type limitedBody struct {
+	io.ReadCloser
+	max, remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	// Read one byte past the limit, to tell if the body exceeds it.
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if b.remaining -= int64(n); b.remaining < 0 {
+		return 0, &profileSizeError{b.max}
+	}
+	return n, err
+}
+
+// checksumTrailers are the HTTP trailers holding a checksum of the
+// body as sent, in hex, along with the table of the CRC-32 it is.
+var checksumTrailers = map[string]*crc32.Table{
+	"X-Checksum-Crc32":  crc32.IEEETable,
+	"X-Checksum-Crc32c": crc32.MakeTable(crc32.Castagnoli),
+}
+
+// checksumBody returns the body of resp, checking once it is read to
+// the end that it matches the checksums in the trailers of resp, to
+// catch truncated profiles. Responses declaring no checksum trailer
+// keep their body as it is.
+func checksumBody(resp *http.Response) io.ReadCloser {
+	hashes := make(map[string]hash.Hash32)
+	for name := range resp.Trailer {
+		if table, ok := checksumTrailers[name]; ok {
+			hashes[name] = crc32.New(table)
+		}
+	}
+	if len(hashes) == 0 {
+		return resp.Body
+	}
+	return &checkedBody{resp.Body, resp.Trailer, hashes}
+}
+
+// checkedBody is a response body returning an error at its end if it
+// does not match the checksums in trailer, computed by hashes, keyed
+// by trailer name. Trailers declared but not sent are ignored.
+type checkedBody struct {
+	io.ReadCloser
+	trailer http.Header
+	hashes  map[string]hash.Hash32
+}
+
+func (b *checkedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	for _, h := range b.hashes {
+		h.Write(p[:n])
+	}
+	if err != io.EOF {
+		return n, err
+	}
+	for name, h := range b.hashes {
+		want := b.trailer.Get(name)
+		if got := fmt.Sprintf("%08x", h.Sum32()); want != "" && !strings.EqualFold(want, got) {
+			return n, fmt.Errorf("corrupt profile (checksum mismatch): got %s %s, computed %s", name, want, got)
+		}
+	}
+	return n, err
+}
+
+// checkContentType returns an error if resp holds an HTML page rather
+// than a profile, as served by misconfigured endpoints, including the
+// first line of the page to help diagnose the problem.
+func checkContentType(resp *http.Response) error {
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediaType != "text/html" {
+		return nil
+	}
+	line, _ := bufio.NewReader(io.LimitReader(resp.Body, 1024)).ReadString('\n')
+	return fmt.Errorf("server returned HTML, not a profile (is the URL correct?): %s", strings.TrimSpace(line))
+}
+
+// retryBaseDelay is the backoff before the first retry of fetchURL;
+// it is a variable so it can be shortened during testing.
+var retryBaseDelay = 500 * time.Millisecond
+
+// retryDelay returns the backoff before retry number attempt, counting
+// from 0. The delay doubles on each attempt, and is jittered by up to
+// half of its length so that concurrent fetches do not retry in lockstep.
+func retryDelay(attempt int) time.Duration {
+	d := retryBaseDelay << uint(attempt)
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// maxPollDelay is the longest backoff between polls for a profile that
+// is not ready yet, when the server does not specify one.
+const maxPollDelay = 10 * time.Second
+
+// pollDelay returns the delay before polling again for a profile that
+// is not ready yet, after poll previous polls, counting from 0. It is
+// taken from retryAfter, the value of the Retry-After header in seconds
+// or as an HTTP date, if valid, or else backs off exponentially.
+func pollDelay(retryAfter string, poll int) time.Duration {
+	if secs, err := strconv.Atoi(retryAfter); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(retryAfter); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+		return 0
+	}
+	if d := retryBaseDelay << uint(poll); poll < 16 && d < maxPollDelay {
+		return d
+	}
+	return maxPollDelay
+}
+
+// staggerStart waits for a random delay of up to s.FetchStagger before
+// fetching a time-based profile, so that concurrent fetches of live
+// profiles do not all reach the servers at once. Since the delays are
+// not cumulative, they add at most s.FetchStagger to the time taken to
+// fetch all profiles. It returns early with the error of ctx if ctx is
+// cancelled.
+func staggerStart(ctx context.Context, s *source) error {
+	if s.FetchStagger <= 0 || s.Seconds <= 0 {
+		return nil
+	}
+	t := time.NewTimer(time.Duration(rand.Int63n(int64(s.FetchStagger))))
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// isPerfFile checks if a file is in perf.data format. It also returns false
+// if it encounters an error during the check.
+func isPerfFile(path string) bool {
+	sourceFile, openErr := os.Open(path)
+	if openErr != nil {
+		return false
+	}
+	defer sourceFile.Close()
+
+	actualHeader := make([]byte, perfMagicLen)
+	if _, readErr := io.ReadFull(sourceFile, actualHeader); readErr != nil {
+		return false
+	}
+	return isPerfMagic(actualHeader)
+}
+
+// perfMagics are the magic numbers at the start of the output of a
+// perf record command. The magic is a 64-bit integer, so it appears
+// byte-swapped in files recorded on big-endian hosts.
+var perfMagics = []string{
+	"PERFILE2", // Current format.
+	"2ELIFREP", // Current format, big-endian.
+	"PERFFILE", // Legacy format.
+	"ELIFFREP", // Legacy format, big-endian.
+}
+
+// perfMagicLen is the length of the magic numbers in perfMagics.
+const perfMagicLen = 8
+
+// isPerfMagic reports whether header starts with a perf.data magic number.
+func isPerfMagic(header []byte) bool {
+	if len(header) < perfMagicLen {
+		return false
+	}
+	for _, magic := range perfMagics {
+		if string(header[:perfMagicLen]) == magic {
+			return true
+		}
+	}
+	return false
+}
+
+// convertPerfData converts the file at path which should be in perf.data format
+// using the converter tool, perf_to_profile by default, and returns a reader
+// for the profile.proto formatted data. If stdout is set, the converter writes
+// the profile to its standard output, which is read as it is produced;
+// otherwise it writes to a temporary file.
+func convertPerfData(perfPath, converter string, stdout bool, ui plugin.UI) (io.ReadCloser, error) {
+	if converter == "" {
+		converter = "perf_to_profile"
+	}
+	converterPath, err := exec.LookPath(converter)
+	if err != nil {
+		return nil, fmt.Errorf("perf.data converter %s not found. Try github.com/google/perf_data_converter: %v", converter, err)
+	}
+	ui.Print(fmt.Sprintf(
+		"Converting %s to a profile.proto... (May take a few minutes)",
+		perfPath))
+	if stdout {
+		return streamPerfData(perfPath, converterPath)
+	}
+	return runConverter("perf.data", perfPath, converterPath)
+}
+
+// runConverter runs converterPath to convert the file at path, in the
+// given format, into a temporary profile.proto file, and returns a
+// reader for it. The converter is given the input and output files as
+// arguments.
+func runConverter(format, path, converterPath string) (io.ReadCloser, error) {
+	profile, err := newTempFile(os.TempDir(), "pprof_", ".pb.gz")
+	if err != nil {
+		return nil, err
+	}
+	deferDeleteTempFile(profile.Name())
+	cmd := exec.Command(converterPath, path, profile.Name())
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		profile.Close()
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%v: %s", err, msg)
+		}
+		return nil, fmt.Errorf("failed to convert %s file with %s: %v", format, converterPath, err)
+	}
+	return profile, nil
+}
+
+// isJFRFile checks if a file is a Java Flight Recorder recording. It
+// also returns false if it encounters an error during the check.
+func isJFRFile(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	header := make([]byte, len(jfrMagic))
+	if _, err := io.ReadFull(f, header); err != nil {
+		return false
+	}
+	return isJFRMagic(header)
+}
+
+// jfrMagic is the magic number at the start of each chunk of a Java
+// Flight Recorder recording.
+const jfrMagic = "FLR\x00"
+
+// isJFRMagic reports whether header starts with the JFR magic number.
+func isJFRMagic(header []byte) bool {
+	return bytes.HasPrefix(header, []byte(jfrMagic))
+}
+
+// convertJFR converts the Java Flight Recorder file at path using the
+// converter tool, jfr_to_profile by default, and returns a reader for
+// the profile.proto formatted data.
+func convertJFR(path, converter string, ui plugin.UI) (io.ReadCloser, error) {
+	if converter == "" {
+		converter = "jfr_to_profile"
+	}
+	converterPath, err := exec.LookPath(converter)
+	if err != nil {
+		return nil, fmt.Errorf("JFR converter %s not found. Set PPROF_JFR_CONVERTER to a tool converting JFR files to profile.proto: %v", converter, err)
+	}
+	ui.Print(fmt.Sprintf("Converting %s to a profile.proto...", path))
+	return runConverter("JFR", path, converterPath)
+}
+
+// isTraceFile checks if a file is a Go execution trace, as written by
+// runtime/trace. It also returns false if it encounters an error during
+// the check.
+func isTraceFile(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	header := make([]byte, traceHeaderSize)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return false
+	}
+	return isTraceMagic(header)
+}
+
+// traceHeaderSize is the size of the header of Go execution traces,
+// such as "go 1.22 trace\x00\x00\x00", padded with zeros.
+const traceHeaderSize = 16
+
+// isTraceMagic reports whether header starts with the header of a Go
+// execution trace.
+func isTraceMagic(header []byte) bool {
+	if len(header) < traceHeaderSize || !bytes.HasPrefix(header, []byte("go 1.")) {
+		return false
+	}
+	return bytes.Contains(header[:traceHeaderSize], []byte(" trace\x00"))
+}
+
+// convertTrace converts the Go execution trace at path using the
+// converter tool, trace_to_profile by default, and returns a reader for
+// the profile.proto formatted data, such as a goroutine or scheduler
+// latency profile derived from the trace.
+func convertTrace(path, converter string, ui plugin.UI) (io.ReadCloser, error) {
+	if converter == "" {
+		converter = "trace_to_profile"
+	}
+	converterPath, err := exec.LookPath(converter)
+	if err != nil {
+		return nil, fmt.Errorf("trace converter %s not found. Set PPROF_TRACE_CONVERTER to a tool converting Go execution traces to profile.proto: %v", converter, err)
+	}
+	ui.Print(fmt.Sprintf("Converting %s to a profile.proto...", path))
+	return runConverter("Go trace", path, converterPath)
+}
+
+// streamPerfData starts converterPath to convert perfPath, writing the
+// profile to its standard output, and returns a reader for it.
+func streamPerfData(perfPath, converterPath string) (io.ReadCloser, error) {
+	cmd := exec.Command(converterPath, perfPath, "-")
+	r := &converterOutput{cmd: cmd, action: "convert perf.data file"}
+	cmd.Stderr = &r.stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	r.out = out
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to convert perf.data file with %s: %v", converterPath, err)
+	}
+	return r, nil
+}
+
+// converterOutput reads the standard output of a command converting
+// its input, such as a perf.data converter. Once the output is
+// exhausted, the command must exit successfully for the read to
+// complete without error. If set, in is the input of the command,
+// closed once the command is done with it.
+type converterOutput struct {
+	cmd    *exec.Cmd
+	out    io.ReadCloser
+	in     io.Closer
+	action string // What the command does, for errors.
+	stderr bytes.Buffer
+	done   bool
+	err    error
+}
+
+func (r *converterOutput) Read(p []byte) (int, error) {
+	n, err := r.out.Read(p)
+	if err == io.EOF {
+		if werr := r.wait(); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// Close stops the converter if it has not finished yet.
+func (r *converterOutput) Close() error {
+	if !r.done {
+		r.cmd.Process.Kill()
+		// Unblock the copy of the input to the killed command.
+		if r.in != nil {
+			r.in.Close()
+		}
+		r.wait()
+	}
+	return nil
+}
+
+// wait waits for the converter to exit, and returns an error including
+// its stderr if it failed.
+func (r *converterOutput) wait() error {
+	if r.done {
+		return r.err
+	}
+	r.done = true
+	err := r.cmd.Wait()
+	if r.in != nil {
+		r.in.Close()
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(r.stderr.String()); msg != "" {
+			err = fmt.Errorf("%v: %s", err, msg)
+		}
+		r.err = fmt.Errorf("failed to %s with %s: %v", r.action, r.cmd.Path, err)
+	}
+	return r.err
+}
+
+// adjustURL validates if a profile source is a URL and returns an
+// cleaned up URL and the timeout to use for retrieval over HTTP.
 // If the source cannot be recognized as a URL it returns an empty string.
+// Sources on a Unix domain socket keep their unix:// form.
 func adjustURL(source string, duration, timeout time.Duration) (string, time.Duration) {
+	if isDataURL(source) {
+		// Profiles inlined in the source are never remote.
+		return "", 0
+	}
+	socket, source := splitUnixSocket(source)
 	u, err := url.Parse(source)
 	if err != nil || (u.Host == "" && u.Scheme != "" && u.Scheme != "file") {
 		// Try adding http:// to catch sources of the form hostname:port/path.
@@ -450,12 +2496,14 @@ func adjustURL(source string, duration, timeout time.Duration) (string, time.Dur
 		return "", 0
 	}
 
-	// Apply duration/timeout overrides to URL.
-	values := u.Query()
-	if duration > 0 {
-		values.Set("seconds", fmt.Sprint(int(duration.Seconds())))
+	// Apply duration/timeout overrides to URL. Range queries, with from
+	// or to parameters, are not time-based and are left as they are.
+	if isRangeQuery(u.Query()) {
+		duration = 0
+	} else if duration > 0 {
+		u.RawQuery = setQuerySeconds(u.RawQuery, int(duration.Seconds()))
 	} else {
-		if urlSeconds := values.Get("seconds"); urlSeconds != "" {
+		if urlSeconds := u.Query().Get("seconds"); urlSeconds != "" {
 			if us, err := strconv.ParseInt(urlSeconds, 10, 32); err == nil {
 				duration = time.Duration(us) * time.Second
 			}
@@ -468,17 +2516,456 @@ func adjustURL(source string, duration, timeout time.Duration) (string, time.Dur
 			timeout = 60 * time.Second
 		}
 	}
-	u.RawQuery = values.Encode()
+	if socket != "" {
+		return unixSocketPrefix + socket + ":" + u.RequestURI(), timeout
+	}
 	return u.String(), timeout
 }
 
-// httpGet is a wrapper around http.Get; it is defined as a variable
+// unixSocketPrefix starts the sources served over HTTP on a Unix domain
+// socket, of the form unix:///path/to/socket:/path/to/profile.
+const unixSocketPrefix = "unix://"
+
+// splitUnixSocket returns the socket path of a source served on a Unix
+// domain socket, along with an http URL for the rest of the source,
+// which is sent to the socket. Other sources are returned unchanged,
+// with an empty socket path.
+func splitUnixSocket(source string) (socket, rest string) {
+	if !strings.HasPrefix(source, unixSocketPrefix) {
+		return "", source
+	}
+	path := strings.TrimPrefix(source, unixSocketPrefix)
+	i := strings.Index(path, ":/")
+	if i <= 0 {
+		return "", source
+	}
+	return path[:i], "http://localhost" + path[i+1:]
+}
+
+// isRangeQuery reports whether query requests the profile data for a
+// time range, with from or to parameters, as served by continuous
+// profiling servers. A step parameter may set the resolution.
+func isRangeQuery(query url.Values) bool {
+	_, from := query["from"]
+	_, to := query["to"]
+	return from || to
+}
+
+// rangeSources returns addrs with the remote sources requesting the
+// profile data for the last duration before now, with from and to
+// parameters in Unix seconds, if last is set. It returns an error for
+// remote sources combining a time range with a duration, from their
+// seconds parameter or from seconds if positive.
+func rangeSources(addrs []string, seconds int, last time.Duration, now time.Time) ([]string, error) {
+	var ranged []string
+	for _, addr := range addrs {
+		sourceURL, _ := adjustURL(addr, 0, 0)
+		if sourceURL == "" {
+			ranged = append(ranged, addr)
+			continue
+		}
+		u, err := url.Parse(sourceURL)
+		if err != nil {
+			return nil, err
+		}
+		query := u.Query()
+		_, hasSeconds := query["seconds"]
+		hasSeconds = hasSeconds || seconds > 0
+		switch {
+		case last > 0 && isRangeQuery(query):
+			return nil, fmt.Errorf("%s: -range cannot be combined with from and to parameters", addr)
+		case last > 0 && hasSeconds:
+			return nil, fmt.Errorf("%s: -range cannot be combined with a duration in seconds", addr)
+		case isRangeQuery(query) && hasSeconds:
+			return nil, fmt.Errorf("%s: from and to parameters cannot be combined with a duration in seconds", addr)
+		case last > 0:
+			sep := "&"
+			if u.RawQuery == "" {
+				sep = "?"
+			}
+			addr = fmt.Sprintf("%s%sfrom=%d&to=%d", sourceURL, sep, now.Add(-last).Unix(), now.Unix())
+		}
+		ranged = append(ranged, addr)
+	}
+	return ranged, nil
+}
+
+// setQuerySeconds returns rawQuery with its seconds parameter set to
+// seconds, replacing any existing ones. Other parameters are kept
+// as they are, in the same order.
+func setQuerySeconds(rawQuery string, seconds int) string {
+	param := fmt.Sprintf("seconds=%d", seconds)
+	var params []string
+	set := false
+	for _, p := range strings.Split(rawQuery, "&") {
+		if p == "" {
+			continue
+		}
+		key := p
+		if i := strings.Index(p, "="); i >= 0 {
+			key = p[:i]
+		}
+		if k, err := url.QueryUnescape(key); err == nil && k == "seconds" {
+			if !set {
+				params = append(params, param)
+				set = true
+			}
+			continue
+		}
+		params = append(params, p)
+	}
+	if !set {
+		params = append(params, param)
+	}
+	return strings.Join(params, "&")
+}
+
+// stripUserinfo returns the URL source without its userinfo, so that
+// credentials given in the URL are not shown or saved. Sources without
+// a scheme are parsed as http URLs, as adjustURL does, and returned
+// without one. Sources that are not URLs with userinfo are returned
+// unchanged.
+func stripUserinfo(source string) string {
+	raw := source
+	if !strings.Contains(source, "://") {
+		raw = "http://" + source
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.User == nil || u.User.String() == "" {
+		return source
+	}
+	u.User = nil
+	if raw != source {
+		return strings.TrimPrefix(u.String(), "http://")
+	}
+	return u.String()
+}
+
+// httpOptions configure the HTTP requests made to fetch profiles.
+type httpOptions struct {
+	header    http.Header                  // Added to each request.
+	token     func(string) (string, error) // Bearer token for each URL, if set.
+	proxy     *url.URL                     // Overrides the proxy from the environment.
+	checkAddr addrCheck                    // Refuses connections to some addresses.
+	tlsConfig *tls.Config                  // Client certificates and CAs for https.
+	transport http.RoundTripper            // Replaces the built-in transport.
+}
+
+// sourceHTTPOptions returns the options of the HTTP requests made to
+// fetch the profiles of s.
+func sourceHTTPOptions(s *source) httpOptions {
+	return httpOptions{
+		header:    s.HTTPHeader,
+		token:     s.HTTPAuthToken,
+		proxy:     s.HTTPProxy,
+		checkAddr: s.CheckFetchAddr,
+		tlsConfig: s.TLSConfig,
+		transport: s.HTTPTransport,
+	}
+}
+
+// httpGet is a wrapper around getURL; it is defined as a variable
 // so it can be redefined during for testing.
-var httpGet = func(url string, timeout time.Duration) (*http.Response, error) {
-	client := &http.Client{
-		Transport: &http.Transport{
-			ResponseHeaderTimeout: timeout + 5*time.Second,
-		},
+var httpGet = getURL
+
+// getURL issues a GET request for url with the header of opts added to
+// it, using the transport of opts if set, or else a transport from
+// httpTransport. Sources on a Unix domain socket are requested over a
+// connection to the socket, which is refused if opts checks addresses
+// since they cannot be checked, as are requests through a custom
+// transport. The token of opts is not used; see withAuthToken. The
+// request, including reading the response body, is aborted if ctx is
+// cancelled or once the request timeout from requestTimeouts expires.
+func getURL(ctx context.Context, source string, timeout time.Duration, opts httpOptions) (*http.Response, error) {
+	socket, source := splitUnixSocket(source)
+	if socket != "" && opts.checkAddr != nil {
+		return nil, &addrDeniedError{host: socket, err: errors.New("cannot check Unix domain sockets")}
+	}
+	if socket != "" {
+		// Sockets are dialed by the built-in transport.
+		opts.transport = nil
+	}
+	if opts.transport != nil && opts.checkAddr != nil {
+		host := source
+		if u, err := url.Parse(source); err == nil {
+			host = u.Hostname()
+		}
+		return nil, &addrDeniedError{host: host, err: errors.New("cannot check the connections of a custom transport")}
+	}
+	cancel := func() {}
+	if t := requestTimeouts(timeout); t.request > 0 {
+		ctx, cancel = context.WithTimeout(ctx, t.request)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", source, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	for k, v := range opts.header {
+		req.Header[k] = v
+	}
+	// Credentials in the URL are sent as basic auth, unless header
+	// already authorizes the request.
+	if user := req.URL.User; user != nil {
+		req.URL.User = nil
+		if req.Header.Get("Authorization") == "" {
+			password, _ := user.Password()
+			req.SetBasicAuth(user.Username(), password)
+		}
+	}
+	client := httpClient(timeout, opts)
+	if socket != "" {
+		transport := client.Transport.(*http.Transport)
+		transport.Proxy = nil
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			d := net.Dialer{Timeout: requestTimeouts(timeout).dial}
+			return d.DialContext(ctx, "unix", socket)
+		}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelBody{resp.Body, cancel}
+	return resp, nil
+}
+
+// cancelBody is a response body releasing the context of its request
+// when closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// The timeouts to connect to HTTP servers, and the time allowed to
+// servers to start responding after the timeout of a request, as
+// profile handlers only respond once the profile is collected. They are
+// variables so that tests can shorten them.
+var (
+	httpDialTimeout         = 30 * time.Second
+	httpTLSHandshakeTimeout = 10 * time.Second
+	httpResponseSlack       = 5 * time.Second
+)
+
+// httpTimeouts are the timeouts of the phases of an HTTP request.
+type httpTimeouts struct {
+	dial, tlsHandshake, responseHeader, request time.Duration
+}
+
+// requestTimeouts returns the timeouts of an HTTP request with the
+// given timeout. Connecting takes at most httpDialTimeout and
+// httpTLSHandshakeTimeout, or the timeout if shorter. The response
+// headers are due by the timeout plus httpResponseSlack, and the whole
+// request, including reading the body, is aborted after the timeout
+// more, so that a body trickling in cannot hold the request forever.
+// A timeout of 0 or less leaves the response and request unbounded.
+func requestTimeouts(timeout time.Duration) httpTimeouts {
+	t := httpTimeouts{dial: httpDialTimeout, tlsHandshake: httpTLSHandshakeTimeout}
+	if timeout <= 0 {
+		return t
+	}
+	if timeout < t.dial {
+		t.dial = timeout
+	}
+	if timeout < t.tlsHandshake {
+		t.tlsHandshake = timeout
+	}
+	t.responseHeader = timeout + httpResponseSlack
+	t.request = t.responseHeader + timeout
+	return t
+}
+
+// httpClient returns a client using the transport of opts if set, or
+// else a transport from httpTransport, which follows redirects as
+// allowed by checkRedirect.
+func httpClient(timeout time.Duration, opts httpOptions) *http.Client {
+	transport := opts.transport
+	if transport == nil {
+		transport = httpTransport(timeout, opts)
+	}
+	return &http.Client{
+		Transport:     transport,
+		CheckRedirect: checkRedirect,
+	}
+}
+
+// maxRedirects is the maximum number of redirects followed to fetch a
+// profile.
+const maxRedirects = 5
+
+// redirectError is the error for a redirect refused by checkRedirect.
+type redirectError struct {
+	msg string
+}
+
+func (e *redirectError) Error() string {
+	return e.msg
+}
+
+// checkRedirect refuses redirects from https to another scheme, which
+// would send requests meant for a secure endpoint, and any credentials
+// in their headers, in the clear. It also limits the number of
+// redirects to maxRedirects.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return &redirectError{fmt.Sprintf("stopped after %d redirects", maxRedirects)}
+	}
+	if prev := via[len(via)-1].URL; prev.Scheme == "https" && req.URL.Scheme != "https" {
+		return &redirectError{fmt.Sprintf("refusing redirect from https://%s to insecure %s://%s", prev.Host, req.URL.Scheme, req.URL.Host)}
+	}
+	return nil
+}
+
+// httpTransport returns a transport going through the proxy of opts
+// if set, or else through the proxy configured in the environment. If
+// opts checks addresses, it refuses the connections opts.checkAddr
+// returns an error for, and the requests that would go through a proxy, since
+// only the proxy could be checked and not the host behind it. Its
+// timeouts are set by requestTimeouts for timeout. The TLS
+// configuration of opts, if set, configures the client certificates
+// and CAs for https. HTTP/2 is negotiated over https even with a
+// custom TLS configuration or dialer, which would otherwise disable
+// it, for servers that only accept HTTP/2; GODEBUG=http2client=0
+// disables it.
+func httpTransport(timeout time.Duration, opts httpOptions) *http.Transport {
+	t := requestTimeouts(timeout)
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: t.dial, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   t.tlsHandshake,
+		ResponseHeaderTimeout: t.responseHeader,
+		TLSClientConfig:       opts.tlsConfig,
+		ForceAttemptHTTP2:     true,
+	}
+	if opts.proxy != nil {
+		transport.Proxy = http.ProxyURL(opts.proxy)
+	}
+	if opts.checkAddr != nil {
+		transport.DialContext = checkedDial(opts.checkAddr, t.dial)
+		transport.Proxy = refuseProxy(transport.Proxy)
+	}
+	return transport
+}
+
+// refuseProxy returns a proxy function returning an addrDeniedError
+// for the requests proxy would send through a proxy, and no proxy for
+// the others.
+func refuseProxy(proxy func(*http.Request) (*url.URL, error)) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		u, err := proxy(req)
+		if err != nil {
+			return nil, err
+		}
+		if u != nil {
+			return nil, &addrDeniedError{host: req.URL.Hostname(), err: fmt.Errorf("cannot check the connections of proxy %s", u.Host)}
+		}
+		return nil, nil
+	}
+}
+
+// addrCheck returns an error if connections to ip, which host resolved
+// to, are not allowed.
+type addrCheck func(host string, ip net.IP) error
+
+// addrDeniedError is the error for a connection refused by an addrCheck.
+type addrDeniedError struct {
+	host string
+	ip   net.IP
+	err  error
+}
+
+func (e *addrDeniedError) Error() string {
+	if e.ip == nil {
+		return fmt.Sprintf("fetching from %s is not allowed: %v", e.host, e.err)
+	}
+	return fmt.Sprintf("fetching from %s (%s) is not allowed: %v", e.host, e.ip, e.err)
+}
+
+// checkedDial returns a dial function refusing the connections that
+// checkAddr returns an error for, and giving up after timeout. The
+// address is checked when the connection is made, after name
+// resolution, so that a host cannot resolve to a different address
+// once it has been checked.
+func checkedDial(checkAddr addrCheck, timeout time.Duration) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		d := &net.Dialer{
+			Timeout:   timeout,
+			KeepAlive: 30 * time.Second,
+			Control: func(_, address string, _ syscall.RawConn) error {
+				ipAddr, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				ip := net.ParseIP(ipAddr)
+				if err := checkAddr(host, ip); err != nil {
+					return &addrDeniedError{host, ip, err}
+				}
+				return nil
+			},
+		}
+		return d.DialContext(ctx, network, addr)
+	}
+}
+
+// parseHTTPHeader parses a list of newline separated header fields of
+// the form "Name: value", as found in PPROF_HTTP_HEADERS. Values are
+// never included in the error, as they may hold credentials.
+func parseHTTPHeader(s string) (http.Header, error) {
+	header := http.Header{}
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		colon := strings.Index(line, ":")
+		if colon <= 0 {
+			return nil, fmt.Errorf("malformed HTTP header: want Name: value")
+		}
+		header.Add(strings.TrimSpace(line[:colon]), strings.TrimSpace(line[colon+1:]))
+	}
+	return header, nil
+}
+
+// loadTLSConfig returns the TLS configuration for fetching profiles
+// over https with the client certificate and key in the PEM files
+// certFile and keyFile, if set, and verifying servers with the CAs in
+// the PEM file caFile, if set, instead of the system CAs. It returns
+// nil if none are set.
+func loadTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" && caFile == "" {
+		return nil, nil
+	}
+	config := &tls.Config{}
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("PPROF_TLS_CERT and PPROF_TLS_KEY must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading CAs: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("loading CAs: no certificates found in %s", caFile)
+		}
+		config.RootCAs = pool
 	}
-	return client.Get(url)
+	return config, nil
 }
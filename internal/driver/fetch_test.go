@@ -15,14 +15,40 @@
 package driver
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
+	"os/exec"
+	"path"
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -35,6 +61,8 @@ func TestSymbolizationPath(t *testing.T) {
 	// Save environment variables to restore after test
 	saveHome := os.Getenv("HOME")
 	savePath := os.Getenv("PPROF_BINARY_PATH")
+	saveDebuginfod := os.Getenv("DEBUGINFOD_URLS")
+	os.Setenv("DEBUGINFOD_URLS", "")
 
 	tempdir, err := ioutil.TempDir("", "home")
 	if err != nil {
@@ -68,13 +96,231 @@ func TestSymbolizationPath(t *testing.T) {
 			},
 		}
 		s := &source{}
-		locateBinaries(p, s, obj, &proftest.TestUI{t, tc.msgCount})
+		locateBinaries(p, s, "", binarySearchPath(), obj, &proftest.TestUI{t, tc.msgCount})
 		if file := p.Mapping[0].File; file != tc.want {
 			t.Errorf("%s:%s:%s, want %s, got %s", tc.env, tc.file, tc.buildID, tc.want, file)
 		}
 	}
 	os.Setenv("HOME", saveHome)
 	os.Setenv("PPROF_BINARY_PATH", savePath)
+	os.Setenv("DEBUGINFOD_URLS", saveDebuginfod)
+}
+
+func TestSourceBinaryPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pprof-binaries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// The main program and its sidecar are both deployed as "server",
+	// without build ids.
+	for _, d := range []string{"main", "sidecar", "global"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, d := range []string{"main", "sidecar"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, d, "server"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer os.Setenv("PPROF_BINARY_PATH", os.Getenv("PPROF_BINARY_PATH"))
+	os.Setenv("PPROF_BINARY_PATH", filepath.Join(dir, "global"))
+
+	str := func(s string) *string { return &s }
+	paths, err := parseSourceBinaryPaths([]*string{
+		str("http://main:8080/profile?debug=1=" + filepath.Join(dir, "main")),
+		str("http://sidecar:9090/profile=" + filepath.Join(dir, "sidecar")),
+	})
+	if err != nil {
+		t.Fatalf("parseSourceBinaryPaths: %v", err)
+	}
+	s := &source{SourceBinaryPaths: paths}
+	for _, tc := range []struct {
+		source, want string
+	}{
+		{"http://main:8080/profile?debug=1", filepath.Join(dir, "main", "server")},
+		{"http://sidecar:9090/profile", filepath.Join(dir, "sidecar", "server")},
+		{"http://other:8080/profile", "/srv/server"},
+	} {
+		p := &profile.Profile{Mapping: []*profile.Mapping{{File: "/srv/server"}}}
+		locateBinaries(p, s, tc.source, binarySearchPath(), debugObj{}, &proftest.TestUI{T: t})
+		if got := p.Mapping[0].File; got != tc.want {
+			t.Errorf("%s: got binary %s, want %s", tc.source, got, tc.want)
+		}
+	}
+
+	for _, bad := range []string{"no-path", "=" + dir, "http://main:8080/profile="} {
+		if _, err := parseSourceBinaryPaths([]*string{str(bad)}); err == nil {
+			t.Errorf("parseSourceBinaryPaths(%q): want error", bad)
+		}
+	}
+}
+
+func TestLocateStaleBinaries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pprof-binaries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// debugObj reads the build id of each file from its contents.
+	files := map[string]string{
+		"stale/abcde10007/binary": "abcde10006",
+		"stale/abcde10007/other":  "abcde10005",
+		"unknown/binary":          "",
+		"exact/binary":            "abcde10007",
+	}
+	for name, buildID := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(buildID), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, env := range []string{"PPROF_BINARY_PATH", "PPROF_SYMBOL_SERVER", "DEBUGINFOD_URLS"} {
+		defer os.Setenv(env, os.Getenv(env))
+	}
+	os.Setenv("PPROF_SYMBOL_SERVER", "")
+	os.Setenv("DEBUGINFOD_URLS", "")
+
+	join := func(dirs ...string) string {
+		for i, d := range dirs {
+			dirs[i] = filepath.Join(dir, d)
+		}
+		return strings.Join(dirs, string(filepath.ListSeparator))
+	}
+	for _, tc := range []struct {
+		path, want string
+	}{
+		// The stale files are skipped, and the exact match is preferred
+		// over the file with an unknown build id found before it.
+		{join("stale", "unknown", "exact"), "exact/binary"},
+		{join("stale", "unknown"), "unknown/binary"},
+		{join("stale"), ""},
+	} {
+		os.Setenv("PPROF_BINARY_PATH", tc.path)
+		p := &profile.Profile{
+			Mapping: []*profile.Mapping{{File: "/usr/bin/binary", BuildID: "abcde10007"}},
+		}
+		// Only the first stale file is reported.
+		locateBinaries(p, &source{}, "", binarySearchPath(), debugObj{}, &proftest.TestUI{T: t, Ignore: 1})
+		want := "/usr/bin/binary"
+		if tc.want != "" {
+			want = filepath.Join(dir, tc.want)
+		}
+		if got := p.Mapping[0].File; got != want {
+			t.Errorf("%s: got file %s, want %s", tc.path, got, want)
+		}
+	}
+}
+
+func TestRemoteBinaries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pprof-binaries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// debugObj reads the build id of each file from its contents.
+	local, cache := filepath.Join(dir, "local"), filepath.Join(dir, "cache")
+	files := map[string]string{
+		filepath.Join(local, "binary"):                  "abcde10007",
+		filepath.Join(local, "lib.so"):                  "",
+		filepath.Join(cache, "abcde10007", "debuginfo"): "abcde10007",
+	}
+	for path, buildID := range files {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(buildID), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, env := range []string{"PPROF_BINARY_PATH", "PPROF_SYMBOL_SERVER", "DEBUGINFOD_URLS", "DEBUGINFOD_CACHE_PATH"} {
+		defer os.Setenv(env, os.Getenv(env))
+	}
+	os.Setenv("PPROF_BINARY_PATH", local)
+	os.Setenv("PPROF_SYMBOL_SERVER", "")
+	os.Setenv("DEBUGINFOD_URLS", "http://debuginfod.example")
+	os.Setenv("DEBUGINFOD_CACHE_PATH", cache)
+
+	for _, remote := range []bool{false, true} {
+		p := &profile.Profile{
+			Mapping: []*profile.Mapping{
+				{File: "/usr/bin/binary", BuildID: "abcde10007"},
+				{File: "/usr/lib/lib.so"},
+			},
+		}
+		obj := &openRecorder{}
+		locateBinaries(p, &source{RemoteBinaries: remote}, "", binarySearchPath(), obj, &proftest.TestUI{T: t, Ignore: 1})
+		want := []string{filepath.Join(local, "binary"), filepath.Join(local, "lib.so")}
+		if remote {
+			want[0] = filepath.Join(cache, "abcde10007", "debuginfo")
+		}
+		for i, m := range p.Mapping {
+			if m.File != want[i] {
+				t.Errorf("RemoteBinaries=%v: got file %s, want %s", remote, m.File, want[i])
+			}
+		}
+		for _, name := range obj.opened {
+			if remote && name == filepath.Join(local, "binary") {
+				t.Errorf("RemoteBinaries=%v: opened local file %s for a mapping with a build id", remote, name)
+			}
+		}
+	}
+}
+
+// openRecorder is a debugObj recording the files it opens.
+type openRecorder struct {
+	debugObj
+	opened []string
+}
+
+func (o *openRecorder) Open(file string, start, limit, offset uint64) (plugin.ObjFile, error) {
+	o.opened = append(o.opened, file)
+	return o.debugObj.Open(file, start, limit, offset)
+}
+
+func TestMappingSourceURLs(t *testing.T) {
+	const (
+		host1 = "http://host1:8080/debug/pprof/profile"
+		host2 = "http://host2:8080/debug/pprof/profile"
+		host3 = "http://host3:8080/debug/pprof/profile"
+	)
+	var profiles []*profile.Profile
+	var msrcs []plugin.MappingSources
+	for _, src := range []struct{ url, file, buildID string }{
+		{host2, "/bin/server", "abcde10001"},
+		{host1, "/bin/server", "abcde10001"},
+		{host2, "/bin/server", "abcde10001"},
+		{host3, "/bin/other", "abcde10002"},
+	} {
+		p := cpuProfile()
+		p.Mapping[0].File, p.Mapping[0].BuildID = src.file, src.buildID
+		profiles = append(profiles, p)
+		msrcs = append(msrcs, collectMappingSources(p, src.url, httpValidators{}, false))
+	}
+	p, msrc, err := combineProfiles(profiles, nil, msrcs, nil, nil)
+	if err != nil {
+		t.Fatalf("combineProfiles: %v", err)
+	}
+	got := make(map[string][]string)
+	for _, m := range p.Mapping {
+		if m.BuildID != "" {
+			got[m.BuildID] = mappingSourceURLs(msrc, m)
+		}
+	}
+	want := map[string][]string{
+		"abcde10001": {host1, host2},
+		"abcde10002": {host3},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got sources %v, want %v", got, want)
+	}
 }
 
 func TestCollectMappingSources(t *testing.T) {
@@ -97,19 +343,207 @@ func TestCollectMappingSources(t *testing.T) {
 				},
 			},
 		}
-		got := collectMappingSources(p, url)
+		got := collectMappingSources(p, url, httpValidators{}, false)
 		if !reflect.DeepEqual(got, tc.want) {
 			t.Errorf("%s:%s, want %s, got %s", tc.file, tc.buildID, tc.want, got)
 		}
 	}
 }
 
+func TestMappingSourcesValidators(t *testing.T) {
+	savedHTTPGet := httpGet
+	defer func() { httpGet = savedHTTPGet }()
+	httpGet = getURL
+
+	data, err := ioutil.ReadFile("testdata/cppbench.cpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const lastModified = "Mon, 02 Jan 2006 15:04:05 GMT"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", lastModified)
+		w.Write(data)
+	}))
+	defer ts.Close()
+
+	s := &source{Seconds: -1, Timeout: -1, MaxDecompressedSize: defaultMaxDecompressedSize, NoSave: true}
+	_, msrc, _, err := grabProfile(context.Background(), s, ts.URL+"/profile", 1, nil, testObj{}, &proftest.TestUI{T: t})
+	if err != nil {
+		t.Fatalf("grabProfile: %v", err)
+	}
+	if len(msrc) == 0 {
+		t.Fatalf("got no mapping sources")
+	}
+	for key, srcs := range msrc {
+		for _, src := range srcs {
+			if src.ETag != `"v1"` || src.LastModified != lastModified {
+				t.Errorf("%s: got ETag %s, Last-Modified %q, want %s and %q", key, src.ETag, src.LastModified, `"v1"`, lastModified)
+			}
+		}
+	}
+}
+
+func TestURLBasicAuth(t *testing.T) {
+	savedHTTPGet := httpGet
+	defer func() { httpGet = savedHTTPGet }()
+	httpGet = getURL
+
+	data, err := ioutil.ReadFile("testdata/cppbench.cpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "user" || password != "s3cret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Write(data)
+	}))
+	defer ts.Close()
+
+	s := &source{Seconds: -1, Timeout: -1, MaxDecompressedSize: defaultMaxDecompressedSize, NoSave: true}
+	source := strings.Replace(ts.URL, "http://", "http://user:s3cret@", 1) + "/profile"
+	_, msrc, _, err := grabProfile(context.Background(), s, source, 1, nil, testObj{}, &proftest.TestUI{T: t})
+	if err != nil {
+		t.Fatalf("grabProfile: %v", err)
+	}
+	if len(msrc) == 0 {
+		t.Fatalf("got no mapping sources")
+	}
+	for key, srcs := range msrc {
+		for _, src := range srcs {
+			if want := ts.URL + "/profile"; src.Source != want {
+				t.Errorf("%s: got mapping source %s, want %s", key, src.Source, want)
+			}
+		}
+	}
+
+	// Wrong credentials are refused, and not shown in the error.
+	source = strings.Replace(source, "s3cret", "wrong", 1)
+	if _, _, _, err := grabProfile(context.Background(), s, source, 1, nil, testObj{}, &proftest.TestUI{T: t}); err == nil || strings.Contains(err.Error(), "wrong") {
+		t.Errorf("grabProfile: got error %v, want one without the credentials", err)
+	}
+}
+
+func TestHTTPTransport(t *testing.T) {
+	savedHTTPGet := httpGet
+	defer func() { httpGet = savedHTTPGet }()
+	httpGet = getURL
+
+	data, err := ioutil.ReadFile("testdata/cppbench.cpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := &cannedTransport{body: data}
+	o := &plugin.Options{
+		Obj:           testObj{},
+		Sym:           testSymbolizer{},
+		UI:            &proftest.TestUI{T: t},
+		NoSave:        true,
+		HTTPHeader:    http.Header{"X-Mesh-Auth": []string{"sidecar"}},
+		HTTPTransport: transport,
+	}
+	p, err := FetchProfiles(context.Background(), []string{"http://mesh-host:8080/debug/pprof/profile?seconds=1"}, o)
+	if err != nil {
+		t.Fatalf("FetchProfiles: %v", err)
+	}
+	if len(p.Sample) == 0 {
+		t.Errorf("FetchProfiles: want non-zero samples")
+	}
+	if len(transport.reqs) != 1 {
+		t.Fatalf("got %d requests through the transport, want 1", len(transport.reqs))
+	}
+	if req := transport.reqs[0]; req.URL.Host != "mesh-host:8080" || req.Header.Get("X-Mesh-Auth") != "sidecar" {
+		t.Errorf("got request for %s with header %v, want mesh-host:8080 with X-Mesh-Auth", req.URL, req.Header)
+	}
+
+	// Connections made by the transport cannot be checked.
+	checkAddr := func(host string, ip net.IP) error { return nil }
+	if _, err := getURL(context.Background(), "http://mesh-host:8080/profile", time.Second, httpOptions{checkAddr: checkAddr, transport: transport}); err == nil {
+		t.Errorf("getURL with a custom transport and an address check: want error")
+	}
+}
+
+// cannedTransport is an http.RoundTripper recording the requests it
+// gets, and responding to them with body.
+type cannedTransport struct {
+	body []byte
+	reqs []*http.Request
+}
+
+func (t *cannedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.reqs = append(t.reqs, req)
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(bytes.NewReader(t.body)),
+		Request:    req,
+	}, nil
+}
+
+func TestMappingSourcesByRange(t *testing.T) {
+	// Two different binaries without build id, installed at the same
+	// path on two hosts.
+	sources := []struct {
+		url          string
+		start, limit uint64
+	}{
+		{"http://host1/profile", 0x400000, 0x500000},
+		{"http://host2/profile", 0x400000, 0x680000},
+	}
+	for _, byRange := range []bool{false, true} {
+		var profiles []*profile.Profile
+		var msrcs []plugin.MappingSources
+		for _, src := range sources {
+			m := &profile.Mapping{ID: 1, File: "/usr/bin/server", Start: src.start, Limit: src.limit}
+			l := &profile.Location{ID: 1, Mapping: m, Address: src.start + 0x10}
+			p := &profile.Profile{
+				SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}},
+				PeriodType: &profile.ValueType{Type: "cpu", Unit: "nanoseconds"},
+				Sample:     []*profile.Sample{{Location: []*profile.Location{l}, Value: []int64{1}}},
+				Location:   []*profile.Location{l},
+				Mapping:    []*profile.Mapping{m},
+			}
+			profiles = append(profiles, p)
+			msrcs = append(msrcs, collectMappingSources(p, src.url, httpValidators{}, byRange))
+		}
+		p, msrc, err := combineProfiles(profiles, nil, msrcs, nil, nil)
+		if err != nil {
+			t.Fatalf("combineProfiles: %v", err)
+		}
+		if len(p.Mapping) != len(sources) {
+			t.Fatalf("got %d mappings, want %d", len(p.Mapping), len(sources))
+		}
+		if !byRange {
+			if got := len(msrc["/usr/bin/server"]); got != len(sources) {
+				t.Errorf("byRange=false: got %d sources for the file, want %d", got, len(sources))
+			}
+			continue
+		}
+		for i, m := range p.Mapping {
+			got := msrc[plugin.MappingRangeKey(m)]
+			if len(got) != 1 || got[0].Source != sources[i].url {
+				t.Errorf("byRange=true: mapping %d got sources %v, want only %s", i, got, sources[i].url)
+			}
+		}
+		if _, ok := msrc["/usr/bin/server"]; ok {
+			t.Errorf("byRange=true: unexpected sources keyed by file")
+		}
+	}
+}
+
 func TestUnsourceMappings(t *testing.T) {
 	for _, tc := range []struct {
-		file, buildID, want string
+		file, buildID string
+		keep          bool
+		want          string
 	}{
-		{"/usr/bin/binary", "buildId", "/usr/bin/binary"},
-		{"http://example.com", "", ""},
+		{"/usr/bin/binary", "buildId", false, "/usr/bin/binary"},
+		{"http://example.com", "", false, ""},
+		{"/usr/bin/binary", "buildId", true, "/usr/bin/binary"},
+		{"http://example.com", "", true, "http://example.com"},
 	} {
 		p := &profile.Profile{
 			Mapping: []*profile.Mapping{
@@ -119,9 +553,9 @@ func TestUnsourceMappings(t *testing.T) {
 				},
 			},
 		}
-		unsourceMappings(p)
+		unsourceMappings(p, tc.keep)
 		if got := p.Mapping[0].File; got != tc.want {
-			t.Errorf("%s:%s, want %s, got %s", tc.file, tc.buildID, tc.want, got)
+			t.Errorf("%s:%s keep=%v, want %s, got %s", tc.file, tc.buildID, tc.keep, tc.want, got)
 		}
 	}
 }
@@ -161,11 +595,13 @@ func TestFetch(t *testing.T) {
 	// Intercept http.Get calls from HTTPFetcher.
 	httpGet = stubHTTPGet
 
+	s := &source{}
 	for _, source := range [][2]string{
 		{path + "go.crc32.cpu", "go.crc32.cpu"},
+		{path + "go.crc32.cpu.gz.gz", "go.crc32.cpu"},
 		{"http://localhost/profile?file=cppbench.cpu", "cppbench.cpu"},
 	} {
-		p, _, err := fetch(source[0], 0, 10*time.Second, &proftest.TestUI{t, 0})
+		p, _, _, err := fetch(context.Background(), source[0], 0, 10*time.Second, s, &proftest.TestUI{t, 0})
 		if err != nil {
 			t.Fatalf("%s: %s", source[0], err)
 		}
@@ -175,13 +611,3676 @@ func TestFetch(t *testing.T) {
 	}
 }
 
-// mappingSources creates MappingSources map with a single item.
-func mappingSources(key, source string, start uint64) plugin.MappingSources {
-	return plugin.MappingSources{
-		key: []struct {
-			Source string
-			Start  uint64
-		}{
+func TestChunkedGrab(t *testing.T) {
+	// Use enough sources to span several chunks, with one failure.
+	const n = 150
+	s := &source{}
+	var sources []profileSource
+	for i := 0; i < n; i++ {
+		addr := "cpu"
+		if i == 100 {
+			addr = "bad"
+		}
+		sources = append(sources, profileSource{addr: addr, source: s, scale: 1})
+	}
+
+	p, _, _, count, err := chunkedGrab(context.Background(), sources, 0, testFetcher{}, testObj{}, &proftest.TestUI{T: t, Ignore: 1})
+	if err != nil {
+		t.Fatalf("chunkedGrab: %v", err)
+	}
+	if want := n - 1; count != want {
+		t.Errorf("chunkedGrab fetched %d profiles, want %d", count, want)
+	}
+
+	var got, want int64
+	for _, s := range p.Sample {
+		got += s.Value[0]
+	}
+	for _, s := range cpuProfile().Sample {
+		want += s.Value[0] * (n - 1)
+	}
+	if got != want {
+		t.Errorf("chunkedGrab merged total %d, want %d", got, want)
+	}
+}
+
+func TestChunkedSymbolization(t *testing.T) {
+	// The profiles have the same mappings, so that every chunk merges
+	// into the same build IDs.
+	var sources []string
+	for i := 0; i < 150; i++ {
+		sources = append(sources, "cpu")
+	}
+	sym := &countingSymbolizer{}
+	o := setDefaults(&plugin.Options{
+		Fetch: testFetcher{},
+		Obj:   testObj{},
+		Sym:   sym,
+		UI:    &proftest.TestUI{T: t},
+	})
+	s := &source{Sources: sources, FetchConcurrency: 16, NoSave: true}
+	if _, err := fetchProfiles(context.Background(), s, o); err != nil {
+		t.Fatalf("fetchProfiles: %v", err)
+	}
+	// Each mapping is symbolized once, after all chunks are merged.
+	if want := []int{len(cpuProfile().Mapping)}; !reflect.DeepEqual(sym.mappings, want) {
+		t.Errorf("got Symbolize calls for %v mappings, want %v", sym.mappings, want)
+	}
+}
+
+func BenchmarkFetchProfiles(b *testing.B) {
+	var sources []string
+	for i := 0; i < 1000; i++ {
+		sources = append(sources, "cpu")
+	}
+	o := setDefaults(&plugin.Options{
+		Fetch: testFetcher{},
+		Obj:   testObj{},
+		Sym:   testSymbolizer{},
+		UI:    &proftest.TestUI{},
+	})
+	s := &source{Sources: sources, NoSave: true}
+	for i := 0; i < b.N; i++ {
+		if _, err := fetchProfiles(context.Background(), s, o); err != nil {
+			b.Fatalf("fetchProfiles: %v", err)
+		}
+	}
+}
+
+// countingSymbolizer records the number of mappings of each profile
+// it is asked to symbolize.
+type countingSymbolizer struct {
+	mappings []int
+}
+
+func (s *countingSymbolizer) Symbolize(_ string, _ plugin.MappingSources, p *profile.Profile) error {
+	s.mappings = append(s.mappings, len(p.Mapping))
+	return nil
+}
+
+func TestSymbolizeFilter(t *testing.T) {
+	p := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}},
+		Mapping: []*profile.Mapping{
+			{ID: 1, Start: 0x1000, Limit: 0x2000, File: "/bin/server", BuildID: "abcd"},
+			{ID: 2, Start: 0x3000, Limit: 0x4000, File: "/lib/libc.so", BuildID: "ef01"},
+		},
+	}
+	p.Location = []*profile.Location{
+		{ID: 1, Mapping: p.Mapping[0], Address: 0x1100},
+		{ID: 2, Mapping: p.Mapping[1], Address: 0x3100},
+	}
+	p.Sample = []*profile.Sample{{Location: p.Location, Value: []int64{1}}}
+	var buf bytes.Buffer
+	if err := p.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		filter string
+		want   []string
+	}{
+		{"", []string{"/bin/server", "/lib/libc.so"}},
+		{"server", []string{"/bin/server"}},
+		{"^ef01$", []string{"/lib/libc.so"}},
+		{"nomatch", nil},
+	} {
+		s := &source{Sources: []string{"mem"}, ProfileData: map[string][]byte{"mem": buf.Bytes()}, NoSave: true}
+		if tc.filter != "" {
+			s.SymbolizeFilter = regexp.MustCompile(tc.filter)
+		}
+		o := setDefaults(&plugin.Options{Fetch: testFetcher{}, Sym: mappingSymbolizer{}, UI: &proftest.TestUI{T: t}})
+		got, err := fetchProfiles(context.Background(), s, o)
+		if err != nil {
+			t.Fatalf("%q: fetchProfiles: %v", tc.filter, err)
+		}
+		var symbolized []string
+		for _, l := range got.Location {
+			if len(l.Line) > 0 {
+				symbolized = append(symbolized, l.Line[0].Function.Name)
+			}
+		}
+		if !reflect.DeepEqual(symbolized, tc.want) {
+			t.Errorf("%q: got symbolized mappings %v, want %v", tc.filter, symbolized, tc.want)
+		}
+		if err := got.CheckValid(); err != nil {
+			t.Errorf("%q: %v", tc.filter, err)
+		}
+	}
+}
+
+// mappingSymbolizer symbolizes each location to a function named
+// after the file of its mapping.
+type mappingSymbolizer struct{}
+
+func (mappingSymbolizer) Symbolize(_ string, _ plugin.MappingSources, p *profile.Profile) error {
+	for _, l := range p.Location {
+		f := &profile.Function{ID: uint64(len(p.Function) + 1), Name: l.Mapping.File}
+		p.Function = append(p.Function, f)
+		l.Line = []profile.Line{{Function: f}}
+	}
+	return nil
+}
+
+func TestPrecheckURL(t *testing.T) {
+	for _, tc := range []struct {
+		check, source, want string
+	}{
+		{"/healthz", "http://host:8080/debug/pprof/profile", "http://host:8080/healthz"},
+		{"/healthz", "host:8080", "http://host:8080/healthz"},
+		{"healthz", "https://host/debug/pprof/heap", "https://host/debug/pprof/healthz"},
+		{"http://lb/status?h=1", "http://host/debug/pprof/heap", "http://lb/status?h=1"},
+		{"/healthz", "testdata/cppbench.cpu", ""},
+	} {
+		if got := precheckURL(tc.check, tc.source); got != tc.want {
+			t.Errorf("precheckURL(%q, %q) = %q, want %q", tc.check, tc.source, got, tc.want)
+		}
+	}
+}
+
+func TestPrecheck(t *testing.T) {
+	savedHTTPGet := httpGet
+	defer func() { httpGet = savedHTTPGet }()
+	httpGet = func(_ context.Context, source string, _ time.Duration, _ httpOptions) (*http.Response, error) {
+		u, err := url.Parse(source)
+		if err != nil {
+			return nil, err
+		}
+		if u.Host == "down" {
+			return nil, fmt.Errorf("connection refused")
+		}
+		status := http.StatusOK
+		if u.Host == "busy" {
+			status = http.StatusServiceUnavailable
+		}
+		return &http.Response{StatusCode: status, Status: http.StatusText(status), Body: http.NoBody}, nil
+	}
+
+	for _, tc := range []struct {
+		source string
+		skip   bool
+	}{
+		{"http://ok/debug/pprof/profile", false},
+		{"http://busy/debug/pprof/profile", true},
+		{"http://down/debug/pprof/profile", true},
+		{"testdata/cppbench.cpu", false},
+	} {
+		err := precheck(context.Background(), "/healthz", tc.source, httpOptions{})
+		if _, skip := err.(*skippedError); skip != tc.skip || (err != nil && !skip) {
+			t.Errorf("precheck(%q, nil): got error %v, want skip=%v", tc.source, err, tc.skip)
+		}
+	}
+
+	sources := []profileSource{
+		{addr: "http://ok/debug/pprof/profile"},
+		{addr: "http://busy/debug/pprof/profile", err: precheck(context.Background(), "/healthz", "http://busy/", httpOptions{})},
+		{addr: "bad", err: fmt.Errorf("unrecognized profile format")},
+	}
+	if got, want := countSkipped(sources), 1; got != want {
+		t.Errorf("countSkipped() = %d, want %d", got, want)
+	}
+}
+
+func TestFetchURLRetries(t *testing.T) {
+	savedHTTPGet, savedDelay := httpGet, retryBaseDelay
+	defer func() { httpGet, retryBaseDelay = savedHTTPGet, savedDelay }()
+	retryBaseDelay = time.Millisecond
+
+	for _, tc := range []struct {
+		desc      string
+		responses []int // 0 stands for a connection error.
+		retries   int
+		timeout   time.Duration
+		wantCalls int
+		wantErr   bool
+	}{
+		{"success", []int{200}, 2, time.Second, 1, false},
+		{"5xx then success", []int{503, 500, 200}, 2, time.Second, 3, false},
+		{"connection error then success", []int{0, 200}, 2, time.Second, 2, false},
+		{"retries exhausted", []int{503, 503, 503, 200}, 2, time.Second, 3, true},
+		{"4xx not retried", []int{404, 200}, 2, time.Second, 1, true},
+		{"retries disabled", []int{503, 200}, 0, time.Second, 1, true},
+		{"timeout exhausted", []int{503, 200}, 2, time.Microsecond, 1, true},
+	} {
+		var calls int
+		httpGet = func(_ context.Context, source string, _ time.Duration, _ httpOptions) (*http.Response, error) {
+			status := tc.responses[calls]
+			calls++
+			if status == 0 {
+				return nil, fmt.Errorf("connection reset by peer")
+			}
+			return &http.Response{StatusCode: status, Status: http.StatusText(status), Body: http.NoBody}, nil
+		}
+		body, _, err := fetchURL(context.Background(), "http://host/profile", tc.timeout, tc.retries, 0, httpOptions{})
+		if gotErr := err != nil; gotErr != tc.wantErr {
+			t.Errorf("%s: got error %v, want error %v", tc.desc, err, tc.wantErr)
+		}
+		if err == nil {
+			body.Close()
+		}
+		if calls != tc.wantCalls {
+			t.Errorf("%s: got %d requests, want %d", tc.desc, calls, tc.wantCalls)
+		}
+	}
+}
+
+func TestFetchURLContentEncoding(t *testing.T) {
+	savedHTTPGet := httpGet
+	defer func() { httpGet = savedHTTPGet }()
+	httpGet = getURL
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file := "testdata/go.crc32.cpu"
+		encoding := r.URL.Query().Get("encoding")
+		if encoding == "zstd" {
+			file += ".zst"
+		}
+		w.Header().Set("Content-Encoding", encoding)
+		http.ServeFile(w, r, file)
+	}))
+	defer ts.Close()
+
+	for _, tc := range []struct {
+		encoding string
+		wantErr  string
+	}{
+		{"identity", ""},
+		{"zstd", ""},
+		{"br", `unsupported Content-Encoding "br"`},
+	} {
+		if _, err := exec.LookPath(zstdCommand); err != nil && tc.encoding == "zstd" {
+			t.Logf("skipping zstd: %v", err)
+			continue
+		}
+		body, _, err := fetchURL(context.Background(), ts.URL+"/profile?encoding="+tc.encoding, time.Second, 0, 0, httpOptions{})
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("%s: fetchURL(, nil) error %v, want %q", tc.encoding, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: fetchURL(, nil): %v", tc.encoding, err)
+			continue
+		}
+		p, err := profile.Parse(body)
+		body.Close()
+		if err != nil || len(p.Sample) == 0 {
+			t.Errorf("%s: got profile %v, error %v, want samples", tc.encoding, p, err)
+		}
+	}
+}
+
+func TestFetchURLAcceptEncoding(t *testing.T) {
+	savedHTTPGet, savedLookZstd := httpGet, lookZstd
+	defer func() { httpGet, lookZstd = savedHTTPGet, savedLookZstd }()
+	httpGet = getURL
+
+	var got string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("Accept-Encoding")
+		if r.URL.Query().Get("encoding") == "zstd" {
+			w.Header().Set("Content-Encoding", "zstd")
+		}
+		http.ServeFile(w, r, "testdata/go.crc32.cpu")
+	}))
+	defer ts.Close()
+
+	missing := errors.New("not found")
+	for _, tc := range []struct {
+		desc   string
+		zstd   error
+		header http.Header
+		want   string
+	}{
+		{"zstd installed", nil, nil, "zstd, gzip"},
+		{"zstd missing", missing, nil, "gzip"},
+		{"user header", nil, http.Header{"Accept-Encoding": []string{"identity"}}, "identity"},
+	} {
+		lookZstd = func() error { return tc.zstd }
+		body, _, err := fetchURL(context.Background(), ts.URL, time.Second, 0, 0, httpOptions{header: tc.header})
+		if err != nil {
+			t.Errorf("%s: fetchURL: %v", tc.desc, err)
+			continue
+		}
+		body.Close()
+		if got != tc.want {
+			t.Errorf("%s: got Accept-Encoding %q, want %q", tc.desc, got, tc.want)
+		}
+	}
+
+	// Servers sending zstd unasked fail clearly without the command.
+	lookZstd = func() error { return missing }
+	_, _, err := fetchURL(context.Background(), ts.URL+"?encoding=zstd", time.Second, 0, 0, httpOptions{})
+	if want := "zstd command is not installed"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("fetchURL of zstd without %s: got error %v, want %q", zstdCommand, err, want)
+	}
+}
+
+func TestFetchURLZstdSize(t *testing.T) {
+	if _, err := exec.LookPath(zstdCommand); err != nil {
+		t.Skipf("skipping zstd: %v", err)
+	}
+	savedHTTPGet := httpGet
+	defer func() { httpGet = savedHTTPGet }()
+	httpGet = getURL
+
+	// 64MiB of zeros compress to a few KiB, which must not be
+	// decompressed in full.
+	const size = 64 << 20
+	cmd := exec.Command(zstdCommand, "-c", "-q")
+	cmd.Stdin = io.LimitReader(zeros{}, size)
+	bomb, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("compressing with %s: %v", zstdCommand, err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "zstd")
+		w.Write(bomb)
+	}))
+	defer ts.Close()
+
+	const maxSize = 1 << 20
+	body, _, err := fetchURL(context.Background(), ts.URL, 5*time.Second, 0, maxSize, httpOptions{})
+	if err != nil {
+		t.Fatalf("fetchURL: %v", err)
+	}
+	n, err := io.Copy(ioutil.Discard, body)
+	body.Close()
+	if _, ok := err.(*profileSizeError); !ok || n > maxSize {
+		t.Errorf("got %d bytes, error %v, want at most %d bytes and a profile size error", n, err, maxSize)
+	}
+
+	// Without a limit, the stream is read in full.
+	body, _, err = fetchURL(context.Background(), ts.URL, 5*time.Second, 0, 0, httpOptions{})
+	if err != nil {
+		t.Fatalf("fetchURL: %v", err)
+	}
+	n, err = io.Copy(ioutil.Discard, body)
+	body.Close()
+	if err != nil || n != size {
+		t.Errorf("got %d bytes, error %v, want %d bytes", n, err, size)
+	}
+}
+
+// zeros is an endless stream of zero bytes.
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestFetchURLGzipSize(t *testing.T) {
+	savedHTTPGet := httpGet
+	defer func() { httpGet = savedHTTPGet }()
+	httpGet = getURL
+
+	var raw, compressed bytes.Buffer
+	if err := cpuProfile().WriteUncompressed(&raw); err != nil {
+		t.Fatal(err)
+	}
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(raw.Bytes())
+	gz.Close()
+	if compressed.Len() >= raw.Len()-1 {
+		t.Fatalf("profile of %d bytes only compresses to %d bytes", raw.Len(), compressed.Len())
+	}
+
+	// The server gzips the profile whether or not the client asks for
+	// it, with the compressed size as Content-Length.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Length", strconv.Itoa(compressed.Len()))
+		w.Write(compressed.Bytes())
+	}))
+	defer ts.Close()
+
+	for _, tr := range []struct {
+		desc      string
+		transport http.RoundTripper
+	}{
+		{"decompressing transport", nil},
+		{"raw transport", &http.Transport{DisableCompression: true}},
+	} {
+		for _, tc := range []struct {
+			maxSize int64
+			wantErr bool
+		}{
+			{0, false},
+			{int64(raw.Len()), false},
+			{int64(raw.Len()) - 1, true},
+		} {
+			body, _, err := fetchURL(context.Background(), ts.URL, time.Second, 0, tc.maxSize, httpOptions{transport: tr.transport})
+			if err != nil {
+				t.Fatalf("%s: fetchURL: %v", tr.desc, err)
+			}
+			data, err := ioutil.ReadAll(body)
+			body.Close()
+			if tc.wantErr {
+				if _, ok := err.(*profileSizeError); !ok {
+					t.Errorf("%s, max size %d: got error %v, want profile size error", tr.desc, tc.maxSize, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("%s, max size %d: %v", tr.desc, tc.maxSize, err)
+				continue
+			}
+			if len(data) != raw.Len() {
+				t.Errorf("%s, max size %d: got %d bytes, want the %d decompressed bytes", tr.desc, tc.maxSize, len(data), raw.Len())
+			}
+		}
+	}
+}
+
+func TestFetchURLPolling(t *testing.T) {
+	savedHTTPGet, savedDelay := httpGet, retryBaseDelay
+	defer func() { httpGet, retryBaseDelay = savedHTTPGet, savedDelay }()
+	httpGet, retryBaseDelay = getURL, time.Millisecond
+
+	var requests int
+	var retryAfter string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests <= 2 {
+			if retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		http.ServeFile(w, r, "testdata/cppbench.cpu")
+	}))
+	defer ts.Close()
+
+	for _, tc := range []struct {
+		desc        string
+		retryAfter  string
+		timeout     time.Duration
+		cancelAfter time.Duration
+		wantErr     string
+	}{
+		{"retry after", "0", time.Second, 0, ""},
+		{"backoff", "", time.Second, 0, ""},
+		{"not ready before timeout", "10", time.Second, 0, "not ready"},
+		{"cancelled while polling", "5", 10 * time.Second, 10 * time.Millisecond, "canceled"},
+	} {
+		requests, retryAfter = 0, tc.retryAfter
+		ctx, cancel := context.WithCancel(context.Background())
+		if tc.cancelAfter > 0 {
+			time.AfterFunc(tc.cancelAfter, cancel)
+		}
+		start := time.Now()
+		// Polls do not count as retries.
+		body, _, err := fetchURL(ctx, ts.URL, tc.timeout, 0, 0, httpOptions{})
+		cancel()
+		if time.Since(start) >= tc.timeout {
+			t.Errorf("%s: fetchURL took %v, want less than the timeout", tc.desc, time.Since(start))
+		}
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("%s: got error %v, want error containing %q", tc.desc, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: fetchURL: %v", tc.desc, err)
+		}
+		p, err := profile.Parse(body)
+		body.Close()
+		if err != nil || len(p.Sample) == 0 {
+			t.Errorf("%s: got profile error %v, want samples", tc.desc, err)
+		}
+		if requests != 3 {
+			t.Errorf("%s: got %d requests, want 3", tc.desc, requests)
+		}
+	}
+}
+
+func TestFetchURLRateLimited(t *testing.T) {
+	savedHTTPGet, savedDelay := httpGet, retryBaseDelay
+	defer func() { httpGet, retryBaseDelay = savedHTTPGet, savedDelay }()
+	httpGet, retryBaseDelay = getURL, time.Millisecond
+
+	var requests int
+	var retryAfter string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.Header().Set("Retry-After", retryAfter)
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+			return
+		}
+		http.ServeFile(w, r, "testdata/cppbench.cpu")
+	}))
+	defer ts.Close()
+
+	for _, tc := range []struct {
+		desc       string
+		retryAfter string
+		wantErr    string
+	}{
+		{"delta seconds", "0", ""},
+		{"http date", time.Now().UTC().Format(http.TimeFormat), ""},
+		{"delta seconds beyond timeout", "10", "rate limited, insufficient timeout"},
+		{"http date beyond timeout", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat), "rate limited, insufficient timeout"},
+	} {
+		requests, retryAfter = 0, tc.retryAfter
+		start := time.Now()
+		// Waiting for the server does not count as a retry.
+		body, _, err := fetchURL(context.Background(), ts.URL, time.Second, 0, 0, httpOptions{})
+		if time.Since(start) >= time.Second {
+			t.Errorf("%s: fetchURL took %v, want less than the timeout", tc.desc, time.Since(start))
+		}
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("%s: got error %v, want error containing %q", tc.desc, err, tc.wantErr)
+			}
+			if requests != 1 {
+				t.Errorf("%s: got %d requests, want 1", tc.desc, requests)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: fetchURL: %v", tc.desc, err)
+		}
+		body.Close()
+		if requests != 2 {
+			t.Errorf("%s: got %d requests, want 2", tc.desc, requests)
+		}
+	}
+}
+
+func TestPollDelay(t *testing.T) {
+	savedDelay := retryBaseDelay
+	defer func() { retryBaseDelay = savedDelay }()
+	retryBaseDelay = time.Second
+
+	for _, tc := range []struct {
+		retryAfter string
+		poll       int
+		want       time.Duration
+	}{
+		{"3", 0, 3 * time.Second},
+		{"0", 5, 0},
+		{time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0, 0},
+		{"", 0, time.Second},
+		{"", 2, 4 * time.Second},
+		{"soon", 3, 8 * time.Second},
+		{"", 4, maxPollDelay},
+		{"", 100, maxPollDelay},
+	} {
+		if got := pollDelay(tc.retryAfter, tc.poll); got != tc.want {
+			t.Errorf("pollDelay(%q, %d) = %v, want %v", tc.retryAfter, tc.poll, got, tc.want)
+		}
+	}
+}
+
+func TestFetchURLHeader(t *testing.T) {
+	savedHTTPGet, savedDelay := httpGet, retryBaseDelay
+	defer func() { httpGet, retryBaseDelay = savedHTTPGet, savedDelay }()
+	httpGet, retryBaseDelay = getURL, time.Millisecond
+
+	const token = "Bearer s3cr3t"
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if got := r.Header.Get("Authorization"); got != token {
+			t.Errorf("request %d: got Authorization %q, want %q", requests, got, token)
+		}
+		if requests == 1 {
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		http.Error(w, "denied", http.StatusForbidden)
+	}))
+	defer ts.Close()
+
+	header := http.Header{"Authorization": []string{token}}
+	_, _, err := fetchURL(context.Background(), ts.URL+"/profile", 5*time.Second, 2, 0, httpOptions{header: header})
+	if err == nil {
+		t.Fatalf("fetchURL: want error from forbidden response")
+	}
+	if strings.Contains(err.Error(), "s3cr3t") {
+		t.Errorf("fetchURL: error %q leaks the token", err)
+	}
+	if requests != 2 {
+		t.Errorf("got %d requests, want 2", requests)
+	}
+}
+
+func TestFetchURLChecksumTrailer(t *testing.T) {
+	savedHTTPGet := httpGet
+	defer func() { httpGet = savedHTTPGet }()
+	httpGet = getURL
+
+	data, err := ioutil.ReadFile("testdata/cppbench.cpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	crc := fmt.Sprintf("%08x", crc32.ChecksumIEEE(data))
+	for _, tc := range []struct {
+		desc, trailer, checksum string
+		wantErr                 bool
+	}{
+		{"no trailer", "", "", false},
+		{"correct checksum", "X-Checksum-Crc32", crc, false},
+		{"correct Castagnoli checksum", "X-Checksum-Crc32c", fmt.Sprintf("%08x", crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli))), false},
+		{"incorrect checksum", "X-Checksum-Crc32", "deadbeef", true},
+		{"declared but not sent", "X-Checksum-Crc32", "", false},
+		{"unknown trailer", "X-Checksum-Md5", "deadbeef", false},
+	} {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if tc.trailer != "" {
+				w.Header().Set("Trailer", tc.trailer)
+			}
+			w.Write(data)
+			if tc.checksum != "" {
+				w.Header().Set(tc.trailer, tc.checksum)
+			}
+		}))
+		body, _, err := fetchURL(context.Background(), ts.URL+"/profile", 5*time.Second, 0, 0, httpOptions{})
+		if err != nil {
+			t.Fatalf("%s: fetchURL: %v", tc.desc, err)
+		}
+		got, err := ioutil.ReadAll(body)
+		body.Close()
+		ts.Close()
+		switch {
+		case tc.wantErr && (err == nil || !strings.Contains(err.Error(), "corrupt profile (checksum mismatch)")):
+			t.Errorf("%s: got error %v, want checksum mismatch", tc.desc, err)
+		case !tc.wantErr && err != nil:
+			t.Errorf("%s: %v", tc.desc, err)
+		case !tc.wantErr && !bytes.Equal(got, data):
+			t.Errorf("%s: got %d bytes, want %d", tc.desc, len(got), len(data))
+		}
+	}
+}
+
+func TestFetchURLAuthToken(t *testing.T) {
+	savedHTTPGet, savedDelay := httpGet, retryBaseDelay
+	defer func() { httpGet, retryBaseDelay = savedHTTPGet, savedDelay }()
+	httpGet, retryBaseDelay = getURL, time.Millisecond
+
+	data, err := ioutil.ReadFile("testdata/cppbench.cpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first token has expired by the time the server checks it.
+	var got []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Header.Get("Authorization"))
+		if r.Header.Get("Authorization") != "Bearer token-2" {
+			http.Error(w, "token expired", http.StatusUnauthorized)
+			return
+		}
+		w.Write(data)
+	}))
+	defer ts.Close()
+
+	var tokens int
+	token := func(url string) (string, error) {
+		tokens++
+		return fmt.Sprintf("token-%d", tokens), nil
+	}
+	header := http.Header{"X-Trace": []string{"1"}}
+	body, _, err := fetchURL(context.Background(), ts.URL+"/profile", 5*time.Second, 2, 0, httpOptions{header: header, token: token})
+	if err != nil {
+		t.Fatalf("fetchURL: %v", err)
+	}
+	body.Close()
+	if want := []string{"Bearer token-1", "Bearer token-2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got Authorization headers %q, want %q", got, want)
+	}
+	if len(header) != 1 {
+		t.Errorf("fetchURL modified the header: %v", header)
+	}
+
+	// Without a token provider, unauthorized requests are not retried.
+	got = nil
+	if _, _, err := fetchURL(context.Background(), ts.URL+"/profile", 5*time.Second, 2, 0, httpOptions{}); err == nil || len(got) != 1 {
+		t.Errorf("fetchURL without token: got %d requests, error %v, want 1 and an error", len(got), err)
+	}
+
+	failing := func(url string) (string, error) { return "", fmt.Errorf("no credentials") }
+	if _, _, err := fetchURL(context.Background(), ts.URL+"/profile", 5*time.Second, 2, 0, httpOptions{token: failing}); err == nil || !strings.Contains(err.Error(), "no credentials") {
+		t.Errorf("fetchURL with failing token: got error %v, want no credentials", err)
+	}
+}
+
+func TestParseHTTPHeader(t *testing.T) {
+	header, err := parseHTTPHeader("Authorization: Bearer tok:en\n\n X-Trace : 1 \n")
+	if err != nil {
+		t.Fatalf("parseHTTPHeader: %v", err)
+	}
+	want := http.Header{"Authorization": []string{"Bearer tok:en"}, "X-Trace": []string{"1"}}
+	if !reflect.DeepEqual(header, want) {
+		t.Errorf("parseHTTPHeader: got %v, want %v", header, want)
+	}
+	if _, err := parseHTTPHeader("Bearer s3cr3t"); err == nil || strings.Contains(err.Error(), "s3cr3t") {
+		t.Errorf("parseHTTPHeader: got error %v, want error without the value", err)
+	}
+}
+
+func TestGetURLProxy(t *testing.T) {
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+		fmt.Fprint(w, "profile")
+	}))
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const source = "http://profiles.example/debug/pprof/heap"
+	resp, err := getURL(context.Background(), source, time.Second, httpOptions{proxy: proxyURL})
+	if err != nil {
+		t.Fatalf("getURL: %v", err)
+	}
+	resp.Body.Close()
+	if proxied != source {
+		t.Errorf("proxy got request for %q, want %q", proxied, source)
+	}
+
+	transport := httpTransport(10*time.Second, httpOptions{proxy: proxyURL})
+	if got, want := transport.ResponseHeaderTimeout, 15*time.Second; got != want {
+		t.Errorf("ResponseHeaderTimeout = %v, want %v", got, want)
+	}
+	if got, want := transport.TLSHandshakeTimeout, 10*time.Second; got != want {
+		t.Errorf("TLSHandshakeTimeout = %v, want %v", got, want)
+	}
+	if transport := httpTransport(10*time.Second, httpOptions{}); transport.Proxy == nil {
+		t.Errorf("httpTransport(nil proxy) does not use the environment proxy")
+	}
+}
+
+func TestRequestTimeouts(t *testing.T) {
+	for _, tc := range []struct {
+		timeout time.Duration
+		want    httpTimeouts
+	}{
+		{60 * time.Second, httpTimeouts{30 * time.Second, 10 * time.Second, 65 * time.Second, 125 * time.Second}},
+		{5 * time.Second, httpTimeouts{5 * time.Second, 5 * time.Second, 10 * time.Second, 15 * time.Second}},
+		{0, httpTimeouts{30 * time.Second, 10 * time.Second, 0, 0}},
+	} {
+		if got := requestTimeouts(tc.timeout); got != tc.want {
+			t.Errorf("requestTimeouts(%v) = %+v, want %+v", tc.timeout, got, tc.want)
+		}
+	}
+}
+
+func TestGetURLBodyDeadline(t *testing.T) {
+	savedSlack := httpResponseSlack
+	defer func() { httpResponseSlack = savedSlack }()
+	httpResponseSlack = 0
+
+	// The server sends the headers and part of the body, and then
+	// never finishes the body.
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial profile"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	}))
+	defer ts.Close()
+	defer close(done)
+
+	const timeout = 100 * time.Millisecond
+	start := time.Now()
+	resp, err := getURL(context.Background(), ts.URL, timeout, httpOptions{})
+	if err != nil {
+		t.Fatalf("getURL: %v", err)
+	}
+	defer resp.Body.Close()
+	if _, err := ioutil.ReadAll(resp.Body); err == nil {
+		t.Errorf("reading body: want error once the request deadline expires")
+	}
+	deadline := requestTimeouts(timeout).request
+	if elapsed := time.Since(start); elapsed < deadline || elapsed > deadline+5*time.Second {
+		t.Errorf("request aborted after %v, want %v", elapsed, deadline)
+	}
+}
+
+func TestCheckFetchAddr(t *testing.T) {
+	saveHTTPGet := httpGet
+	defer func() { httpGet = saveHTTPGet }()
+	httpGet = getURL
+
+	var hits int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		http.ServeFile(w, r, "testdata/cppbench.cpu")
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowed := map[string]bool{"127.0.0.1": true}
+	checkAddr := func(host string, ip net.IP) error {
+		if allowed[host] {
+			return nil
+		}
+		if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() {
+			return fmt.Errorf("private address")
+		}
+		return nil
+	}
+
+	for _, tc := range []struct {
+		source, wantErr string
+	}{
+		// Allowed by host, although its address is private.
+		{"http://127.0.0.1:" + u.Port() + "/profile", ""},
+		// Denied by its address, once localhost is resolved.
+		{"http://localhost:" + u.Port() + "/profile", "fetching from localhost"},
+		{"http://169.254.169.254/computeMetadata/v1/", "fetching from 169.254.169.254 (169.254.169.254)"},
+	} {
+		hits = 0
+		body, _, err := fetchURL(context.Background(), tc.source, 5*time.Second, 2, 0, httpOptions{checkAddr: checkAddr})
+		if tc.wantErr == "" {
+			if err != nil {
+				t.Errorf("fetchURL(%s, nil): %v", tc.source, err)
+				continue
+			}
+			body.Close()
+			if hits != 1 {
+				t.Errorf("fetchURL(%s, nil): got %d requests, want 1", tc.source, hits)
+			}
+			continue
+		}
+		if err == nil {
+			body.Close()
+			t.Errorf("fetchURL(%s, nil): want error %q", tc.source, tc.wantErr)
+			continue
+		}
+		if _, ok := err.(*addrDeniedError); !ok || !strings.HasPrefix(err.Error(), tc.wantErr) || !strings.HasSuffix(err.Error(), "is not allowed: private address") {
+			t.Errorf("fetchURL(%s, nil): got error %v, want %q... is not allowed", tc.source, err, tc.wantErr)
+		}
+		if hits != 0 {
+			t.Errorf("fetchURL(%s, nil): got %d requests, want none", tc.source, hits)
+		}
+	}
+
+	// Only the proxy could be checked, so that denied hosts could be
+	// fetched through it: proxied requests are refused.
+	var proxied int
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied++
+		http.ServeFile(w, r, "testdata/cppbench.cpu")
+	}))
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, source := range []string{"http://169.254.169.254/computeMetadata/v1/", "http://example.com/profile"} {
+		body, _, err := fetchURL(context.Background(), source, 5*time.Second, 2, 0, httpOptions{proxy: proxyURL, checkAddr: checkAddr})
+		if err == nil {
+			body.Close()
+		}
+		if _, ok := err.(*addrDeniedError); !ok || !strings.Contains(err.Error(), "cannot check the connections of proxy") {
+			t.Errorf("fetchURL(%s) through a proxy: got error %v, want proxy not allowed", source, err)
+		}
+	}
+	if proxied != 0 {
+		t.Errorf("got %d proxied requests with checkAddr set, want none", proxied)
+	}
+
+	// Without checkAddr, the proxy is used.
+	body, _, err := fetchURL(context.Background(), "http://example.com/profile", 5*time.Second, 0, 0, httpOptions{proxy: proxyURL})
+	if err != nil {
+		t.Fatalf("fetchURL through a proxy: %v", err)
+	}
+	body.Close()
+	if proxied != 1 {
+		t.Errorf("got %d proxied requests without checkAddr, want 1", proxied)
+	}
+}
+
+func TestAdjustURL(t *testing.T) {
+	for _, tc := range []struct {
+		source      string
+		duration    time.Duration
+		want        string
+		wantTimeout time.Duration
+	}{
+		{"host:8080/profile", 0, "http://host:8080/profile", 60 * time.Second},
+		{"http://host/profile", 30 * time.Second, "http://host/profile?seconds=30", 45 * time.Second},
+		{
+			"http://host/profile?debug=1&tag=b&tag=a&x=%2F",
+			0,
+			"http://host/profile?debug=1&tag=b&tag=a&x=%2F",
+			60 * time.Second,
+		},
+		{
+			"http://host/profile?tag=b&seconds=10&debug=1&tag=a",
+			0,
+			"http://host/profile?tag=b&seconds=10&debug=1&tag=a",
+			15 * time.Second,
+		},
+		{
+			"http://host/profile?tag=b&seconds=10&debug=1&seconds=20&tag=a",
+			30 * time.Second,
+			"http://host/profile?tag=b&seconds=30&debug=1&tag=a",
+			45 * time.Second,
+		},
+		{
+			"http://host/profile?z=1&debug&tag=b&tag=a",
+			30 * time.Second,
+			"http://host/profile?z=1&debug&tag=b&tag=a&seconds=30",
+			45 * time.Second,
+		},
+		{
+			"http://host/profile?from=1700000000&to=1700000300&step=10",
+			0,
+			"http://host/profile?from=1700000000&to=1700000300&step=10",
+			60 * time.Second,
+		},
+		{
+			"http://host/profile?step=10&from=1700000000",
+			30 * time.Second,
+			"http://host/profile?step=10&from=1700000000",
+			60 * time.Second,
+		},
+		{"/local/file", 0, "", 0},
+		{"data:application/octet-stream;base64,H4sIAAAAAAAA", 0, "", 0},
+		{"unix:///run/service.sock:/debug/pprof/heap", 0, "unix:///run/service.sock:/debug/pprof/heap", 60 * time.Second},
+		{
+			"unix:///run/service.sock:/debug/pprof/profile?debug=1",
+			30 * time.Second,
+			"unix:///run/service.sock:/debug/pprof/profile?debug=1&seconds=30",
+			45 * time.Second,
+		},
+	} {
+		got, timeout := adjustURL(tc.source, tc.duration, 0)
+		if got != tc.want || timeout != tc.wantTimeout {
+			t.Errorf("adjustURL(%q, %v) = %q, %v, want %q, %v", tc.source, tc.duration, got, timeout, tc.want, tc.wantTimeout)
+		}
+	}
+}
+
+func TestRangeSources(t *testing.T) {
+	now := time.Unix(1700000300, 0)
+	for _, tc := range []struct {
+		desc    string
+		addr    string
+		seconds int
+		last    time.Duration
+		want    string
+		wantErr bool
+	}{
+		{"local", "/local/file", 0, 5 * time.Minute, "/local/file", false},
+		{"no range", "host:8080/profile", 30, 0, "host:8080/profile", false},
+		{"kept range", "http://host/profile?from=1&to=2&step=10", -1, 0, "http://host/profile?from=1&to=2&step=10", false},
+		{"last 5m", "host:8080/profile", -1, 5 * time.Minute, "http://host:8080/profile?from=1700000000&to=1700000300", false},
+		{"last 5m with step", "http://host/profile?step=10", -1, 5 * time.Minute, "http://host/profile?step=10&from=1700000000&to=1700000300", false},
+		{"range and seconds parameters", "http://host/profile?from=1&seconds=30", -1, 0, "", true},
+		{"range parameters and -seconds", "http://host/profile?from=1&to=2", 30, 0, "", true},
+		{"-range and range parameters", "http://host/profile?to=2", -1, time.Minute, "", true},
+		{"-range and seconds parameter", "http://host/profile?seconds=30", -1, time.Minute, "", true},
+	} {
+		got, err := rangeSources([]string{tc.addr}, tc.seconds, tc.last, now)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: rangeSources() error %v, want error %v", tc.desc, err, tc.wantErr)
+			continue
+		}
+		if err == nil && got[0] != tc.want {
+			t.Errorf("%s: rangeSources() = %q, want %q", tc.desc, got[0], tc.want)
+		}
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	for _, tc := range []struct {
+		v       string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"last 5m", 5 * time.Minute, false},
+		{" last  1h30m ", 90 * time.Minute, false},
+		{"5m", 0, true},
+		{"last", 0, true},
+		{"last five", 0, true},
+		{"last -5m", 0, true},
+		{"next 5m", 0, true},
+	} {
+		got, err := parseRange(tc.v)
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("parseRange(%q) = %v, %v, want %v, error %v", tc.v, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+func TestDataURL(t *testing.T) {
+	saveHTTPGet := httpGet
+	defer func() { httpGet = saveHTTPGet }()
+	httpGet = func(ctx context.Context, source string, timeout time.Duration, opts httpOptions) (*http.Response, error) {
+		t.Errorf("unexpected HTTP request for %s", source)
+		return nil, fmt.Errorf("unexpected HTTP request")
+	}
+
+	want := cpuProfile()
+	var buf bytes.Buffer
+	if err := want.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	data := base64.StdEncoding.EncodeToString(buf.Bytes())
+
+	for _, dataURL := range []string{
+		"data:application/octet-stream;base64," + data,
+		"data:;base64," + strings.TrimRight(data, "="),
+	} {
+		p, src, _, err := fetch(context.Background(), dataURL, 0, 0, &source{}, &proftest.TestUI{T: t})
+		if err != nil {
+			t.Fatalf("fetch(%.40s...): %v", dataURL, err)
+		}
+		if src != "" {
+			t.Errorf("fetch(%.40s...): got remote source %q, want none", dataURL, src)
+		}
+		if len(p.Sample) != len(want.Sample) {
+			t.Errorf("fetch(%.40s...): got %d samples, want %d", dataURL, len(p.Sample), len(want.Sample))
+		}
+	}
+
+	for _, tc := range []struct {
+		source, wantErr string
+	}{
+		{"data:application/octet-stream;base64", "missing comma"},
+		{"data:;base64,!!!!", "malformed"},
+		{"data:," + "%zz", "malformed"},
+		{"data:;base64," + strings.Repeat("A", 2*maxDataURLSize), "exceeds"},
+		{"data:," + strings.Repeat("x", maxDataURLSize+1), "exceeds"},
+	} {
+		if _, _, _, err := fetch(context.Background(), tc.source, 0, 0, &source{}, &proftest.TestUI{T: t}); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("fetch(%.40s...): got error %v, want error containing %q", tc.source, err, tc.wantErr)
+		}
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix domain sockets are not supported")
+	}
+	saveHTTPGet := httpGet
+	defer func() { httpGet = saveHTTPGet }()
+	httpGet = getURL
+
+	dir, err := ioutil.TempDir("", "pprof-socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "service.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.RequestURI())
+		http.ServeFile(w, r, "testdata/cppbench.cpu")
+	})}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	src := "unix://" + socket + ":/debug/pprof/profile"
+	p, got, _, err := fetch(context.Background(), src, 10*time.Second, 0, &source{}, &proftest.TestUI{T: t})
+	if err != nil {
+		t.Fatalf("fetch(%s): %v", src, err)
+	}
+	if len(p.Sample) == 0 || got != src+"?seconds=10" {
+		t.Errorf("fetch(%s): got %d samples from %s, want samples from %s?seconds=10", src, len(p.Sample), got, src)
+	}
+	if want := "/debug/pprof/profile?seconds=10"; len(paths) != 1 || paths[0] != want {
+		t.Errorf("fetch(%s): got requests for %v, want %s", src, paths, want)
+	}
+
+	// Sockets cannot be checked, so they are refused if addresses are.
+	allowAll := func(string, net.IP) error { return nil }
+	if _, _, err := fetchURL(context.Background(), src, time.Second, 2, 0, httpOptions{checkAddr: allowAll}); err == nil || !strings.Contains(err.Error(), "is not allowed") {
+		t.Errorf("fetchURL(%s, nil) with address check: got error %v, want not allowed", src, err)
+	}
+	if len(paths) != 1 {
+		t.Errorf("fetchURL(%s, nil) with address check: got %d requests, want none", src, len(paths)-1)
+	}
+}
+
+func TestRedirects(t *testing.T) {
+	saveHTTPGet := httpGet
+	defer func() { httpGet = saveHTTPGet }()
+
+	var plainHits int
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		plainHits++
+		http.ServeFile(w, r, "testdata/cppbench.cpu")
+	}))
+	defer plain.Close()
+	var secureHits int
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secureHits++
+		switch r.URL.Path {
+		case "/downgrade":
+			http.Redirect(w, r, plain.URL+"/profile", http.StatusTemporaryRedirect)
+		case "/moved":
+			http.Redirect(w, r, "/profile", http.StatusFound)
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		default:
+			http.ServeFile(w, r, "testdata/cppbench.cpu")
+		}
+	}))
+	defer secure.Close()
+
+	// Use the transport of httpClient, trusting the test server.
+	httpGet = func(ctx context.Context, source string, timeout time.Duration, opts httpOptions) (*http.Response, error) {
+		client := httpClient(timeout, opts)
+		client.Transport.(*http.Transport).TLSClientConfig = secure.Client().Transport.(*http.Transport).TLSClientConfig
+		return client.Get(source)
+	}
+
+	for _, tc := range []struct {
+		path, wantErr string
+		wantHits      int
+	}{
+		{"/moved", "", 2},
+		{"/downgrade", "refusing redirect from https://" + secure.Listener.Addr().String() + " to insecure http://", 1},
+		{"/loop", "stopped after 5 redirects", 5},
+	} {
+		plainHits, secureHits = 0, 0
+		body, _, err := fetchURL(context.Background(), secure.URL+tc.path, 5*time.Second, 2, 0, httpOptions{})
+		if tc.wantErr == "" {
+			if err != nil {
+				t.Errorf("fetchURL(%s, nil): %v", tc.path, err)
+				continue
+			}
+			body.Close()
+		} else if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("fetchURL(%s, nil): got error %v, want %q", tc.path, err, tc.wantErr)
+		}
+		// Refused redirects are not retried, nor followed.
+		if secureHits != tc.wantHits || plainHits != 0 {
+			t.Errorf("fetchURL(%s, nil): got %d https and %d http requests, want %d and 0", tc.path, secureHits, plainHits, tc.wantHits)
+		}
+	}
+}
+
+func TestMaxProfileSize(t *testing.T) {
+	saveHTTPGet := httpGet
+	defer func() { httpGet = saveHTTPGet }()
+	httpGet = getURL
+
+	data, err := ioutil.ReadFile("testdata/cppbench.cpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stream" {
+			// Flushing before writing the body omits its length.
+			w.(http.Flusher).Flush()
+			w.Write(bytes.Repeat([]byte("x"), 4096))
+			return
+		}
+		w.Write(data)
+	}))
+	defer ts.Close()
+
+	for _, tc := range []struct {
+		path    string
+		maxSize int64
+		wantErr bool
+	}{
+		{"/profile", 0, false},
+		{"/profile", int64(len(data)), false},
+		{"/profile", int64(len(data)) - 1, true},
+		{"/stream", 4096, false},
+		{"/stream", 100, true},
+	} {
+		body, _, err := fetchURL(context.Background(), ts.URL+tc.path, 5*time.Second, 0, tc.maxSize, httpOptions{})
+		var got []byte
+		if err == nil {
+			got, err = ioutil.ReadAll(body)
+			body.Close()
+		}
+		if !tc.wantErr {
+			if err != nil {
+				t.Errorf("fetchURL(%s, nil) with max size %d: %v", tc.path, tc.maxSize, err)
+			}
+			continue
+		}
+		if want := fmt.Sprintf("profile exceeds max size of %d bytes", tc.maxSize); err == nil || err.Error() != want {
+			t.Errorf("fetchURL(%s, nil) with max size %d: got %d bytes, error %v, want %q", tc.path, tc.maxSize, len(got), err, want)
+		}
+	}
+}
+
+func TestHTTP2(t *testing.T) {
+	saveHTTPGet := httpGet
+	defer func() { httpGet = saveHTTPGet }()
+	httpGet = getURL
+
+	for _, tc := range []struct {
+		desc      string
+		http2     bool
+		wantProto string
+	}{
+		{"http2 server", true, "HTTP/2.0"},
+		{"http1 server", false, "HTTP/1.1"},
+	} {
+		var proto string
+		ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			proto = r.Proto
+			http.ServeFile(w, r, "testdata/cppbench.cpu")
+		}))
+		ts.EnableHTTP2 = tc.http2
+		ts.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+		ts.StartTLS()
+
+		// A custom TLS configuration does not prevent negotiating HTTP/2.
+		roots := x509.NewCertPool()
+		roots.AddCert(ts.Certificate())
+		body, _, err := fetchURL(context.Background(), ts.URL, time.Second, 0, 0, httpOptions{tlsConfig: &tls.Config{RootCAs: roots}})
+		if err != nil {
+			ts.Close()
+			t.Fatalf("%s: fetchURL: %v", tc.desc, err)
+		}
+		_, err = profile.Parse(body)
+		body.Close()
+		ts.Close()
+		if err != nil {
+			t.Errorf("%s: parsing profile: %v", tc.desc, err)
+		}
+		if proto != tc.wantProto {
+			t.Errorf("%s: got protocol %s, want %s", tc.desc, proto, tc.wantProto)
+		}
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	saveHTTPGet, savedDelay := httpGet, retryBaseDelay
+	defer func() { httpGet, retryBaseDelay = saveHTTPGet, savedDelay }()
+	httpGet, retryBaseDelay = getURL, time.Millisecond
+
+	dir, err := ioutil.TempDir("", "pprof-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Issue a client certificate from a test CA.
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "pprof test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "pprof"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, &clientKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKeyDER, err := x509.MarshalECPrivateKey(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Serve profiles only to clients presenting a certificate from the
+	// CA, failing the first request of each client to force a retry.
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca)
+	var hits int
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits++; hits == 1 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		http.ServeFile(w, r, "testdata/cppbench.cpu")
+	}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	ts.Config.ErrorLog = log.New(ioutil.Discard, "", 0) // Expected handshake errors.
+	ts.StartTLS()
+	defer ts.Close()
+
+	writePEM := func(name, blockType string, der []byte) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	certFile := writePEM("client.crt", "CERTIFICATE", clientDER)
+	keyFile := writePEM("client.key", "EC PRIVATE KEY", clientKeyDER)
+	caFile := writePEM("server-ca.crt", "CERTIFICATE", ts.Certificate().Raw)
+
+	for _, tc := range []struct {
+		desc                     string
+		certFile, keyFile, ca    string
+		wantErr, wantConfigError bool
+	}{
+		{"client certificate", certFile, keyFile, caFile, false, false},
+		{"no client certificate", "", "", caFile, true, false},
+		{"untrusted server", certFile, keyFile, "", true, false},
+		{"certificate without key", certFile, "", caFile, false, true},
+		{"missing CA file", certFile, keyFile, filepath.Join(dir, "missing"), false, true},
+	} {
+		hits = 0
+		config, err := loadTLSConfig(tc.certFile, tc.keyFile, tc.ca)
+		if tc.wantConfigError {
+			if err == nil {
+				t.Errorf("%s: loadTLSConfig: want error", tc.desc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: loadTLSConfig: %v", tc.desc, err)
+		}
+		body, _, err := fetchURL(context.Background(), ts.URL+"/profile", 5*time.Second, 1, 0, httpOptions{tlsConfig: config})
+		if tc.wantErr {
+			if err == nil {
+				body.Close()
+				t.Errorf("%s: fetchURL: want error", tc.desc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: fetchURL: %v", tc.desc, err)
+			continue
+		}
+		p, err := profile.Parse(body)
+		body.Close()
+		if err != nil || len(p.Sample) == 0 || hits != 2 {
+			t.Errorf("%s: got profile %v, error %v after %d requests, want samples after 2", tc.desc, p, err, hits)
+		}
+	}
+}
+
+func TestFetchStagger(t *testing.T) {
+	const n = 8
+	const stagger = 300 * time.Millisecond
+	for _, tc := range []struct {
+		desc       string
+		seconds    int
+		wantSpread bool
+	}{
+		{"time-based profiles", 1, true},
+		{"other profiles", -1, false},
+	} {
+		f := &timedFetcher{}
+		s := &source{Seconds: tc.seconds, FetchStagger: stagger}
+		sources := make([]profileSource, n)
+		for i := range sources {
+			sources[i] = profileSource{addr: "cpu", source: s, scale: 1}
+		}
+		start := time.Now()
+		if err := concurrentFetch(context.Background(), sources, f, testObj{}, &proftest.TestUI{T: t}, nil); err != nil {
+			t.Fatalf("%s: concurrentFetch: %v", tc.desc, err)
+		}
+		if elapsed := time.Since(start); elapsed > 5*stagger {
+			t.Errorf("%s: fetches took %v, want at most about %v of stagger", tc.desc, elapsed, stagger)
+		}
+		first, last := f.starts[0], f.starts[0]
+		for _, t := range f.starts {
+			if t.Before(first) {
+				first = t
+			}
+			if t.After(last) {
+				last = t
+			}
+		}
+		// The chance of all random delays falling within a tenth of the
+		// stagger of each other is negligible.
+		if spread := last.Sub(first); (spread > stagger/10) != tc.wantSpread {
+			t.Errorf("%s: fetches started within %v, want spread out: %v", tc.desc, spread, tc.wantSpread)
+		}
+	}
+
+	// Staggered fetches are abandoned once cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	s := &source{Seconds: 1, FetchStagger: time.Hour}
+	sources := []profileSource{{addr: "cpu", source: s, scale: 1}}
+	f := &timedFetcher{}
+	if err := concurrentFetch(ctx, sources, f, testObj{}, &proftest.TestUI{T: t}, nil); err != context.Canceled {
+		t.Errorf("concurrentFetch: got error %v, want %v", err, context.Canceled)
+	}
+	if len(f.starts) != 0 {
+		t.Errorf("concurrentFetch: got %d fetches after cancellation, want none", len(f.starts))
+	}
+}
+
+// timedFetcher is a testFetcher recording when each fetch started.
+type timedFetcher struct {
+	mu     sync.Mutex
+	starts []time.Time
+}
+
+func (f *timedFetcher) Fetch(s string, d, t time.Duration) (*profile.Profile, string, error) {
+	f.mu.Lock()
+	f.starts = append(f.starts, time.Now())
+	f.mu.Unlock()
+	return testFetcher{}.Fetch(s, d, t)
+}
+
+func TestFetchCancel(t *testing.T) {
+	savedHTTPGet := httpGet
+	defer func() { httpGet = savedHTTPGet }()
+	httpGet = getURL
+
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, _, err := fetchURL(ctx, ts.URL+"/profile", 30*time.Second, 2, 0, httpOptions{})
+	if err == nil {
+		t.Errorf("fetchURL: want error after cancellation")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("fetchURL returned after %v, want prompt return on cancellation", elapsed)
+	}
+
+	sources := []profileSource{{addr: "cpu", source: &source{}, scale: 1}}
+	_, _, _, _, err = concurrentGrab(ctx, sources, testFetcher{}, testObj{}, &proftest.TestUI{T: t}, nil)
+	if err != context.Canceled {
+		t.Errorf("concurrentGrab: got error %v, want %v", err, context.Canceled)
+	}
+	if sources[0].p != nil || sources[0].err != nil {
+		t.Errorf("concurrentGrab fetched a source after cancellation")
+	}
+}
+
+func TestChunkedGrabConcurrency(t *testing.T) {
+	const n, chunkSize = 20, 3
+	s := &source{}
+	var sources []profileSource
+	for i := 0; i < n; i++ {
+		sources = append(sources, profileSource{addr: "cpu", source: s, scale: 1})
+	}
+
+	f := &peakFetcher{}
+	_, _, _, count, err := chunkedGrab(context.Background(), sources, chunkSize, f, testObj{}, &proftest.TestUI{T: t})
+	if err != nil {
+		t.Fatalf("chunkedGrab: %v", err)
+	}
+	if count != n {
+		t.Errorf("chunkedGrab fetched %d profiles, want %d", count, n)
+	}
+	if f.peak > chunkSize {
+		t.Errorf("chunkedGrab fetched %d profiles at once, want at most %d", f.peak, chunkSize)
+	}
+}
+
+func TestNoPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pprof-prune")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Mark the leaf frames, as the Go runtime does for its own frames.
+	p := cpuProfile()
+	p.DropFrames = "mangled1000"
+	name := filepath.Join(dir, "cpu.pb.gz")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Write(f); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	hasFrame := func(p *profile.Profile, fn string) bool {
+		for _, s := range p.Sample {
+			for _, l := range s.Location {
+				for _, line := range l.Line {
+					if line.Function.Name == fn {
+						return true
+					}
+				}
+			}
+		}
+		return false
+	}
+	for _, noPrune := range []bool{false, true} {
+		o := setDefaults(&plugin.Options{Obj: testObj{}, Sym: testSymbolizer{}, UI: &proftest.TestUI{T: t}})
+		p, err := fetchProfiles(context.Background(), &source{Sources: []string{name}, NoPrune: noPrune}, o)
+		if err != nil {
+			t.Fatalf("fetchProfiles: %v", err)
+		}
+		if got := hasFrame(p, "mangled1000"); got != noPrune {
+			t.Errorf("NoPrune=%v: got dropped frame kept %v, want %v", noPrune, got, noPrune)
+		}
+	}
+}
+
+func TestTransform(t *testing.T) {
+	rename := func(source string, p *profile.Profile) error {
+		if source == "bad" {
+			return fmt.Errorf("cannot transform %s", source)
+		}
+		for _, st := range p.SampleType {
+			if st.Type == "cpu_time" {
+				st.Type = "cpu"
+			}
+		}
+		return nil
+	}
+
+	// The renamed sample type does not merge with the others.
+	o := setDefaults(&plugin.Options{Fetch: renamingFetcher{}, Obj: testObj{}, Sym: testSymbolizer{}, UI: &proftest.TestUI{T: t}})
+	if _, err := fetchProfiles(context.Background(), &source{Sources: []string{"cpu", "renamed"}, NoSave: true}, o); err == nil {
+		t.Errorf("fetchProfiles: want merge error without a transform")
+	}
+
+	// The failed transform only drops its source.
+	o = setDefaults(&plugin.Options{Fetch: renamingFetcher{}, Obj: testObj{}, Sym: testSymbolizer{}, UI: &proftest.TestUI{T: t, Ignore: 2}})
+	p, err := fetchProfiles(context.Background(), &source{Sources: []string{"cpu", "renamed", "bad"}, Transform: rename, NoSave: true}, o)
+	if err != nil {
+		t.Fatalf("fetchProfiles: %v", err)
+	}
+	if got, want := p.SampleType[1].Type, "cpu"; got != want {
+		t.Errorf("got sample type %q, want %q", got, want)
+	}
+	if got, want := p.Sample[0].Value[0], 2*cpuProfile().Sample[0].Value[0]; got != want {
+		t.Errorf("got merged sample value %d, want %d", got, want)
+	}
+}
+
+// renamingFetcher is a fetcher serving a CPU profile for every source,
+// with its cpu sample type renamed to cpu_time for source "renamed".
+type renamingFetcher struct{}
+
+func (renamingFetcher) Fetch(s string, d, t time.Duration) (*profile.Profile, string, error) {
+	p := cpuProfile()
+	if s == "renamed" {
+		p.SampleType[1].Type = "cpu_time"
+	}
+	return p, "", nil
+}
+
+func TestProfileData(t *testing.T) {
+	var buf bytes.Buffer
+	if err := cpuProfile().Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	data := map[string][]byte{
+		"inmem":                  buf.Bytes(),
+		"http://host:9000/cpu":   buf.Bytes(),
+		"bad":                    []byte("not a profile"),
+		"http://host:9000/empty": nil,
+	}
+	s := &source{ProfileData: data, ExecName: "/path/to/exec", MaxDecompressedSize: defaultMaxDecompressedSize, NoSave: true}
+
+	// testFetcher fails on all these sources, so the profiles can only
+	// come from the raw data.
+	p, msrc, remote, err := grabProfile(context.Background(), s, "inmem", 2, testFetcher{}, testObj{}, &proftest.TestUI{T: t})
+	if err != nil {
+		t.Fatalf("grabProfile: %v", err)
+	}
+	if got, want := p.Sample[0].Value[1], 2*cpuProfile().Sample[0].Value[1]; got != want {
+		t.Errorf("got scaled sample value %d, want %d", got, want)
+	}
+	if got, want := p.Mapping[0].File, "/path/to/exec"; got != want {
+		t.Errorf("got mapping file %s, want %s", got, want)
+	}
+	if msrc != nil || remote {
+		t.Errorf("got mapping sources %v, remote %v for local data, want none", msrc, remote)
+	}
+
+	// Mappings of remote sources are collected for symbolization.
+	_, msrc, remote, err = grabProfile(context.Background(), s, "http://host:9000/cpu", 1, testFetcher{}, testObj{}, &proftest.TestUI{T: t})
+	if err != nil {
+		t.Fatalf("grabProfile: %v", err)
+	}
+	if len(msrc) == 0 || !remote {
+		t.Errorf("got mapping sources %v, remote %v, want sources from the URL", msrc, remote)
+	}
+	for _, srcs := range msrc {
+		for _, src := range srcs {
+			if src.Source != "http://host:9000/cpu" {
+				t.Errorf("got mapping source %s, want http://host:9000/cpu", src.Source)
+			}
+		}
+	}
+
+	for _, bad := range []string{"bad", "http://host:9000/empty"} {
+		if _, _, _, err := grabProfile(context.Background(), s, bad, 1, testFetcher{}, testObj{}, &proftest.TestUI{T: t}); err == nil || !strings.Contains(err.Error(), "parsing profile data") {
+			t.Errorf("%s: got error %v, want parse error", bad, err)
+		}
+	}
+}
+
+func TestOffline(t *testing.T) {
+	o := setDefaults(&plugin.Options{Fetch: testFetcher{}, Obj: testObj{}, Sym: testSymbolizer{}, UI: &proftest.TestUI{T: t}})
+	for _, remote := range []string{"http://host:8000/cpu", "host:8000/cpu", "grpc://host:8000/cpu"} {
+		s := &source{Sources: []string{"cpu", remote}, Offline: true, NoSave: true}
+		if _, err := fetchProfiles(context.Background(), s, o); err == nil || !strings.Contains(err.Error(), "offline mode") {
+			t.Errorf("%s: got error %v, want offline mode error", remote, err)
+		}
+	}
+	s := &source{Sources: []string{"cpu"}, Base: []string{"http://host:8000/cpu"}, Offline: true, NoSave: true}
+	if _, err := fetchProfiles(context.Background(), s, o); err == nil || !strings.Contains(err.Error(), "offline mode") {
+		t.Errorf("remote base: got error %v, want offline mode error", err)
+	}
+	s = &source{Sources: []string{"cpu"}, Offline: true, NoSave: true}
+	if _, err := fetchProfiles(context.Background(), s, o); err != nil {
+		t.Errorf("local source: %v", err)
+	}
+
+	// Only binaries already downloaded from debuginfod are used.
+	savedHTTPGet := httpGet
+	defer func() { httpGet = savedHTTPGet }()
+	httpGet = func(context.Context, string, time.Duration, httpOptions) (*http.Response, error) {
+		t.Errorf("offline mode: unexpected HTTP request")
+		return nil, fmt.Errorf("offline")
+	}
+	dir, err := ioutil.TempDir("", "pprof-offline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, env := range []string{"DEBUGINFOD_URLS", "DEBUGINFOD_CACHE_PATH", "PPROF_SYMBOL_SERVER", "PPROF_BINARY_PATH"} {
+		defer os.Setenv(env, os.Getenv(env))
+	}
+	os.Setenv("DEBUGINFOD_URLS", "http://debuginfod.example")
+	os.Setenv("DEBUGINFOD_CACHE_PATH", dir)
+	os.Setenv("PPROF_SYMBOL_SERVER", "http://symbols.example/{buildid}")
+	os.Setenv("PPROF_BINARY_PATH", dir)
+	cached := filepath.Join(dir, "abcde10003", "debuginfo")
+	if err := os.MkdirAll(filepath.Dir(cached), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(cached, []byte("abcde10003"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		buildID, want string
+	}{
+		{"abcde10003", cached},
+		{"abcde10004", "/usr/bin/binary"},
+	} {
+		p := &profile.Profile{
+			Mapping: []*profile.Mapping{{File: "/usr/bin/binary", BuildID: tc.buildID}},
+		}
+		locateBinaries(p, &source{Offline: true}, "", binarySearchPath(), debugObj{}, &proftest.TestUI{T: t, Ignore: 1})
+		if got := p.Mapping[0].File; got != tc.want {
+			t.Errorf("%s: got file %s, want %s", tc.buildID, got, tc.want)
+		}
+	}
+}
+
+func TestPeriodOverride(t *testing.T) {
+	cpu := &profile.ValueType{Type: "cpu", Unit: "milliseconds"}
+	for _, tc := range []struct {
+		desc       string
+		period     *periodOverride
+		wantType   *profile.ValueType
+		wantPeriod int64
+		wantWarn   bool
+	}{
+		{"no override", nil, cpu, 20000000, false},
+		{"period", &periodOverride{period: 10000000}, cpu, 10000000, true},
+		{"period and type", &periodOverride{&profile.ValueType{Type: "wall", Unit: "nanoseconds"}, 1000}, &profile.ValueType{Type: "wall", Unit: "nanoseconds"}, 1000, true},
+	} {
+		fetcher := periodFetcher{"cpu": 10000000, "slow": 20000000}
+		ui := &progressUI{}
+		o := setDefaults(&plugin.Options{Fetch: fetcher, Obj: testObj{}, Sym: testSymbolizer{}, UI: ui})
+		p, err := fetchProfiles(context.Background(), &source{Sources: []string{"cpu", "slow"}, PeriodOverride: tc.period, NoSave: true}, o)
+		if err != nil {
+			t.Fatalf("%s: fetchProfiles: %v", tc.desc, err)
+		}
+		if p.Period != tc.wantPeriod || *p.PeriodType != *tc.wantType {
+			t.Errorf("%s: got period %d %v, want %d %v", tc.desc, p.Period, *p.PeriodType, tc.wantPeriod, *tc.wantType)
+		}
+		var warned bool
+		for _, msg := range ui.msgs {
+			warned = warned || strings.Contains(msg, "different periods")
+		}
+		if warned != tc.wantWarn {
+			t.Errorf("%s: got warnings %q, want period warning: %v", tc.desc, ui.msgs, tc.wantWarn)
+		}
+	}
+
+	// No warning is given if the sources agree.
+	ui := &progressUI{}
+	o := setDefaults(&plugin.Options{Fetch: periodFetcher{"cpu": 10000000}, Obj: testObj{}, Sym: testSymbolizer{}, UI: ui})
+	if _, err := fetchProfiles(context.Background(), &source{Sources: []string{"cpu", "cpu"}, PeriodOverride: &periodOverride{period: 1}, NoSave: true}, o); err != nil {
+		t.Fatalf("fetchProfiles: %v", err)
+	}
+	for _, msg := range ui.msgs {
+		if strings.Contains(msg, "different periods") {
+			t.Errorf("got warning %q for sources with the same period", msg)
+		}
+	}
+}
+
+// periodFetcher is a fetcher serving a CPU profile with the period
+// given for each source.
+type periodFetcher map[string]int64
+
+func (f periodFetcher) Fetch(s string, d, t time.Duration) (*profile.Profile, string, error) {
+	period, ok := f[s]
+	if !ok {
+		return nil, "", fmt.Errorf("unexpected source: %s", s)
+	}
+	p := cpuProfile()
+	p.Period = period
+	return p, "", nil
+}
+
+func TestNormalizeSources(t *testing.T) {
+	// Source a has a single sample with 1000ms of cpu, and b one with
+	// 10ms on another stack.
+	f := sampleFetcher{"a": 0, "b": 3}
+	for _, tc := range []struct {
+		normalize   bool
+		concurrency int
+		want        [2]int64
+	}{
+		{false, 0, [2]int64{1000, 10}},
+		{true, 0, [2]int64{505, 505}},
+		// Merging the sources in separate chunks gives the same result.
+		{true, 1, [2]int64{505, 505}},
+	} {
+		o := setDefaults(&plugin.Options{Fetch: f, Obj: testObj{}, Sym: testSymbolizer{}, UI: &proftest.TestUI{T: t}})
+		s := &source{Sources: []string{"a", "b"}, NormalizeSources: tc.normalize, FetchConcurrency: tc.concurrency, NoSave: true}
+		p, err := fetchProfiles(context.Background(), s, o)
+		if err != nil {
+			t.Fatalf("fetchProfiles: %v", err)
+		}
+		if len(p.Sample) != 2 {
+			t.Fatalf("normalize=%v: got %d samples, want 2", tc.normalize, len(p.Sample))
+		}
+		got := [2]int64{p.Sample[0].Value[1], p.Sample[1].Value[1]}
+		if len(p.Sample[0].Location) < len(p.Sample[1].Location) {
+			got[0], got[1] = got[1], got[0]
+		}
+		if got != tc.want {
+			t.Errorf("normalize=%v, concurrency=%d: got sample values %v, want %v", tc.normalize, tc.concurrency, got, tc.want)
+		}
+	}
+}
+
+// sampleFetcher is a fetcher serving a CPU profile with only the
+// sample at the index given for each source.
+func TestMemoryBudget(t *testing.T) {
+	f := sampleFetcher{"a": 0, "b": 1, "c": 2, "d": 3}
+	for _, tc := range []struct {
+		budget      int64
+		wantSamples int
+		wantWarns   int
+	}{
+		{0, 4, 0},
+		{1 << 20, 4, 0},
+		// The first chunk is over budget, so the others are skipped.
+		{1, 1, 2},
+	} {
+		ui := &progressUI{}
+		o := setDefaults(&plugin.Options{Fetch: f, Obj: testObj{}, Sym: testSymbolizer{}, UI: ui})
+		s := &source{Sources: []string{"a", "b", "c", "d"}, FetchConcurrency: 1, MemoryBudget: tc.budget, NoSave: true}
+		p, err := fetchProfiles(context.Background(), s, o)
+		if err != nil {
+			t.Fatalf("budget %d: fetchProfiles: %v", tc.budget, err)
+		}
+		if len(p.Sample) != tc.wantSamples {
+			t.Errorf("budget %d: got %d samples, want %d", tc.budget, len(p.Sample), tc.wantSamples)
+		}
+		if len(ui.msgs) != tc.wantWarns {
+			t.Errorf("budget %d: got warnings %q, want %d", tc.budget, ui.msgs, tc.wantWarns)
+		} else if tc.wantWarns > 0 && (!strings.Contains(ui.msgs[0], "over the memory budget") || !strings.Contains(ui.msgs[1], "3 skipped")) {
+			t.Errorf("budget %d: got warnings %q, want memory budget and skipped sources", tc.budget, ui.msgs)
+		}
+	}
+}
+
+type sampleFetcher map[string]int
+
+func (f sampleFetcher) Fetch(s string, d, t time.Duration) (*profile.Profile, string, error) {
+	i, ok := f[s]
+	if !ok {
+		return nil, "", fmt.Errorf("unexpected source: %s", s)
+	}
+	p := cpuProfile()
+	p.Sample = p.Sample[i : i+1]
+	return p, "", nil
+}
+
+func TestParsePeriod(t *testing.T) {
+	for _, tc := range []struct {
+		v       string
+		want    *periodOverride
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"10000000", &periodOverride{period: 10000000}, false},
+		{"cpu/nanoseconds=10000000", &periodOverride{&profile.ValueType{Type: "cpu", Unit: "nanoseconds"}, 10000000}, false},
+		{"cpu=10", nil, true},
+		{"/nanoseconds=10", nil, true},
+		{"cpu/nanoseconds=", nil, true},
+		{"0", nil, true},
+		{"ten", nil, true},
+	} {
+		got, err := parsePeriod(tc.v)
+		if (err != nil) != tc.wantErr || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parsePeriod(%q) = %v, %v, want %v, error %v", tc.v, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+func TestPartialMergeStats(t *testing.T) {
+	ui := &progressUI{}
+	o := setDefaults(&plugin.Options{Fetch: testFetcher{}, Obj: testObj{}, Sym: testSymbolizer{}, UI: ui})
+	s := &source{Sources: []string{"cpu", "cpu", "missing", "cpu"}, NoSave: true}
+	if _, err := fetchProfiles(context.Background(), s, o); err != nil {
+		t.Fatalf("fetchProfiles: %v", err)
+	}
+	// Each CPU profile has 1.12s of samples.
+	want := "fetched 3 profiles out of 4: 4 samples, 3.36s cpu; about 1.12s (25%) missing from failed sources"
+	var found bool
+	for _, msg := range ui.msgs {
+		found = found || msg == want
+	}
+	if !found {
+		t.Errorf("got messages %q, want %q", ui.msgs, want)
+	}
+}
+
+func TestStrictFetch(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		const n, chunkSize = 10, 2
+		s := &source{StrictFetch: strict}
+		sources := []profileSource{{addr: "bad", source: s, scale: 1}}
+		for i := 1; i < n; i++ {
+			sources = append(sources, profileSource{addr: "cpu", source: s, scale: 1})
+		}
+		f := &timedFetcher{}
+		ignore := 1 // The failure is reported.
+		if strict {
+			ignore = 0
+		}
+		_, _, _, count, err := chunkedGrab(context.Background(), sources, chunkSize, f, testObj{}, &proftest.TestUI{T: t, Ignore: ignore})
+		if !strict {
+			if err != nil || count != n-1 {
+				t.Errorf("chunkedGrab: got %d profiles, error %v, want %d profiles", count, err, n-1)
+			}
+			continue
+		}
+		if err == nil || !strings.HasPrefix(err.Error(), "bad: ") {
+			t.Errorf("strict chunkedGrab: got error %v, want failure of bad", err)
+		}
+		// The remaining chunks are not fetched.
+		if len(f.starts) > chunkSize {
+			t.Errorf("strict chunkedGrab: got %d fetches, want at most %d", len(f.starts), chunkSize)
+		}
+	}
+
+	o := setDefaults(&plugin.Options{
+		Fetch: testFetcher{},
+		Obj:   testObj{},
+		Sym:   testSymbolizer{},
+		// The failure and the fetched count are reported.
+		UI: &proftest.TestUI{T: t, Ignore: 2},
+	})
+	if _, err := fetchProfiles(context.Background(), &source{Sources: []string{"cpu", "bad"}, NoSave: true}, o); err != nil {
+		t.Errorf("fetchProfiles: %v", err)
+	}
+	if _, err := fetchProfiles(context.Background(), &source{Sources: []string{"cpu", "bad"}, NoSave: true, StrictFetch: true}, o); err == nil {
+		t.Errorf("strict fetchProfiles: want error")
+	}
+}
+
+// peakFetcher is a fetcher that records the peak number of concurrent
+// calls to Fetch.
+type peakFetcher struct {
+	mu           sync.Mutex
+	active, peak int
+}
+
+func (f *peakFetcher) Fetch(s string, d, t time.Duration) (*profile.Profile, string, error) {
+	f.mu.Lock()
+	f.active++
+	if f.active > f.peak {
+		f.peak = f.active
+	}
+	f.mu.Unlock()
+
+	time.Sleep(5 * time.Millisecond)
+
+	f.mu.Lock()
+	f.active--
+	f.mu.Unlock()
+	return testFetcher{}.Fetch(s, d, t)
+}
+
+func TestFetchProgress(t *testing.T) {
+	savedInterval := progressInterval
+	defer func() { progressInterval = savedInterval }()
+
+	if p := newFetchProgress(&proftest.TestUI{T: t}, 10); p != nil {
+		t.Errorf("newFetchProgress: want no progress reports on a non-interactive UI")
+	}
+
+	ui := &progressUI{}
+	p := newFetchProgress(ui, 5)
+	progressInterval = time.Hour
+	p.done()
+	progressInterval = 0
+	p.done()
+	p.done()
+	progressInterval = time.Hour
+	p.done()
+	progressInterval = 0
+	p.done()
+
+	want := []string{"fetched 2/5 profiles", "fetched 3/5 profiles"}
+	if !reflect.DeepEqual(ui.msgs, want) {
+		t.Errorf("progress reports: got %q, want %q", ui.msgs, want)
+	}
+}
+
+// progressUI is an interactive UI recording the messages printed to it.
+type progressUI struct {
+	proftest.TestUI
+	msgs []string
+}
+
+func (ui *progressUI) PrintErr(args ...interface{}) {
+	ui.msgs = append(ui.msgs, fmt.Sprint(args...))
+}
+
+func (ui *progressUI) IsTerminal() bool {
+	return true
+}
+
+func TestConvertPerfDataErrors(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("stub converter is a shell script")
+	}
+	dir, err := ioutil.TempDir("", "pprof-converter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	missing := filepath.Join(dir, "missing_converter")
+	if _, err := convertPerfData("perf.data", missing, false, &proftest.TestUI{T: t}); err == nil || !strings.Contains(err.Error(), missing) {
+		t.Errorf("convertPerfData with missing converter: got error %v, want error naming %s", err, missing)
+	}
+
+	failing := filepath.Join(dir, "failing_converter")
+	script := "#!/bin/sh\necho 'unsupported perf.data version' >&2\nexit 1\n"
+	if err := ioutil.WriteFile(failing, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := convertPerfData("perf.data", failing, false, &proftest.TestUI{T: t}); err == nil || !strings.Contains(err.Error(), "unsupported perf.data version") {
+		t.Errorf("convertPerfData with failing converter: got error %v, want converter stderr", err)
+	}
+}
+
+func TestConvertPerfDataStdout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("stub converter is a shell script")
+	}
+	dir, err := ioutil.TempDir("", "pprof-converter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data, err := filepath.Abs("testdata/cppbench.cpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		desc, script string
+		wantErr      string
+	}{
+		{"streaming", "[ \"$2\" = - ] || exit 2\ncat " + data + "\n", ""},
+		{"failing", "echo partial\necho 'out of memory' >&2\nexit 1\n", "out of memory"},
+	} {
+		converter := filepath.Join(dir, tc.desc+"_converter")
+		if err := ioutil.WriteFile(converter, []byte("#!/bin/sh\n"+tc.script), 0755); err != nil {
+			t.Fatal(err)
+		}
+		r, err := convertPerfData("perf.data", converter, true, &proftest.TestUI{T: t})
+		if err != nil {
+			t.Fatalf("%s: convertPerfData: %v", tc.desc, err)
+		}
+		p, err := profile.Parse(r)
+		r.Close()
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("%s: got error %v, want error containing %q", tc.desc, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: profile.Parse: %v", tc.desc, err)
+		}
+		if len(p.Sample) == 0 {
+			t.Errorf("%s: want non-zero samples", tc.desc)
+		}
+	}
+}
+
+func TestIsPerfFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pprof-perf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		header string
+		want   bool
+	}{
+		{"PERFILE2\x68\x00\x00\x00", true},
+		{"2ELIFREP\x00\x00\x00\x68", true},
+		{"PERFFILE\x68\x00\x00\x00", true},
+		{"ELIFFREP\x00\x00\x00\x68", true},
+		{"PERFILE", false},
+		{"PERFILE3\x68\x00\x00\x00", false},
+		{"\x1f\x8b\x08\x00\x00\x00\x00\x00", false},
+		{"", false},
+	} {
+		path := filepath.Join(dir, "perf.data")
+		if err := ioutil.WriteFile(path, []byte(tc.header), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got := isPerfFile(path); got != tc.want {
+			t.Errorf("isPerfFile(%q) = %v, want %v", tc.header, got, tc.want)
+		}
+	}
+	if isPerfFile(filepath.Join(dir, "missing")) {
+		t.Errorf("isPerfFile of missing file = true, want false")
+	}
+}
+
+func TestConvertJFR(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("stub converter is a shell script")
+	}
+	dir, err := ioutil.TempDir("", "pprof-jfr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data, err := filepath.Abs("testdata/cppbench.cpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	converter := filepath.Join(dir, "jfr_converter")
+	script := "#!/bin/sh\nhead -c 4 \"$1\" | grep -q FLR || exit 2\ncp " + data + " \"$2\"\n"
+	if err := ioutil.WriteFile(converter, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	jfr := filepath.Join(dir, "recording.jfr")
+	if err := ioutil.WriteFile(jfr, []byte("FLR\x00\x00\x02\x00\x00"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &source{JFRConverter: converter}
+	p, _, _, err := fetch(context.Background(), jfr, 0, 0, s, &proftest.TestUI{T: t})
+	if err != nil {
+		t.Fatalf("fetch JFR file: %v", err)
+	}
+	if len(p.Sample) == 0 {
+		t.Errorf("fetch JFR file: want non-zero samples")
+	}
+
+	// Other files are not passed to the converter.
+	s.JFRConverter = filepath.Join(dir, "missing_converter")
+	if _, _, _, err := fetch(context.Background(), data, 0, 0, s, &proftest.TestUI{T: t}); err != nil {
+		t.Errorf("fetch profile with missing JFR converter: %v", err)
+	}
+	if _, _, _, err := fetch(context.Background(), jfr, 0, 0, s, &proftest.TestUI{T: t}); err == nil || !strings.Contains(err.Error(), "missing_converter") {
+		t.Errorf("fetch JFR file with missing converter: got error %v, want error naming the converter", err)
+	}
+}
+
+func TestIsJFRFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pprof-jfr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		header string
+		want   bool
+	}{
+		{"FLR\x00\x00\x02\x00\x00", true},
+		{"FLR\x00", true},
+		{"FLR", false},
+		{"FLR\x01\x00\x02\x00\x00", false},
+		{"PERFILE2\x68\x00\x00\x00", false},
+		{"", false},
+	} {
+		path := filepath.Join(dir, "recording.jfr")
+		if err := ioutil.WriteFile(path, []byte(tc.header), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got := isJFRFile(path); got != tc.want {
+			t.Errorf("isJFRFile(%q) = %v, want %v", tc.header, got, tc.want)
+		}
+	}
+	if isJFRFile(filepath.Join(dir, "missing")) {
+		t.Errorf("isJFRFile of missing file = true, want false")
+	}
+}
+
+func TestConvertTrace(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("stub converter is a shell script")
+	}
+	dir, err := ioutil.TempDir("", "pprof-trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data, err := filepath.Abs("testdata/cppbench.cpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	converter := filepath.Join(dir, "trace_converter")
+	script := "#!/bin/sh\nhead -c 16 \"$1\" | grep -q 'go 1.22 trace' || exit 2\ncp " + data + " \"$2\"\n"
+	if err := ioutil.WriteFile(converter, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	trace := filepath.Join(dir, "trace.out")
+	if err := ioutil.WriteFile(trace, []byte("go 1.22 trace\x00\x00\x00\x01\x02"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &source{TraceConverter: converter}
+	p, _, _, err := fetch(context.Background(), trace, 0, 0, s, &proftest.TestUI{T: t})
+	if err != nil {
+		t.Fatalf("fetch trace: %v", err)
+	}
+	if len(p.Sample) == 0 {
+		t.Errorf("fetch trace: want non-zero samples")
+	}
+
+	// Other files are not passed to the converter.
+	s.TraceConverter = filepath.Join(dir, "missing_converter")
+	if _, _, _, err := fetch(context.Background(), data, 0, 0, s, &proftest.TestUI{T: t}); err != nil {
+		t.Errorf("fetch profile with missing trace converter: %v", err)
+	}
+	if _, _, _, err := fetch(context.Background(), trace, 0, 0, s, &proftest.TestUI{T: t}); err == nil || !strings.Contains(err.Error(), "missing_converter") {
+		t.Errorf("fetch trace with missing converter: got error %v, want error naming the converter", err)
+	}
+}
+
+func TestIsTraceFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pprof-trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		header string
+		want   bool
+	}{
+		{"go 1.22 trace\x00\x00\x00\x01", true},
+		{"go 1.5 trace\x00\x00\x00\x00", true},
+		{"go 1.22 trace", false},
+		{"go 1.22 tracer\x00\x00", false},
+		{"go 1.22 profile\x00", false},
+		{"FLR\x00\x00\x02\x00\x00", false},
+		{"", false},
+	} {
+		path := filepath.Join(dir, "trace.out")
+		if err := ioutil.WriteFile(path, []byte(tc.header), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got := isTraceFile(path); got != tc.want {
+			t.Errorf("isTraceFile(%q) = %v, want %v", tc.header, got, tc.want)
+		}
+	}
+	if isTraceFile(filepath.Join(dir, "missing")) {
+		t.Errorf("isTraceFile of missing file = true, want false")
+	}
+}
+
+func TestSourceLabels(t *testing.T) {
+	s := &source{SourceLabels: true}
+	sources := []profileSource{
+		{addr: "http://host:8000/cpu", source: s, scale: 1},
+		{addr: "cpu", source: s, scale: 1},
+		{addr: "cpu", source: s, scale: -1},
+	}
+	p, _, _, _, err := chunkedGrab(context.Background(), sources, 0, testFetcher{}, testObj{}, &proftest.TestUI{T: t})
+	if err != nil {
+		t.Fatalf("chunkedGrab: %v", err)
+	}
+
+	got := make(map[string]int64)
+	for _, s := range p.Sample {
+		got[strings.Join(s.Label[sourceLabelKey], ",")] += s.Value[0]
+	}
+	var total int64
+	for _, s := range cpuProfile().Sample {
+		total += s.Value[0]
+	}
+	want := map[string]int64{"host:8000": total, "cpu": total, "": -total}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sample values by source: got %v, want %v", got, want)
+	}
+}
+
+func TestSourceScales(t *testing.T) {
+	o := setDefaults(&plugin.Options{
+		Fetch: testFetcher{},
+		Obj:   testObj{},
+		Sym:   testSymbolizer{},
+		UI:    &proftest.TestUI{T: t, Ignore: 1},
+	})
+	s := &source{
+		Sources:    []string{"cpu", "cpu"},
+		Scales:     []float64{0.5, 1.5},
+		Base:       []string{"cpu"},
+		BaseScales: []float64{-0.25},
+	}
+	p, err := fetchProfiles(context.Background(), s, o)
+	if err != nil {
+		t.Fatalf("fetchProfiles: %v", err)
+	}
+
+	var got, want int64
+	for _, s := range p.Sample {
+		got += s.Value[1]
+	}
+	for _, scale := range []float64{0.5, 1.5, -0.25} {
+		scaled := cpuProfile()
+		scaled.Scale(scale)
+		for _, s := range scaled.Sample {
+			want += s.Value[1]
+		}
+	}
+	if got != want {
+		t.Errorf("fetchProfiles: got total %d, want %d", got, want)
+	}
+
+	for _, bad := range []*source{
+		{Sources: []string{"cpu", "cpu"}, Scales: []float64{0.5}},
+		{Sources: []string{"cpu"}, Base: []string{"cpu"}, BaseScales: []float64{-1, -1}},
+	} {
+		if _, err := fetchProfiles(context.Background(), bad, o); err == nil {
+			t.Errorf("fetchProfiles(%v): want error for mismatched scale factors", bad)
+		}
+	}
+}
+
+func TestSavedName(t *testing.T) {
+	withBinary := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "samples"}, {Type: "cpu"}},
+		Mapping:    []*profile.Mapping{{File: "/usr/bin/server"}},
+	}
+	noBinary := &profile.Profile{SampleType: []*profile.ValueType{{Type: "inuse_space"}}}
+	heap := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "alloc_objects"}, {Type: "alloc_space"}, {Type: "inuse_objects"}, {Type: "inuse_space"}},
+		Mapping:    []*profile.Mapping{{File: "/usr/bin/app"}},
+	}
+	repeated := &profile.Profile{SampleType: []*profile.ValueType{{Type: "cpu", Unit: "nanoseconds"}, {Type: "cpu", Unit: "count"}}}
+	for _, tc := range []struct {
+		p             *profile.Profile
+		template, tag string
+		want          string
+	}{
+		{withBinary, "", "", "pprof.server.samples.cpu."},
+		{noBinary, "", "", "pprof.inuse_space."},
+		{withBinary, "", "abc123", "pprof.server.samples.cpu.abc123."},
+		{withBinary, "pprof.{binary}.{tag}", "exp/1 ../x", "pprof.server.exp_1_._x."},
+		{noBinary, "pprof.{tag}.{binary}.{types}", "..", "pprof.inuse_space."},
+		{withBinary, "run-{tag}.", "a:b", "run-a_b."},
+		{heap, "", "", "pprof.app.alloc_objects.alloc_space.+2."},
+		{repeated, "", "", "pprof.cpu."},
+	} {
+		if got := savedName(tc.template, tc.tag, tc.p); got != tc.want {
+			t.Errorf("savedName(%q, %q) = %q, want %q", tc.template, tc.tag, got, tc.want)
+		}
+	}
+}
+
+func TestFetchComments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pprof")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("PPROF_TMPDIR", os.Getenv("PPROF_TMPDIR"))
+	os.Setenv("PPROF_TMPDIR", dir)
+
+	o := setDefaults(&plugin.Options{
+		Fetch: testFetcher{},
+		Obj:   testObj{},
+		Sym:   testSymbolizer{},
+		// The base cancels out the profile, which is reported along
+		// with the saved profile.
+		UI: &proftest.TestUI{T: t, Ignore: 4},
+	})
+	for _, enabled := range []bool{true, false} {
+		s := &source{
+			Sources:       []string{"cpu"},
+			Base:          []string{"cpu"},
+			Seconds:       30,
+			Timeout:       60,
+			FetchComments: enabled,
+		}
+		if _, err := fetchProfiles(context.Background(), s, o); err != nil {
+			t.Fatalf("fetchProfiles: %v", err)
+		}
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, "pprof.*.pb.gz"))
+	if err != nil || len(names) != 2 {
+		t.Fatalf("got saved profiles %v, %v, want 2", names, err)
+	}
+	var saved [][]string
+	for _, name := range names {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := profile.Parse(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("parsing %s: %v", name, err)
+		}
+		saved = append(saved, p.Comments)
+	}
+
+	want := []string{"Source: cpu", "Base: cpu", "Seconds: 30", "Timeout: 60s"}
+	if got := saved[0]; len(got) != len(want)+1 || !reflect.DeepEqual(got[:len(want)], want) {
+		t.Errorf("got comments %q, want %q followed by the fetch time", got, want)
+	} else if !strings.HasPrefix(got[len(want)], "Fetched at: ") {
+		t.Errorf("got comment %q, want the fetch time", got[len(want)])
+	}
+	if got := saved[1]; len(got) != 0 {
+		t.Errorf("got comments %q with fetch_comments disabled, want none", got)
+	}
+}
+
+func TestFetchCommentsCredentials(t *testing.T) {
+	savedHTTPGet := httpGet
+	defer func() { httpGet = savedHTTPGet }()
+	httpGet = getURL
+
+	dir, err := ioutil.TempDir("", "pprof")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("PPROF_TMPDIR", os.Getenv("PPROF_TMPDIR"))
+	os.Setenv("PPROF_TMPDIR", dir)
+
+	data, err := ioutil.ReadFile("testdata/cppbench.cpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "user" || password != "s3cret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Write(data)
+	}))
+	defer ts.Close()
+
+	// Sources without a scheme are fetched as http URLs, so their
+	// credentials must be left out too.
+	host := strings.TrimPrefix(ts.URL, "http://")
+	s := &source{
+		Sources:             []string{"http://user:s3cret@" + host + "/profile", "user:s3cret@" + host + "/other"},
+		Seconds:             -1,
+		Timeout:             -1,
+		MaxDecompressedSize: defaultMaxDecompressedSize,
+		FetchComments:       true,
+	}
+	o := setDefaults(&plugin.Options{Obj: testObj{}, Sym: testSymbolizer{}, UI: &proftest.TestUI{T: t, Ignore: 1}})
+	if _, err := fetchProfiles(context.Background(), s, o); err != nil {
+		t.Fatalf("fetchProfiles: %v", err)
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, "pprof.*.pb.gz"))
+	if err != nil || len(names) != 1 {
+		t.Fatalf("got saved profiles %v, %v, want 1", names, err)
+	}
+	f, err := os.Open(names[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := profile.Parse(f)
+	f.Close()
+	if err != nil {
+		t.Fatalf("parsing %s: %v", names[0], err)
+	}
+	want := []string{"Source: " + ts.URL + "/profile", "Source: " + host + "/other"}
+	if got := p.Comments; len(got) < len(want) || !reflect.DeepEqual(got[:len(want)], want) {
+		t.Errorf("got comments %q, want %q", got, want)
+	}
+	for _, c := range p.Comments {
+		if strings.Contains(c, "s3cret") {
+			t.Errorf("saved comment %q has the credentials", c)
+		}
+	}
+}
+
+func TestNoSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pprof")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("PPROF_TMPDIR", os.Getenv("PPROF_TMPDIR"))
+	os.Setenv("PPROF_TMPDIR", dir)
+
+	o := setDefaults(&plugin.Options{
+		Fetch: testFetcher{},
+		Obj:   testObj{},
+		Sym:   testSymbolizer{},
+		UI:    &proftest.TestUI{T: t},
+	})
+	s := &source{Sources: []string{"http://host:8000/cpu"}, NoSave: true}
+	p, err := fetchProfiles(context.Background(), s, o)
+	if err != nil {
+		t.Fatalf("fetchProfiles: %v", err)
+	}
+	if len(p.Sample) == 0 {
+		t.Errorf("fetchProfiles: want non-zero samples")
+	}
+	if names, _ := filepath.Glob(filepath.Join(dir, "*")); len(names) != 0 {
+		t.Errorf("fetchProfiles with NoSave saved %v", names)
+	}
+}
+
+func TestFetchEvents(t *testing.T) {
+	var mu sync.Mutex
+	events := make(map[string][]*plugin.FetchEvent)
+	o := &plugin.Options{
+		Fetch:  testFetcher{},
+		Obj:    testObj{},
+		Sym:    testSymbolizer{},
+		UI:     &proftest.TestUI{T: t, Ignore: 2},
+		NoSave: true,
+		FetchEvents: func(e *plugin.FetchEvent) {
+			mu.Lock()
+			defer mu.Unlock()
+			events[e.Source] = append(events[e.Source], e)
+		},
+	}
+	if _, err := FetchProfiles(context.Background(), []string{"cpu", "missing"}, o); err != nil {
+		t.Fatalf("FetchProfiles: %v", err)
+	}
+	for _, tc := range []struct {
+		source string
+		want   []plugin.FetchEventKind
+	}{
+		{"cpu", []plugin.FetchEventKind{plugin.FetchStarted, plugin.FetchSucceeded}},
+		{"missing", []plugin.FetchEventKind{plugin.FetchStarted, plugin.FetchFailed}},
+	} {
+		var got []plugin.FetchEventKind
+		for _, e := range events[tc.source] {
+			got = append(got, e.Kind)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got events %v, want %v", tc.source, got, tc.want)
+			continue
+		}
+		switch e := events[tc.source][1]; e.Kind {
+		case plugin.FetchSucceeded:
+			if e.Bytes <= 0 || e.Err != nil {
+				t.Errorf("%s: got %d bytes and error %v, want bytes and no error", tc.source, e.Bytes, e.Err)
+			}
+		case plugin.FetchFailed:
+			if e.Err == nil || !strings.Contains(e.Err.Error(), "unexpected source") {
+				t.Errorf("%s: got error %v, want unexpected source", tc.source, e.Err)
+			}
+		}
+	}
+}
+
+func TestInMemory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pprof")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("PPROF_TMPDIR", os.Getenv("PPROF_TMPDIR"))
+	os.Setenv("PPROF_TMPDIR", dir)
+	defer os.Setenv("PPROF_CACHE_DIR", os.Getenv("PPROF_CACHE_DIR"))
+	os.Setenv("PPROF_CACHE_DIR", "")
+
+	baseVars := pprofVariables
+	pprofVariables = baseVars.makeCopy()
+	defer func() { pprofVariables = baseVars }()
+
+	f := baseFlags()
+	f.bools["in_memory"] = true
+	f.ints["cache_ttl"] = 3600
+	f.args = []string{"http://host:8000/cpu"}
+	o := setDefaults(&plugin.Options{
+		Flagset: f,
+		Fetch:   testFetcher{},
+		Obj:     testObj{},
+		Sym:     testSymbolizer{},
+		UI:      &proftest.TestUI{T: t},
+	})
+	s, _, err := parseFlags(o)
+	if err != nil {
+		t.Fatalf("parseFlags: %v", err)
+	}
+	if !s.InMemory || s.Cache != nil {
+		t.Errorf("parseFlags: got InMemory %v and cache %v, want in memory and no cache", s.InMemory, s.Cache)
+	}
+	p, err := fetchProfiles(context.Background(), s, o)
+	if err != nil {
+		t.Fatalf("fetchProfiles: %v", err)
+	}
+	if len(p.Sample) == 0 {
+		t.Errorf("fetchProfiles: want non-zero samples")
+	}
+	if names, _ := filepath.Glob(filepath.Join(dir, "*")); len(names) != 0 {
+		t.Errorf("fetchProfiles in memory wrote %v", names)
+	}
+}
+
+func TestUnwritableTmpDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pprof")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	readOnly := filepath.Join(dir, "readonly")
+	if err := os.Mkdir(readOnly, 0555); err != nil {
+		t.Fatal(err)
+	}
+	notDir := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(notDir, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	saveHTTPGet := httpGet
+	defer func() { httpGet = saveHTTPGet }()
+	httpGet = func(ctx context.Context, source string, timeout time.Duration, opts httpOptions) (*http.Response, error) {
+		t.Errorf("fetched %s with an unwritable temp dir", source)
+		return stubHTTPGet(ctx, source, timeout, opts)
+	}
+	defer os.Setenv("PPROF_TMPDIR", os.Getenv("PPROF_TMPDIR"))
+
+	o := setDefaults(&plugin.Options{
+		Obj: testObj{},
+		Sym: testSymbolizer{},
+		UI:  &proftest.TestUI{T: t},
+	})
+	s := &source{Sources: []string{"http://localhost/profile?file=cppbench.cpu"}}
+	for _, tmpDir := range []string{readOnly, notDir} {
+		if tmpDir == readOnly {
+			// Permissions are not enforced for some users, eg root.
+			if f, err := ioutil.TempFile(readOnly, "probe"); err == nil {
+				f.Close()
+				continue
+			}
+		}
+		os.Setenv("PPROF_TMPDIR", tmpDir)
+		if _, err := fetchProfiles(context.Background(), s, o); err == nil || !strings.Contains(err.Error(), "cannot save profiles") {
+			t.Errorf("fetchProfiles with PPROF_TMPDIR=%s: got error %v, want cannot save profiles", tmpDir, err)
+		}
+	}
+}
+
+func TestTmpDirs(t *testing.T) {
+	for _, env := range []string{"XDG_CACHE_HOME", "HOME", "PPROF_TMPDIR"} {
+		defer os.Setenv(env, os.Getenv(env))
+	}
+	os.Setenv("HOME", "/home/user")
+	for _, tc := range []struct {
+		goos, cache string
+		want        []string
+	}{
+		{"linux", "/home/user/.cache", []string{"/home/user/.cache/pprof", "/home/user/pprof", os.TempDir()}},
+		{"linux", "", []string{"/home/user/pprof", os.TempDir()}},
+		{"darwin", "/home/user/.cache", []string{"/home/user/pprof", os.TempDir()}},
+		{"windows", "/home/user/.cache", []string{"/home/user/pprof", os.TempDir()}},
+	} {
+		os.Setenv("XDG_CACHE_HOME", tc.cache)
+		if got := tmpDirs(tc.goos); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("tmpDirs(%s) with XDG_CACHE_HOME=%q: got %v, want %v", tc.goos, tc.cache, got, tc.want)
+		}
+	}
+
+	if runtime.GOOS != "linux" {
+		t.Skip("XDG_CACHE_HOME is only used on Linux")
+	}
+	dir, err := ioutil.TempDir("", "pprof-xdg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("PPROF_TMPDIR", "")
+	os.Setenv("HOME", filepath.Join(dir, "home"))
+	for _, cache := range []string{filepath.Join(dir, "cache"), ""} {
+		os.Setenv("XDG_CACHE_HOME", cache)
+		want := filepath.Join(dir, "home", "pprof")
+		if cache != "" {
+			want = filepath.Join(cache, "pprof")
+		}
+		got, err := setTmpDir(&proftest.TestUI{T: t})
+		if err != nil || got != want {
+			t.Errorf("setTmpDir with XDG_CACHE_HOME=%q: got %s, %v, want %s", cache, got, err, want)
+		}
+		if fi, err := os.Stat(want); err != nil || !fi.IsDir() {
+			t.Errorf("setTmpDir with XDG_CACHE_HOME=%q did not create %s: %v", cache, want, err)
+		}
+	}
+}
+
+func TestFetchStdin(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/go.crc32.cpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	go func() {
+		w.Write(data)
+		w.Close()
+	}()
+	defer func(stdin *os.File) { os.Stdin = stdin }(os.Stdin)
+	os.Stdin = r
+
+	p, msrc, remote, err := grabProfile(context.Background(), &source{}, "-", 1, nil, testObj{}, &proftest.TestUI{T: t})
+	if err != nil {
+		t.Fatalf("grabProfile(-): %v", err)
+	}
+	if len(p.Sample) == 0 {
+		t.Errorf("grabProfile(-): want non-zero samples")
+	}
+	if remote || len(msrc) != 0 {
+		t.Errorf("grabProfile(-): got remote %v, mapping sources %v, want a local profile", remote, msrc)
+	}
+
+	for _, s := range []*source{
+		{Sources: []string{"-", "-"}},
+		{Sources: []string{"-"}, Base: []string{"-"}},
+	} {
+		if _, err := profileSources(s, &proftest.TestUI{T: t}); err == nil {
+			t.Errorf("profileSources(%v): want error for multiple stdin sources", s)
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	saveHTTPGet := httpGet
+	defer func() { httpGet = saveHTTPGet }()
+	httpGet = func(_ context.Context, source string, _ time.Duration, _ httpOptions) (*http.Response, error) {
+		t.Errorf("fetched %s in dry run", source)
+		return nil, fmt.Errorf("unexpected fetch")
+	}
+
+	ui := &printUI{TestUI: proftest.TestUI{T: t}}
+	o := setDefaults(&plugin.Options{UI: ui})
+	s := &source{
+		Sources:        []string{"host:8080/debug/pprof/profile", "http://slow/debug/pprof/profile?debug=1", "testdata/cppbench.cpu"},
+		Base:           []string{"http://host:8080/debug/pprof/profile?seconds=5"},
+		Seconds:        30,
+		Timeout:        -1,
+		SourceTimeouts: map[string]int{"http://slow/debug/pprof/profile?debug=1": 120},
+		DryRun:         true,
+	}
+	p, err := fetchProfiles(context.Background(), s, o)
+	if err != nil || p != nil {
+		t.Fatalf("fetchProfiles in dry run: got %v, %v, want no profile", p, err)
+	}
+	want := []string{
+		"http://host:8080/debug/pprof/profile?seconds=30 (timeout 45s)",
+		"http://slow/debug/pprof/profile?debug=1&seconds=30 (timeout 2m0s)",
+		"testdata/cppbench.cpu (local)",
+		"http://host:8080/debug/pprof/profile?seconds=30 (timeout 45s)",
+	}
+	if !reflect.DeepEqual(ui.msgs, want) {
+		t.Errorf("fetchProfiles in dry run printed %q, want %q", ui.msgs, want)
+	}
+}
+
+// printUI is a UI recording the messages printed to its output.
+type printUI struct {
+	proftest.TestUI
+	msgs []string
+}
+
+func (ui *printUI) Print(args ...interface{}) {
+	ui.msgs = append(ui.msgs, fmt.Sprint(args...))
+}
+
+func TestSourceTimeouts(t *testing.T) {
+	saveHTTPGet := httpGet
+	defer func() { httpGet = saveHTTPGet }()
+	var mu sync.Mutex
+	timeouts := make(map[string]time.Duration)
+	httpGet = func(ctx context.Context, source string, timeout time.Duration, opts httpOptions) (*http.Response, error) {
+		u, err := url.Parse(source)
+		if err != nil {
+			return nil, err
+		}
+		mu.Lock()
+		timeouts[u.Host] = timeout
+		mu.Unlock()
+		return stubHTTPGet(ctx, source, timeout, opts)
+	}
+
+	sources := []string{
+		"http://fast/profile?file=cppbench.cpu",
+		"http://slow/profile?file=cppbench.cpu",
+	}
+	for _, tc := range []struct {
+		desc    string
+		seconds int
+		timeout int
+		want    map[string]time.Duration
+	}{
+		{
+			desc:    "default timeout",
+			seconds: -1,
+			timeout: -1,
+			want:    map[string]time.Duration{"fast": 60 * time.Second, "slow": 300 * time.Second},
+		},
+		{
+			desc:    "default timeout from duration",
+			seconds: 10,
+			timeout: -1,
+			want:    map[string]time.Duration{"fast": 15 * time.Second, "slow": 300 * time.Second},
+		},
+		{
+			desc:    "global timeout",
+			seconds: -1,
+			timeout: 5,
+			want:    map[string]time.Duration{"fast": 5 * time.Second, "slow": 300 * time.Second},
+		},
+	} {
+		s := &source{
+			Seconds:        tc.seconds,
+			Timeout:        tc.timeout,
+			SourceTimeouts: map[string]int{sources[1]: 300},
+		}
+		for _, src := range sources {
+			if _, _, _, err := grabProfile(context.Background(), s, src, 1, nil, testObj{}, &proftest.TestUI{T: t}); err != nil {
+				t.Fatalf("%s: grabProfile(%s): %v", tc.desc, src, err)
+			}
+		}
+		if !reflect.DeepEqual(timeouts, tc.want) {
+			t.Errorf("%s: got timeouts %v, want %v", tc.desc, timeouts, tc.want)
+		}
+	}
+}
+
+func TestParseSourceTimeouts(t *testing.T) {
+	for _, tc := range []struct {
+		values  []string
+		want    map[string]int
+		wantErr bool
+	}{
+		{values: nil, want: nil},
+		{values: []string{""}, want: nil},
+		{
+			values: []string{"localhost:8080=30", "http://host/profile?seconds=5=120"},
+			want:   map[string]int{"localhost:8080": 30, "http://host/profile?seconds=5": 120},
+		},
+		{values: []string{"localhost:8080"}, wantErr: true},
+		{values: []string{"=30"}, wantErr: true},
+		{values: []string{"localhost:8080=0"}, wantErr: true},
+		{values: []string{"localhost:8080=soon"}, wantErr: true},
+	} {
+		var values []*string
+		for i := range tc.values {
+			values = append(values, &tc.values[i])
+		}
+		got, err := parseSourceTimeouts(values)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("parseSourceTimeouts(%q): got error %v, want error %v", tc.values, err, tc.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseSourceTimeouts(%q) = %v, want %v", tc.values, got, tc.want)
+		}
+	}
+}
+
+func TestParseMappingFiles(t *testing.T) {
+	for _, tc := range []struct {
+		values  []string
+		want    map[string]string
+		wantErr bool
+	}{
+		{values: nil, want: nil},
+		{values: []string{""}, want: nil},
+		{
+			values: []string{"/old/path/app=/new/path/app", "/lib/libc.so=/tmp/libc.so", "/old/path/app=/new/path/app"},
+			want:   map[string]string{"/old/path/app": "/new/path/app", "/lib/libc.so": "/tmp/libc.so"},
+		},
+		{values: []string{"/old/path/app=/new/path/app", "/old/path/app=/other/app"}, wantErr: true},
+		{values: []string{"/old/path/app"}, wantErr: true},
+		{values: []string{"=/new/path/app"}, wantErr: true},
+		{values: []string{"/old/path/app="}, wantErr: true},
+	} {
+		var values []*string
+		for i := range tc.values {
+			values = append(values, &tc.values[i])
+		}
+		got, err := parseMappingFiles(values)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("parseMappingFiles(%q): got error %v, want error %v", tc.values, err, tc.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseMappingFiles(%q) = %v, want %v", tc.values, got, tc.want)
+		}
+	}
+}
+
+func TestMappingFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pprof-binaries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// debugObj reads the build id of each file from its contents.
+	matching, stale := filepath.Join(dir, "app"), filepath.Join(dir, "app.old")
+	for name, buildID := range map[string]string{matching: "abcde10008", stale: "abcde10007"} {
+		if err := ioutil.WriteFile(name, []byte(buildID), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, env := range []string{"PPROF_BINARY_PATH", "PPROF_SYMBOL_SERVER", "DEBUGINFOD_URLS"} {
+		defer os.Setenv(env, os.Getenv(env))
+	}
+	os.Setenv("PPROF_BINARY_PATH", filepath.Join(dir, "missing"))
+	os.Setenv("PPROF_SYMBOL_SERVER", "")
+	os.Setenv("DEBUGINFOD_URLS", "")
+
+	for _, tc := range []struct {
+		desc     string
+		binary   string
+		force    bool
+		want     string
+		msgCount int
+	}{
+		{"matching build id", matching, false, matching, 0},
+		{"mismatched build id", stale, false, "/old/path/app", 1},
+		{"forced", stale, true, stale, 0},
+		{"missing binary", filepath.Join(dir, "missing"), false, "/old/path/app", 1},
+	} {
+		p := &profile.Profile{
+			Mapping: []*profile.Mapping{{File: "/old/path/app", BuildID: "abcde10008"}},
+		}
+		s := &source{MappingFiles: map[string]string{"/old/path/app": tc.binary}, ForceMappingFiles: tc.force}
+		locateBinaries(p, s, "", binarySearchPath(), debugObj{}, &proftest.TestUI{T: t, Ignore: tc.msgCount})
+		if got := p.Mapping[0].File; got != tc.want {
+			t.Errorf("%s: got file %s, want %s", tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestStripPaths(t *testing.T) {
+	// Move the sources of the test profile under a home directory.
+	const project = "/home/alice/secret-project/"
+	move := func(source string, p *profile.Profile) error {
+		for _, fn := range p.Function {
+			fn.Filename = project + fn.Filename
+		}
+		p.Function[0].Filename = "/home/alice/notes/file1000.src"
+		p.Function[1].Filename = "/home/alice2/file2000.src"
+		return nil
+	}
+	o := setDefaults(&plugin.Options{Fetch: testFetcher{}, Obj: testObj{}, Sym: testSymbolizer{}, UI: &proftest.TestUI{T: t}})
+	s := &source{
+		Sources:    []string{"cpu"},
+		Transform:  move,
+		StripPaths: []pathPrefix{{"/home/alice/secret-project", ""}, {"/home/alice", "~"}},
+		NoPrune:    true,
+		NoSave:     true,
+	}
+	p, err := fetchProfiles(context.Background(), s, o)
+	if err != nil {
+		t.Fatalf("fetchProfiles: %v", err)
+	}
+	// Merging reorders functions and locations, so compare them by
+	// name and address.
+	want := cpuProfile()
+	want.Function[0].Filename = "~/notes/file1000.src"
+	want.Function[1].Filename = "/home/alice2/file2000.src"
+	files := make(map[string]string)
+	for _, fn := range want.Function {
+		files[fn.Name] = fn.Filename
+	}
+	for _, fn := range p.Function {
+		if fn.Filename != files[fn.Name] || fn.SystemName != fn.Name {
+			t.Errorf("function %s: got file %s, want %s", fn.Name, fn.Filename, files[fn.Name])
+		}
+	}
+	lines := make(map[uint64]string)
+	for _, l := range want.Location {
+		lines[l.Address] = fmt.Sprint(len(l.Line))
+		for _, ln := range l.Line {
+			lines[l.Address] += fmt.Sprintf(" %s:%d", ln.Function.Name, ln.Line)
+		}
+	}
+	for _, l := range p.Location {
+		got := fmt.Sprint(len(l.Line))
+		for _, ln := range l.Line {
+			got += fmt.Sprintf(" %s:%d", ln.Function.Name, ln.Line)
+		}
+		if got != lines[l.Address] {
+			t.Errorf("location %#x: got lines %s, want %s", l.Address, got, lines[l.Address])
+		}
+	}
+}
+
+func TestParseStripPaths(t *testing.T) {
+	str := func(s string) *string { return &s }
+	got, err := parseStripPaths([]*string{str("/home/alice/src/"), str(""), str("/home/alice=~")})
+	if err != nil {
+		t.Fatalf("parseStripPaths: %v", err)
+	}
+	if want := []pathPrefix{{"/home/alice/src", ""}, {"/home/alice", "~"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("parseStripPaths: got %v, want %v", got, want)
+	}
+	for _, bad := range []string{"=~", "/"} {
+		if _, err := parseStripPaths([]*string{str(bad)}); err == nil {
+			t.Errorf("parseStripPaths(%q): want error", bad)
+		}
+	}
+}
+
+func TestParseBinaryDigests(t *testing.T) {
+	digest := strings.Repeat("ab", 32)
+	for _, tc := range []struct {
+		values  []string
+		want    map[string]string
+		wantErr bool
+	}{
+		{values: nil, want: nil},
+		{values: []string{""}, want: nil},
+		{
+			values: []string{"abcde10008=" + strings.ToUpper(digest), "app=" + digest},
+			want:   map[string]string{"abcde10008": digest, "app": digest},
+		},
+		{values: []string{"app=" + digest, "app=" + strings.Repeat("cd", 32)}, wantErr: true},
+		{values: []string{"app"}, wantErr: true},
+		{values: []string{"=" + digest}, wantErr: true},
+		{values: []string{"app=abcd"}, wantErr: true},
+		{values: []string{"app=" + strings.Repeat("zz", 32)}, wantErr: true},
+	} {
+		var values []*string
+		for i := range tc.values {
+			values = append(values, &tc.values[i])
+		}
+		got, err := parseBinaryDigests(values)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("parseBinaryDigests(%q): got error %v, want error %v", tc.values, err, tc.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseBinaryDigests(%q) = %v, want %v", tc.values, got, tc.want)
+		}
+	}
+}
+
+func TestBinaryDigests(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pprof-binaries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// debugObj reads the build id of each file from its contents.
+	const buildID = "abcde10009"
+	if err := ioutil.WriteFile(filepath.Join(dir, "app"), []byte(buildID), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte(buildID))
+	digest, other := hex.EncodeToString(sum[:]), strings.Repeat("00", 32)
+	for _, env := range []string{"PPROF_BINARY_PATH", "PPROF_SYMBOL_SERVER", "DEBUGINFOD_URLS"} {
+		defer os.Setenv(env, os.Getenv(env))
+	}
+	os.Setenv("PPROF_BINARY_PATH", dir)
+	os.Setenv("PPROF_SYMBOL_SERVER", "")
+	os.Setenv("DEBUGINFOD_URLS", "")
+
+	for _, tc := range []struct {
+		desc     string
+		digests  map[string]string
+		want     string
+		msgCount int
+	}{
+		{"no digest", nil, filepath.Join(dir, "app"), 0},
+		{"matching build id digest", map[string]string{buildID: digest}, filepath.Join(dir, "app"), 0},
+		{"matching base name digest", map[string]string{"app": digest}, filepath.Join(dir, "app"), 0},
+		{"mismatching digest", map[string]string{buildID: other}, "/old/path/app", 1},
+		{"build id digest first", map[string]string{buildID: other, "app": digest}, "/old/path/app", 1},
+		{"other binary", map[string]string{"lib.so": other}, filepath.Join(dir, "app"), 0},
+	} {
+		p := &profile.Profile{
+			Mapping: []*profile.Mapping{{File: "/old/path/app", BuildID: buildID}},
+		}
+		ui := &proftest.TestUI{T: t, Ignore: tc.msgCount}
+		locateBinaries(p, &source{BinaryDigests: tc.digests}, "", binarySearchPath(), debugObj{}, ui)
+		if got := p.Mapping[0].File; got != tc.want {
+			t.Errorf("%s: got file %s, want %s", tc.desc, got, tc.want)
+		}
+	}
+
+	// Binaries given with -mapping_file are checked as well.
+	p := &profile.Profile{
+		Mapping: []*profile.Mapping{{File: "/old/path/app", BuildID: buildID}},
+	}
+	s := &source{
+		MappingFiles:  map[string]string{"/old/path/app": filepath.Join(dir, "app")},
+		BinaryDigests: map[string]string{"app": other},
+	}
+	locateBinaries(p, s, "", binarySearchPath(), debugObj{}, &proftest.TestUI{T: t, Ignore: 2})
+	if got := p.Mapping[0].File; got != "/old/path/app" {
+		t.Errorf("mapping file: got file %s, want /old/path/app", got)
+	}
+}
+
+func TestDuplicateSources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pprof")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("PPROF_TMPDIR", os.Getenv("PPROF_TMPDIR"))
+	os.Setenv("PPROF_TMPDIR", dir)
+
+	saveHTTPGet := httpGet
+	defer func() { httpGet = saveHTTPGet }()
+	var mu sync.Mutex
+	var fetches []string
+	httpGet = func(ctx context.Context, source string, timeout time.Duration, opts httpOptions) (*http.Response, error) {
+		mu.Lock()
+		fetches = append(fetches, source)
+		mu.Unlock()
+		return stubHTTPGet(ctx, source, timeout, opts)
+	}
+
+	const profileURL = "http://localhost/profile?file=cppbench.cpu"
+	s := &source{
+		Sources: []string{
+			profileURL,
+			profileURL,
+			"http://localhost/profile/?file=cppbench.cpu",
+		},
+		Base: []string{profileURL, profileURL},
+	}
+	o := setDefaults(&plugin.Options{
+		Obj: testObj{},
+		Sym: testSymbolizer{},
+		// Three duplicates are dropped, the cancelled out samples are
+		// reported, and the profile is saved.
+		UI: &proftest.TestUI{T: t, Ignore: 5},
+	})
+	p, err := fetchProfiles(context.Background(), s, o)
+	if err != nil {
+		t.Fatalf("fetchProfiles: %v", err)
+	}
+	// The source and its base are fetched once each, so they cancel out.
+	if len(fetches) != 2 {
+		t.Errorf("got fetches %v, want one for the source and one for the base", fetches)
+	}
+	for _, sample := range p.Sample {
+		for _, v := range sample.Value {
+			if v != 0 {
+				t.Fatalf("got sample %v, want base to cancel out the source", sample)
+			}
+		}
+	}
+}
+
+func TestZeroSamplesWarning(t *testing.T) {
+	const warning = "all sample values are zero after merging"
+	for _, tc := range []struct {
+		desc     string
+		s        *source
+		wantWarn string
+	}{
+		{"profile", &source{Sources: []string{"cpu"}, NoSave: true}, ""},
+		{"profile against itself as base", &source{Sources: []string{"cpu"}, Base: []string{"cpu"}, NoSave: true}, "-base profile"},
+		{"scale of 0", &source{Sources: []string{"cpu"}, Scales: []float64{0}, NoSave: true}, "-scale factor of 0"},
+	} {
+		ui := &progressUI{}
+		o := setDefaults(&plugin.Options{
+			Fetch: testFetcher{},
+			Obj:   testObj{},
+			Sym:   testSymbolizer{},
+			UI:    ui,
+		})
+		p, err := fetchProfiles(context.Background(), tc.s, o)
+		if err != nil {
+			t.Fatalf("%s: fetchProfiles: %v", tc.desc, err)
+		}
+		if p == nil {
+			t.Fatalf("%s: fetchProfiles returned no profile", tc.desc)
+		}
+		var got string
+		for _, msg := range ui.msgs {
+			if strings.HasPrefix(msg, warning) {
+				got = msg
+			}
+		}
+		switch {
+		case tc.wantWarn == "" && got != "":
+			t.Errorf("%s: got unexpected warning %q", tc.desc, got)
+		case tc.wantWarn != "" && !strings.Contains(got, tc.wantWarn):
+			t.Errorf("%s: got warnings %q, want %q... mentioning %q", tc.desc, ui.msgs, warning, tc.wantWarn)
+		}
+	}
+}
+
+func TestClockSkew(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		desc     string
+		offsets  []time.Duration
+		wantWarn bool
+	}{
+		{"same time", []time.Duration{0, time.Minute}, false},
+		{"an hour apart", []time.Duration{time.Hour, 0}, true},
+	} {
+		var profiles []*profile.Profile
+		for _, offset := range tc.offsets {
+			p := cpuProfile()
+			p.TimeNanos = start.Add(offset).UnixNano()
+			profiles = append(profiles, p)
+		}
+		ui := &progressUI{}
+		p, _, err := combineProfiles(profiles, nil, nil, nil, ui)
+		if err != nil {
+			t.Fatalf("%s: combineProfiles: %v", tc.desc, err)
+		}
+		if got := len(ui.msgs) > 0 && strings.Contains(ui.msgs[0], "inconsistent clocks"); got != tc.wantWarn || len(ui.msgs) > 1 {
+			t.Errorf("%s: got warnings %q, want clock warning: %v", tc.desc, ui.msgs, tc.wantWarn)
+		}
+		if want := start.UnixNano(); p.TimeNanos != want {
+			t.Errorf("%s: got merged time %v, want earliest %v", tc.desc, time.Unix(0, p.TimeNanos).UTC(), start)
+		}
+	}
+}
+
+func TestDefaultSampleTypeConflict(t *testing.T) {
+	heap := func(defaultType string) *profile.Profile {
+		p := cpuProfile()
+		p.SampleType = []*profile.ValueType{
+			{Type: "alloc_space", Unit: "bytes"},
+			{Type: "inuse_space", Unit: "bytes"},
+		}
+		for _, s := range p.Sample {
+			s.Value = []int64{s.Value[0], s.Value[0]}
+		}
+		p.DefaultSampleType = defaultType
+		return p
+	}
+	for _, tc := range []struct {
+		desc     string
+		types    []string
+		want     string
+		wantWarn bool
+	}{
+		{"same type", []string{"inuse_space", "inuse_space"}, "inuse_space", false},
+		{"unset type", []string{"", "alloc_space"}, "alloc_space", false},
+		{"alloc first", []string{"alloc_space", "inuse_space"}, "alloc_space", true},
+		{"inuse first", []string{"inuse_space", "", "alloc_space"}, "inuse_space", true},
+	} {
+		var profiles []*profile.Profile
+		for _, typ := range tc.types {
+			profiles = append(profiles, heap(typ))
+		}
+		ui := &progressUI{}
+		p, _, err := combineProfiles(profiles, nil, nil, nil, ui)
+		if err != nil {
+			t.Fatalf("%s: combineProfiles: %v", tc.desc, err)
+		}
+		if p.DefaultSampleType != tc.want {
+			t.Errorf("%s: got default sample type %q, want %q", tc.desc, p.DefaultSampleType, tc.want)
+		}
+		if got := len(ui.msgs) > 0 && strings.Contains(ui.msgs[0], "different default sample types"); got != tc.wantWarn || len(ui.msgs) > 1 {
+			t.Errorf("%s: got warnings %q, want sample type warning: %v", tc.desc, ui.msgs, tc.wantWarn)
+		}
+	}
+}
+
+func TestIncompatibleSampleTypes(t *testing.T) {
+	o := setDefaults(&plugin.Options{Fetch: testFetcher{}, Obj: testObj{}, UI: &proftest.TestUI{T: t}})
+	_, err := fetchProfiles(context.Background(), &source{Sources: []string{"cpu", "heap", "cpu"}, NoSave: true}, o)
+	if err == nil {
+		t.Fatal("fetchProfiles: want error merging cpu and heap profiles")
+	}
+	want := "cannot merge profiles with different sample types: [samples/count,cpu/milliseconds] from cpu, [inuse_objects/count,inuse_space/bytes] from heap"
+	if got := err.Error(); got != want {
+		t.Errorf("fetchProfiles: got error %q, want %q", got, want)
+	}
+
+	// Sample types differing only in units are merged.
+	p1, p2 := cpuProfile(), cpuProfile()
+	p2.SampleType[1].Unit = "microseconds"
+	if _, _, err := combineProfiles([]*profile.Profile{p1, p2}, nil, nil, nil, nil); err != nil {
+		t.Errorf("combineProfiles: %v", err)
+	}
+}
+
+func TestFetchTimings(t *testing.T) {
+	saveHTTPGet := httpGet
+	defer func() { httpGet = saveHTTPGet }()
+	const delay = 100 * time.Millisecond
+	httpGet = func(ctx context.Context, source string, timeout time.Duration, opts httpOptions) (*http.Response, error) {
+		if strings.Contains(source, "slow") {
+			time.Sleep(delay)
+		}
+		return stubHTTPGet(ctx, source, timeout, opts)
+	}
+
+	const fast, slow = "http://fast/profile?file=cppbench.cpu", "http://slow/profile?file=cppbench.cpu"
+	ui := &progressUI{}
+	o := setDefaults(&plugin.Options{Obj: testObj{}, Sym: testSymbolizer{}, UI: ui})
+	s := &source{Sources: []string{fast, slow}, NoSave: true, FetchTimings: true}
+	if _, err := fetchProfiles(context.Background(), s, o); err != nil {
+		t.Fatalf("fetchProfiles: %v", err)
+	}
+	var report string
+	for _, msg := range ui.msgs {
+		if strings.HasPrefix(msg, "Fetch timings") {
+			report = msg
+		}
+	}
+	lines := strings.Split(report, "\n")
+	if len(lines) != 3 || !strings.HasSuffix(lines[1], slow) || !strings.HasSuffix(lines[2], fast) {
+		t.Fatalf("got timings %q, want %s then %s", report, slow, fast)
+	}
+
+	// The recorded durations match the delay of each source.
+	sources := []profileSource{
+		{addr: fast, source: s, scale: 1},
+		{addr: slow, source: s, scale: 1},
+	}
+	if err := concurrentFetch(context.Background(), sources, nil, testObj{}, ui, nil); err != nil {
+		t.Fatalf("concurrentFetch: %v", err)
+	}
+	if got := sources[0].elapsed; got <= 0 || got >= delay {
+		t.Errorf("%s: got elapsed %v, want less than %v", fast, got, delay)
+	}
+	if got := sources[1].elapsed; got < delay || got > 10*delay {
+		t.Errorf("%s: got elapsed %v, want about %v", slow, got, delay)
+	}
+
+	// Time-based profiles separate the time spent collecting them.
+	timed := profileSource{addr: slow + "&seconds=30", source: &source{Seconds: -1}, remote: true, elapsed: 31 * time.Second}
+	if got := collectionTime(timed); got != 30*time.Second {
+		t.Errorf("collectionTime(%s) = %v, want 30s", timed.addr, got)
+	}
+	timed.source.Seconds = 10
+	if got := collectionTime(timed); got != 10*time.Second {
+		t.Errorf("collectionTime(%s) with -seconds=10 = %v, want 10s", timed.addr, got)
+	}
+}
+
+func TestFetchErrors(t *testing.T) {
+	var got []*plugin.FetchError
+	o := setDefaults(&plugin.Options{
+		Fetch: testFetcher{},
+		Obj:   testObj{},
+		Sym:   testSymbolizer{},
+		// Each failure is printed, along with the fetched count and
+		// the saved profile.
+		UI: &proftest.TestUI{T: t, Ignore: 5},
+		FetchErrors: func(errs []*plugin.FetchError) {
+			got = append(got, errs...)
+		},
+	})
+
+	s := &source{Sources: []string{"bad1", "cpu", "bad2"}}
+	if _, err := fetchProfiles(context.Background(), s, o); err != nil {
+		t.Fatalf("fetchProfiles: %v", err)
+	}
+	s = &source{Sources: []string{"bad3"}}
+	if _, err := fetchProfiles(context.Background(), s, o); err == nil {
+		t.Errorf("fetchProfiles: want error when no profile is fetched")
+	}
+
+	want := []string{"bad1", "bad2", "bad3"}
+	if len(got) != len(want) {
+		t.Fatalf("got fetch errors %v, want errors for %v", got, want)
+	}
+	for i, err := range got {
+		if err.Source != want[i] {
+			t.Errorf("got fetch error for %s, want %s", err.Source, want[i])
+		}
+		if msg := "unexpected source: " + want[i]; err.Err == nil || err.Err.Error() != msg {
+			t.Errorf("%s: got underlying error %v, want %q", err.Source, err.Err, msg)
+		}
+	}
+}
+
+func TestFetchSeparateProfiles(t *testing.T) {
+	o := setDefaults(&plugin.Options{
+		Fetch: testFetcher{},
+		Obj:   testObj{},
+		Sym:   testSymbolizer{},
+		UI:    &proftest.TestUI{T: t, Ignore: 2},
+	})
+	// Profiles with different sample types cannot be merged, but can
+	// be kept separate.
+	s := &source{Sources: []string{"cpu", "heap", "bad"}}
+	datasets, err := fetchSeparateProfiles(context.Background(), s, o)
+	if err != nil {
+		t.Fatalf("fetchSeparateProfiles: %v", err)
+	}
+	if len(datasets) != 2 {
+		t.Fatalf("fetchSeparateProfiles: got %d datasets, want 2", len(datasets))
+	}
+	for i, want := range []string{"cpu", "heap"} {
+		if got := datasets[i].addr; got != want {
+			t.Errorf("dataset %d: got source %s, want %s", i, got, want)
+		}
+	}
+	if want := heapProfile().SampleType[0].Type; datasets[1].p.SampleType[0].Type != want {
+		t.Errorf("dataset 1: got sample type %s, want %s", datasets[1].p.SampleType[0].Type, want)
+	}
+
+	// The merged profile leaves the datasets unchanged.
+	datasets[1] = datasets[0]
+	merged, err := mergeDatasets(datasets, nil, nil)
+	if err != nil {
+		t.Fatalf("mergeDatasets: %v", err)
+	}
+	if merged == datasets[0].p || merged.Sample[0].Value[0] != 2*datasets[0].p.Sample[0].Value[0] {
+		t.Errorf("mergeDatasets: want a new profile adding up the datasets")
+	}
+
+	// Datasets differing only in units are scaled to merge.
+	micros := dataset{"cpu_us", datasets[0].p.Copy()}
+	micros.p.SampleType[1].Unit = "microseconds"
+	if _, err := mergeDatasets([]dataset{datasets[0], micros}, nil, nil); err != nil {
+		t.Errorf("mergeDatasets of milliseconds and microseconds: %v", err)
+	}
+	if micros.p.SampleType[1].Unit != "microseconds" {
+		t.Errorf("mergeDatasets: changed the units of a dataset to %s", micros.p.SampleType[1].Unit)
+	}
+}
+
+func TestFetchBraceSources(t *testing.T) {
+	s := &source{Sources: []string{"host:8080/debug/pprof/{profile,heap,goroutine}"}, NoSave: true}
+	if !hasBraces(s.Sources) {
+		t.Errorf("hasBraces(%q) = false, want true", s.Sources)
+	}
+	o := setDefaults(&plugin.Options{Fetch: endpointFetcher{}, Obj: testObj{}, Sym: testSymbolizer{}, UI: &proftest.TestUI{T: t}})
+	datasets, err := fetchSeparateProfiles(context.Background(), s, o)
+	if err != nil {
+		t.Fatalf("fetchSeparateProfiles: %v", err)
+	}
+	var got []string
+	for _, d := range datasets {
+		got = append(got, d.addr+" "+d.p.SampleType[len(d.p.SampleType)-1].Type)
+	}
+	want := []string{
+		"host:8080/debug/pprof/profile cpu",
+		"host:8080/debug/pprof/heap inuse_space",
+		"host:8080/debug/pprof/goroutine goroutine",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got datasets %q, want %q", got, want)
+	}
+	// Profiles of different types are never merged, and the error
+	// names the datasets.
+	_, err = mergeDatasets(datasets, nil, nil)
+	if want := "from host:8080/debug/pprof/heap"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("mergeDatasets: got error %v, want one naming %q", err, want)
+	}
+}
+
+// endpointFetcher is a fetcher serving a profile of the type named by
+// the last path element of each source.
+type endpointFetcher struct{}
+
+func (endpointFetcher) Fetch(s string, d, t time.Duration) (*profile.Profile, string, error) {
+	switch path.Base(s) {
+	case "profile":
+		return cpuProfile(), "", nil
+	case "heap":
+		return heapProfile(), "", nil
+	case "goroutine":
+		p := cpuProfile()
+		p.SampleType = []*profile.ValueType{{Type: "goroutine", Unit: "count"}}
+		p.PeriodType, p.Period = nil, 0
+		for _, s := range p.Sample {
+			s.Value = s.Value[:1]
+		}
+		return p, "", nil
+	}
+	return nil, "", fmt.Errorf("unexpected source: %s", s)
+}
+
+func TestFetchURLContentType(t *testing.T) {
+	savedHTTPGet := httpGet
+	defer func() { httpGet = savedHTTPGet }()
+	httpGet = getURL
+
+	profileData, err := ioutil.ReadFile("testdata/cppbench.cpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			fmt.Fprint(w, "<html><title>Sign in</title>\n<body>...</body></html>\n")
+		case "/profile":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write(profileData)
+		case "/untyped":
+			w.Header()["Content-Type"] = nil
+			w.Write(profileData)
+		}
+	}))
+	defer ts.Close()
+
+	_, _, err = fetchURL(context.Background(), ts.URL+"/login", time.Second, 0, 0, httpOptions{})
+	if err == nil || !strings.Contains(err.Error(), "HTML") || !strings.Contains(err.Error(), "<title>Sign in</title>") {
+		t.Errorf("fetchURL of HTML page: got error %v, want error with the first line of the page", err)
+	}
+
+	for _, path := range []string{"/profile", "/untyped"} {
+		body, _, err := fetchURL(context.Background(), ts.URL+path, time.Second, 0, 0, httpOptions{})
+		if err != nil {
+			t.Errorf("fetchURL(%s, nil): %v", path, err)
+			continue
+		}
+		p, err := profile.Parse(body)
+		body.Close()
+		if err != nil || len(p.Sample) == 0 {
+			t.Errorf("fetchURL(%s, nil): got profile %v, error %v, want samples", path, p, err)
+		}
+	}
+}
+
+func TestDecompressProfile(t *testing.T) {
+	gzipped := func(data []byte) []byte {
+		var b bytes.Buffer
+		gz := gzip.NewWriter(&b)
+		gz.Write(data)
+		gz.Close()
+		return b.Bytes()
+	}
+	raw := []byte("not a gzip stream")
+	single := gzipped(raw)
+	double := gzipped(single)
+	// A small stream decompressing to 64MiB of zeroes.
+	bomb := gzipped(make([]byte, 64<<20))
+
+	for _, tc := range []struct {
+		desc    string
+		data    []byte
+		maxSize int64
+		want    []byte
+		wantErr string
+	}{
+		{"plain", raw, 0, raw, ""},
+		{"single gzip", single, 0, raw, ""},
+		{"double gzip", double, 0, raw, ""},
+		{"truncated gzip", single[:5], 0, nil, "decompressing profile"},
+		{"within limit", double, int64(len(single)), raw, ""},
+		{"over limit", single, int64(len(raw)) - 1, nil, "exceeds max size"},
+		{"nested over limit", gzipped(bomb), 1 << 20, nil, "exceeds max size"},
+		{"bomb", bomb, 1 << 20, nil, "exceeds max size"},
+	} {
+		got, err := decompressProfile(tc.data, tc.maxSize)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("%s: decompressProfile() error %v, want %q", tc.desc, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(got, tc.want) {
+			t.Errorf("%s: decompressProfile() = %q, %v, want %q", tc.desc, got, err, tc.want)
+		}
+	}
+	if len(bomb) > 1<<20 {
+		t.Errorf("bomb fixture is %d bytes, want a highly compressible one", len(bomb))
+	}
+}
+
+func TestMaxDecompressedSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pprof-bomb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A valid profile padded with a long comment, which compresses to
+	// a small file.
+	p := cpuProfile()
+	p.Comments = []string{strings.Repeat("x", 4<<20)}
+	name := filepath.Join(dir, "cpu.pb.gz")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Write(f); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	for _, tc := range []struct {
+		maxSize int64
+		wantErr bool
+	}{
+		{0, false},
+		{defaultMaxDecompressedSize, false},
+		{1 << 20, true},
+	} {
+		o := setDefaults(&plugin.Options{Obj: testObj{}, Sym: testSymbolizer{}, UI: &proftest.TestUI{T: t, Ignore: 1}})
+		_, err := fetchProfiles(context.Background(), &source{Sources: []string{name}, MaxDecompressedSize: tc.maxSize, NoSave: true}, o)
+		if gotErr := err != nil; gotErr != tc.wantErr {
+			t.Errorf("MaxDecompressedSize=%d: got error %v, want error %v", tc.maxSize, err, tc.wantErr)
+		}
+	}
+}
+
+func TestSaveFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pprof")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A write failing midway must leave no file behind.
+	_, err = saveFile(dir, "pprof.", ".pb.gz", func(w io.Writer) error {
+		if _, err := w.Write([]byte("partial")); err != nil {
+			return err
+		}
+		return fmt.Errorf("write failed")
+	})
+	if err == nil || !strings.Contains(err.Error(), "write failed") {
+		t.Fatalf("saveFile() with failing write got error %v, want write failed", err)
+	}
+	if names, _ := filepath.Glob(filepath.Join(dir, "*")); len(names) != 0 {
+		t.Errorf("saveFile() with failing write left files %v", names)
+	}
+
+	for _, want := range []string{"pprof.001.pb.gz", "pprof.002.pb.gz"} {
+		name, err := saveFile(dir, "pprof.", ".pb.gz", func(w io.Writer) error {
+			_, err := w.Write([]byte("complete"))
+			return err
+		})
+		if err != nil {
+			t.Fatalf("saveFile(): %v", err)
+		}
+		if got := filepath.Base(name); got != want {
+			t.Errorf("saveFile() created %s, want %s", got, want)
+		}
+		if data, err := ioutil.ReadFile(name); err != nil || string(data) != "complete" {
+			t.Errorf("saved file contains %q, %v, want %q", data, err, "complete")
+		}
+	}
+	if names, _ := filepath.Glob(filepath.Join(dir, "*.tmp")); len(names) != 0 {
+		t.Errorf("saveFile() left temporary files %v", names)
+	}
+}
+
+// mappingSources creates MappingSources map with a single item.
+func mappingSources(key, source string, start uint64) plugin.MappingSources {
+	return plugin.MappingSources{
+		key: []plugin.MappingSource{
 			{Source: source, Start: start},
 		},
 	}
@@ -189,7 +4288,7 @@ func mappingSources(key, source string, start uint64) plugin.MappingSources {
 
 // stubHTTPGet intercepts a call to http.Get and rewrites it to use
 // "file://" to get the profile directly from a file.
-func stubHTTPGet(source string, _ time.Duration) (*http.Response, error) {
+func stubHTTPGet(_ context.Context, source string, _ time.Duration, _ httpOptions) (*http.Response, error) {
 	url, err := url.Parse(source)
 	if err != nil {
 		return nil, err
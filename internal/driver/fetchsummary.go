@@ -0,0 +1,110 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"encoding/json"
+
+	"github.com/google/pprof/internal/plugin"
+	"github.com/google/pprof/profile"
+)
+
+// fetchSummary is the JSON document written by -fetch_summary,
+// describing the result of fetching profiles for monitoring. Fields
+// may be added, but existing ones must keep their name and meaning.
+type fetchSummary struct {
+	Sources     []fetchSummarySource `json:"sources"`
+	SampleTypes []fetchSummaryType   `json:"sample_types"`
+}
+
+// fetchSummarySource describes the fetch of a single source. Bytes is
+// the size of the fetched profile in compressed protobuf format.
+type fetchSummarySource struct {
+	Source  string  `json:"source"`
+	OK      bool    `json:"ok"`
+	Error   string  `json:"error,omitempty"`
+	Bytes   int64   `json:"bytes"`
+	Seconds float64 `json:"seconds"`
+	Remote  bool    `json:"remote"`
+}
+
+// fetchSummaryType describes a sample type of the merged profile, with
+// the total of its values over all samples.
+type fetchSummaryType struct {
+	Type  string `json:"type"`
+	Unit  string `json:"unit"`
+	Total int64  `json:"total"`
+}
+
+// writeFetchSummary writes the summary of fetching sources, merged into
+// p, as JSON to the file name. p is nil if no profile was fetched.
+func writeFetchSummary(name string, sources []profileSource, p *profile.Profile, w plugin.Writer) error {
+	summary := fetchSummary{
+		Sources:     make([]fetchSummarySource, 0, len(sources)),
+		SampleTypes: []fetchSummaryType{},
+	}
+	for _, s := range sources {
+		ss := fetchSummarySource{
+			Source:  stripUserinfo(s.addr),
+			OK:      s.err == nil,
+			Bytes:   s.size,
+			Seconds: s.elapsed.Seconds(),
+			Remote:  s.remote || remoteSourceKey(s.addr) != "",
+		}
+		if s.err != nil {
+			ss.Error = s.err.Error()
+		}
+		summary.Sources = append(summary.Sources, ss)
+	}
+	if p != nil {
+		for i, st := range p.SampleType {
+			var total int64
+			for _, s := range p.Sample {
+				total += s.Value[i]
+			}
+			summary.SampleTypes = append(summary.SampleTypes, fetchSummaryType{st.Type, st.Unit, total})
+		}
+	}
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := w.Open(name)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// profileSize returns the size of p in compressed protobuf format.
+func profileSize(p *profile.Profile) int64 {
+	var c countingWriter
+	if err := p.Write(&c); err != nil {
+		return 0
+	}
+	return int64(c)
+}
+
+// countingWriter counts the bytes written to it, discarding them.
+type countingWriter int64
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	*c += countingWriter(len(b))
+	return len(b), nil
+}
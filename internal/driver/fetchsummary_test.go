@@ -0,0 +1,119 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/pprof/internal/plugin"
+	"github.com/google/pprof/internal/proftest"
+)
+
+func TestFetchSummary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pprof-summary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "summary.json")
+
+	o := setDefaults(&plugin.Options{
+		Fetch: testFetcher{},
+		Obj:   testObj{},
+		Sym:   testSymbolizer{},
+		// The failure and the fetched count are reported.
+		UI: &proftest.TestUI{T: t, Ignore: 2},
+	})
+	s := &source{
+		Sources:      []string{"http://host:8000/cpu", "bad"},
+		NoSave:       true,
+		FetchSummary: name,
+	}
+	if _, err := fetchProfiles(context.Background(), s, o); err != nil {
+		t.Fatalf("fetchProfiles: %v", err)
+	}
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatalf("reading summary: %v", err)
+	}
+
+	// Check the field names, which must not change.
+	var doc map[string]interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatalf("parsing summary: %v\n%s", err, data)
+	}
+	wantKeys := map[string][]string{
+		"":             {"sample_types", "sources"},
+		"sources":      {"bytes", "ok", "remote", "seconds", "source"},
+		"sample_types": {"total", "type", "unit"},
+	}
+	checkKeys := func(what string, v interface{}) {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			t.Fatalf("%s: got %T, want object", what, v)
+		}
+		var keys []string
+		for k := range m {
+			if k != "error" {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		if !reflect.DeepEqual(keys, wantKeys[what]) {
+			t.Errorf("%s: got fields %v, want %v", what, keys, wantKeys[what])
+		}
+	}
+	checkKeys("", doc)
+	for _, what := range []string{"sources", "sample_types"} {
+		for _, v := range doc[what].([]interface{}) {
+			checkKeys(what, v)
+		}
+	}
+
+	var summary fetchSummary
+	if err := json.Unmarshal(data, &summary); err != nil {
+		t.Fatalf("parsing summary: %v", err)
+	}
+	if len(summary.Sources) != 2 {
+		t.Fatalf("got %d sources, want 2", len(summary.Sources))
+	}
+	if got := summary.Sources[0]; got.Source != s.Sources[0] || !got.OK || got.Error != "" || got.Bytes <= 0 || !got.Remote {
+		t.Errorf("got summary %+v for %s, want fetched remote profile", got, s.Sources[0])
+	}
+	if got := summary.Sources[1]; got.Source != "bad" || got.OK || !strings.Contains(got.Error, "unexpected source") || got.Bytes != 0 || got.Remote {
+		t.Errorf("got summary %+v for bad, want local failure", got)
+	}
+
+	p := cpuProfile()
+	var want []fetchSummaryType
+	for i, st := range p.SampleType {
+		var total int64
+		for _, s := range p.Sample {
+			total += s.Value[i]
+		}
+		want = append(want, fetchSummaryType{st.Type, st.Unit, total})
+	}
+	if !reflect.DeepEqual(summary.SampleTypes, want) {
+		t.Errorf("got sample types %+v, want %+v", summary.SampleTypes, want)
+	}
+}
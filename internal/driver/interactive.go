@@ -17,6 +17,7 @@ package driver
 import (
 	"fmt"
 	"io"
+	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
@@ -30,8 +31,15 @@ import (
 var commentStart = "//:" // Sentinel for comments on options
 var tailDigitsRE = regexp.MustCompile("[0-9]+$")
 
-// interactive starts a shell to read pprof commands.
-func interactive(p *profile.Profile, o *plugin.Options) error {
+// interactive starts a shell to read pprof commands. If datasets is
+// set, p is their merged profile, and the shell can switch between it
+// and each of the datasets. If the datasets cannot be merged, p is the
+// first of them, and there is no merged profile.
+func interactive(p *profile.Profile, datasets []dataset, s *source, o *plugin.Options) error {
+	merged := p
+	if len(datasets) > 0 && datasets[0].p == p {
+		merged = nil
+	}
 	// Enter command processing loop.
 	o.UI.SetAutoComplete(newCompleter(functionNames(p)))
 	pprofVariables.set("compact_labels", "true")
@@ -41,6 +49,9 @@ func interactive(p *profile.Profile, o *plugin.Options) error {
 	// graphs to be visualized simultaneously.
 	interactiveMode = true
 	shortcuts := profileShortcuts(p)
+	// The binary search path can be changed by binary_path for the
+	// rest of the session.
+	binPath := binarySearchPath()
 
 	greetings(p, o.UI)
 	for {
@@ -104,6 +115,24 @@ func interactive(p *profile.Profile, o *plugin.Options) error {
 			case "help":
 				commandHelp(strings.Join(tokens[1:], " "), o.UI)
 				continue
+			case "symbolize":
+				if err := resymbolize(p, s, binPath, o); err != nil {
+					o.UI.PrintErr(err)
+				}
+				continue
+			case "binary_path":
+				binPath = binaryPath(tokens[1:], binPath, o.UI)
+				continue
+			case "datasets":
+				listDatasets(datasets, p, merged, o.UI)
+				continue
+			case "dataset":
+				if d := selectDataset(tokens[1:], datasets, merged, o.UI); d != nil {
+					p = d
+					o.UI.SetAutoComplete(newCompleter(functionNames(p)))
+					shortcuts = profileShortcuts(p)
+				}
+				continue
 			}
 
 			args, vars, err := parseCommandLine(tokens)
@@ -120,6 +149,93 @@ func interactive(p *profile.Profile, o *plugin.Options) error {
 
 var generateReportWrapper = generateReport // For testing purposes.
 
+// listDatasets prints the datasets that can be selected with the
+// dataset command, marking the current one.
+func listDatasets(datasets []dataset, current, merged *profile.Profile, ui plugin.UI) {
+	if len(datasets) == 0 {
+		ui.PrintErr("No datasets, use -keep_separate to fetch profiles separately")
+		return
+	}
+	mark := func(p *profile.Profile) string {
+		if p == current {
+			return "*"
+		}
+		return " "
+	}
+	lines := []string{fmt.Sprintf("%s all: merged profile", mark(merged))}
+	if merged == nil {
+		lines[0] = "  all: none, the profiles cannot be merged"
+	}
+	for i, d := range datasets {
+		lines = append(lines, fmt.Sprintf("%s %3d: %s", mark(d.p), i+1, d.addr))
+	}
+	ui.Print(strings.Join(lines, "\n"))
+}
+
+// selectDataset returns the profile selected by the arguments of the
+// dataset command, either a dataset number as shown by listDatasets or
+// "all" for the merged profile, if any. It returns nil on errors.
+func selectDataset(args []string, datasets []dataset, merged *profile.Profile, ui plugin.UI) *profile.Profile {
+	if len(datasets) == 0 {
+		ui.PrintErr("No datasets, use -keep_separate to fetch profiles separately")
+		return nil
+	}
+	if len(args) != 1 {
+		ui.PrintErr("usage: dataset <number|all>")
+		return nil
+	}
+	if args[0] == "all" {
+		if merged == nil {
+			ui.PrintErr("The profiles cannot be merged, select a dataset by number")
+		}
+		return merged
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 1 || n > len(datasets) {
+		ui.PrintErr(fmt.Sprintf("invalid dataset %q, want a number from 1 to %d or all", args[0], len(datasets)))
+		return nil
+	}
+	return datasets[n-1].p
+}
+
+// resymbolize locates the binaries for the profile mappings again,
+// searching searchPath, and symbolizes the profile in place, to pick up
+// binaries that have been made available since the profile was
+// fetched. Only local symbolization is possible, as the remote sources
+// of the mappings are no longer known.
+func resymbolize(p *profile.Profile, s *source, searchPath string, o *plugin.Options) error {
+	before := symbolizedLocations(p)
+	locateBinaries(p, s, "", searchPath, o.Obj, o.UI)
+	if err := symbolize(o.Sym, s, plugin.MappingSources{}, p); err != nil {
+		return err
+	}
+	o.UI.Print(fmt.Sprintf("Symbolized %d additional locations", symbolizedLocations(p)-before))
+	return nil
+}
+
+// symbolizedLocations returns the number of locations in a profile that
+// have symbol information.
+func symbolizedLocations(p *profile.Profile) int {
+	var n int
+	for _, l := range p.Location {
+		if len(l.Line) > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// binaryPath prints path, the search path used to locate binaries, or
+// returns the one in args for subsequent symbolize commands if one is
+// provided.
+func binaryPath(args []string, path string, ui plugin.UI) string {
+	if len(args) == 0 {
+		ui.Print(path)
+		return path
+	}
+	return strings.Join(args, string(filepath.ListSeparator))
+}
+
 // greetings prints a brief welcome and some overall profile
 // information before accepting interactive commands.
 func greetings(p *profile.Profile, ui plugin.UI) {
@@ -312,6 +428,10 @@ func commandHelp(args string, ui plugin.UI) {
 		help := usage(false)
 		help = help + `
   :   Clear focus/ignore/hide/tagfocus/tagignore
+  symbolize   Symbolize the profile again using binaries in the search path
+  binary_path Show or set the search path for binaries used by symbolize
+  datasets    List the profiles fetched separately with -keep_separate
+  dataset     Select a dataset by number, or all for the merged profile
 
   type "help <cmd|option>" for more information
 `
@@ -18,10 +18,12 @@ import (
 	"fmt"
 	"io"
 	"math/rand"
+	"os"
 	"strings"
 	"testing"
 
 	"github.com/google/pprof/internal/plugin"
+	"github.com/google/pprof/internal/proftest"
 	"github.com/google/pprof/internal/report"
 	"github.com/google/pprof/profile"
 )
@@ -43,13 +45,13 @@ func TestShell(t *testing.T) {
 	pprofVariables = testVariables(savedVariables)
 	o := setDefaults(nil)
 	o.UI = newUI(t, interleave(script, 0))
-	if err := interactive(p, o); err != nil {
+	if err := interactive(p, nil, &source{}, o); err != nil {
 		t.Error("first attempt:", err)
 	}
 	// Random interleave of independent scripts
 	pprofVariables = testVariables(savedVariables)
 	o.UI = newUI(t, interleave(script, 1))
-	if err := interactive(p, o); err != nil {
+	if err := interactive(p, nil, &source{}, o); err != nil {
 		t.Error("second attempt:", err)
 	}
 
@@ -58,7 +60,7 @@ func TestShell(t *testing.T) {
 	var scScript []string
 	pprofShortcuts, scScript = makeShortcuts(interleave(script, 2), 1)
 	o.UI = newUI(t, scScript)
-	if err := interactive(p, o); err != nil {
+	if err := interactive(p, nil, &source{}, o); err != nil {
 		t.Error("first shortcut attempt:", err)
 	}
 
@@ -66,14 +68,14 @@ func TestShell(t *testing.T) {
 	pprofVariables = testVariables(savedVariables)
 	pprofShortcuts, scScript = makeShortcuts(interleave(script, 1), 2)
 	o.UI = newUI(t, scScript)
-	if err := interactive(p, o); err != nil {
+	if err := interactive(p, nil, &source{}, o); err != nil {
 		t.Error("second shortcut attempt:", err)
 	}
 
 	// Verify propagation of IO errors
 	pprofVariables = testVariables(savedVariables)
 	o.UI = newUI(t, []string{"**error**"})
-	if err := interactive(p, o); err == nil {
+	if err := interactive(p, nil, &source{}, o); err == nil {
 		t.Error("expected IO error, got nil")
 	}
 
@@ -323,3 +325,81 @@ func TestInteractiveCommands(t *testing.T) {
 		}
 	}
 }
+
+func TestResymbolize(t *testing.T) {
+	m := &profile.Mapping{ID: 1, Start: 0x1000, Limit: 0x2000, File: "/bin/app"}
+	p := &profile.Profile{
+		Mapping: []*profile.Mapping{m},
+		Location: []*profile.Location{
+			{ID: 1, Mapping: m, Address: 0x1000},
+			{ID: 2, Mapping: m, Address: 0x1100},
+		},
+	}
+
+	o := setDefaults(nil)
+	o.UI = newUI(t, nil)
+	o.Obj = new(mockObjTool)
+	o.Sym = pathSymbolizer("/new/path")
+
+	savePath := os.Getenv("PPROF_BINARY_PATH")
+	path := binaryPath([]string{"/new/path"}, "/old/path", o.UI)
+	if want := "/new/path"; path != want {
+		t.Errorf("binary search path, want %s, got %s", want, path)
+	}
+	if got := os.Getenv("PPROF_BINARY_PATH"); got != savePath {
+		t.Errorf("binary_path changed PPROF_BINARY_PATH to %s", got)
+	}
+	if err := resymbolize(p, &source{}, path, o); err != nil {
+		t.Fatalf("resymbolize: %v", err)
+	}
+	if want := "/new/path/app"; m.File != want {
+		t.Errorf("mapping file, want %s, got %s", want, m.File)
+	}
+	if got, want := symbolizedLocations(p), 2; got != want {
+		t.Errorf("symbolized locations, want %d, got %d", want, got)
+	}
+}
+
+// pathSymbolizer symbolizes the locations of mappings whose file is
+// in a given directory.
+type pathSymbolizer string
+
+func (s pathSymbolizer) Symbolize(_ string, _ plugin.MappingSources, p *profile.Profile) error {
+	for _, l := range p.Location {
+		if strings.HasPrefix(l.Mapping.File, string(s)) {
+			l.Line = []profile.Line{{Function: &profile.Function{Name: "fn"}}}
+		}
+	}
+	return nil
+}
+
+func TestSelectDataset(t *testing.T) {
+	merged, a, b := &profile.Profile{}, &profile.Profile{}, &profile.Profile{}
+	datasets := []dataset{{"host1", a}, {"host2", b}}
+	for _, tc := range []struct {
+		args []string
+		want *profile.Profile
+	}{
+		{[]string{"all"}, merged},
+		{[]string{"1"}, a},
+		{[]string{"2"}, b},
+		{[]string{"0"}, nil},
+		{[]string{"3"}, nil},
+		{[]string{"host1"}, nil},
+		{nil, nil},
+	} {
+		ignore := 0
+		if tc.want == nil {
+			ignore = 1
+		}
+		if got := selectDataset(tc.args, datasets, merged, &proftest.TestUI{T: t, Ignore: ignore}); got != tc.want {
+			t.Errorf("selectDataset(%v): got %p, want %p", tc.args, got, tc.want)
+		}
+	}
+	if got := selectDataset([]string{"1"}, nil, merged, &proftest.TestUI{T: t, Ignore: 1}); got != nil {
+		t.Errorf("selectDataset without datasets: got %p, want nil", got)
+	}
+	if got := selectDataset([]string{"all"}, datasets, nil, &proftest.TestUI{T: t, Ignore: 1}); got != nil {
+		t.Errorf("selectDataset(all) without a merged profile: got %p, want nil", got)
+	}
+}
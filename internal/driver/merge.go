@@ -0,0 +1,70 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/google/pprof/internal/plugin"
+	"github.com/google/pprof/profile"
+)
+
+// mergeOnly merges the local profile files in s.Sources and writes the
+// result to s.MergeOnly through o.Writer, without locating binaries,
+// symbolizing or pruning the profiles.
+func mergeOnly(s *source, o *plugin.Options) error {
+	p, err := mergeFiles(s.Sources, s.MaxDecompressedSize)
+	if err != nil {
+		return err
+	}
+	w, err := o.Writer.Open(s.MergeOnly)
+	if err != nil {
+		return err
+	}
+	if err := p.Write(w); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	o.UI.PrintErr("Merged ", len(s.Sources), " profiles into ", s.MergeOnly)
+	return nil
+}
+
+// mergeFiles parses the profiles in the local files at paths and merges
+// them as combineProfiles does for fetched profiles. Profiles
+// decompressing to more than maxSize bytes, if positive, are refused.
+func mergeFiles(paths []string, maxSize int64) (*profile.Profile, error) {
+	profiles := make([]*profile.Profile, len(paths))
+	for i, path := range paths {
+		if sourceURL, _ := adjustURL(path, 0, 0); sourceURL != "" {
+			return nil, fmt.Errorf("%s: only local files can be merged with -merge_only", path)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if profiles[i], err = parseProfileData(data, maxSize); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if err := profiles[i].CheckValid(); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	p, _, err := combineProfiles(profiles, paths, nil, nil, nil)
+	return p, err
+}
@@ -0,0 +1,69 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/pprof/internal/plugin"
+	"github.com/google/pprof/internal/proftest"
+)
+
+func TestMergeOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pprof-merge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("PPROF_BINARY_PATH", os.Getenv("PPROF_BINARY_PATH"))
+	os.Setenv("PPROF_BINARY_PATH", dir)
+
+	paths := []string{"testdata/cppbench.cpu", "testdata/go.crc32.cpu"}
+	out := filepath.Join(dir, "merged.pb.gz")
+	s := &source{Sources: paths, MergeOnly: out, MaxDecompressedSize: defaultMaxDecompressedSize}
+	if err := mergeOnly(s, setDefaults(&plugin.Options{UI: &proftest.TestUI{T: t, Ignore: 1}})); err != nil {
+		t.Fatalf("mergeOnly: %v", err)
+	}
+	got, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The fetch path gives the same profile once symbolization and
+	// pruning are disabled.
+	o := setDefaults(&plugin.Options{UI: &proftest.TestUI{T: t}})
+	p, err := fetchProfiles(context.Background(), &source{Sources: paths, Symbolize: "none", NoPrune: true, NoSave: true, MaxDecompressedSize: defaultMaxDecompressedSize}, o)
+	if err != nil {
+		t.Fatalf("fetchProfiles: %v", err)
+	}
+	var want bytes.Buffer
+	if err := p.Write(&want); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want.Bytes()) {
+		t.Errorf("merge-only profile differs from the fetched one: got %d bytes, want %d", len(got), want.Len())
+	}
+
+	for _, bad := range [][]string{{"http://host:8000/cpu"}, {"testdata/cppbench.cpu", "testdata/missing.cpu"}} {
+		if _, err := mergeFiles(bad, 0); err == nil {
+			t.Errorf("mergeFiles(%v): want error", bad)
+		}
+	}
+}
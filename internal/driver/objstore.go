@@ -0,0 +1,65 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/pprof/internal/plugin"
+	"github.com/google/pprof/profile"
+)
+
+// objectStoreFetcher is a plugin.Fetcher reading profiles from object
+// stores, for sources of the form scheme://bucket/object with a scheme
+// registered in stores. Other sources are passed on to next, if set.
+type objectStoreFetcher struct {
+	stores map[string]plugin.ObjectStore
+	next   plugin.Fetcher
+}
+
+func (f *objectStoreFetcher) Fetch(src string, duration, timeout time.Duration) (*profile.Profile, string, error) {
+	if u, err := url.Parse(src); err == nil {
+		if store := f.stores[u.Scheme]; store != nil {
+			p, err := fetchObject(store, u)
+			if err != nil {
+				return nil, "", fmt.Errorf("fetch %s: %v", src, err)
+			}
+			// Objects are not served by the profiled program, so
+			// there is no source to use for remote symbolization.
+			return p, "", nil
+		}
+	}
+	if f.next == nil {
+		return nil, "", nil
+	}
+	return f.next.Fetch(src, duration, timeout)
+}
+
+// fetchObject reads a profile from the object named by u in store.
+func fetchObject(store plugin.ObjectStore, u *url.URL) (*profile.Profile, error) {
+	bucket, object := u.Host, strings.TrimPrefix(u.Path, "/")
+	if bucket == "" || object == "" {
+		return nil, fmt.Errorf("want %s://bucket/object", u.Scheme)
+	}
+	r, err := store.Open(bucket, object)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return profile.Parse(r)
+}
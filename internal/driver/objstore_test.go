@@ -0,0 +1,68 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/google/pprof/internal/plugin"
+)
+
+func TestObjectStoreFetcher(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/cppbench.cpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gs := fakeObjectStore{"profiles/prod/cpu.pb.gz": data}
+	f := setDefaults(&plugin.Options{
+		Fetch:        testFetcher{},
+		ObjectStores: map[string]plugin.ObjectStore{"gs": gs, "s3": fakeObjectStore{}},
+	}).Fetch
+
+	p, src, err := f.Fetch("gs://profiles/prod/cpu.pb.gz", 0, 0)
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if len(p.Sample) == 0 || src != "" {
+		t.Errorf("Fetch: got %d samples and source %q, want samples and no source", len(p.Sample), src)
+	}
+
+	for _, bad := range []string{"gs://profiles/missing", "s3://profiles/prod/cpu.pb.gz", "gs://profiles"} {
+		if _, _, err := f.Fetch(bad, 0, 0); err == nil {
+			t.Errorf("Fetch(%s): want error", bad)
+		}
+	}
+
+	// Other sources are left to the next fetcher.
+	if p, _, err := f.Fetch("cpu", 0, 0); err != nil || p == nil {
+		t.Errorf("Fetch(cpu): got %v, %v, want profile from next fetcher", p, err)
+	}
+}
+
+// fakeObjectStore is an object store holding objects in memory, keyed
+// by bucket/object.
+type fakeObjectStore map[string][]byte
+
+func (s fakeObjectStore) Open(bucket, object string) (io.ReadCloser, error) {
+	data, ok := s[bucket+"/"+object]
+	if !ok {
+		return nil, fmt.Errorf("object %s not found in bucket %s", object, bucket)
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
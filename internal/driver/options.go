@@ -49,6 +49,12 @@ func setDefaults(o *plugin.Options) *plugin.Options {
 	if d.Sym == nil {
 		d.Sym = &symbolizer.Symbolizer{d.Obj, d.UI}
 	}
+	if len(d.ObjectStores) > 0 {
+		d.Fetch = &objectStoreFetcher{d.ObjectStores, d.Fetch}
+	}
+	if len(d.ProfileServices) > 0 {
+		d.Fetch = &profileServiceFetcher{d.ProfileServices, d.Fetch}
+	}
 	return d
 }
 
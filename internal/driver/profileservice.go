@@ -0,0 +1,81 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/pprof/internal/plugin"
+	"github.com/google/pprof/profile"
+)
+
+// profileServiceFetcher is a plugin.Fetcher collecting profiles from
+// profile services, for sources of the form scheme://host/name with a
+// scheme registered in services. Other sources are passed on to next,
+// if set.
+type profileServiceFetcher struct {
+	services map[string]plugin.ProfileService
+	next     plugin.Fetcher
+}
+
+func (f *profileServiceFetcher) Fetch(src string, duration, timeout time.Duration) (*profile.Profile, string, error) {
+	if u, err := url.Parse(src); err == nil {
+		if service := f.services[u.Scheme]; service != nil {
+			p, err := fetchFromService(service, u, duration, timeout)
+			if err != nil {
+				return nil, "", fmt.Errorf("fetch %s: %v", src, err)
+			}
+			// Profile services do not serve symbols, so there is no
+			// source to use for remote symbolization.
+			return p, "", nil
+		}
+	}
+	if f.next == nil {
+		return nil, "", nil
+	}
+	return f.next.Fetch(src, duration, timeout)
+}
+
+// fetchFromService collects the profile named by u from service. As
+// for HTTP sources, the timeout defaults to 1.5 times the duration, or
+// to 60 seconds for profiles that are not time-based.
+func fetchFromService(service plugin.ProfileService, u *url.URL, duration, timeout time.Duration) (*profile.Profile, error) {
+	addr, name := u.Host, strings.TrimPrefix(u.Path, "/")
+	if addr == "" || name == "" {
+		return nil, fmt.Errorf("want %s://host/name", u.Scheme)
+	}
+	if duration < 0 {
+		duration = 0
+	}
+	if timeout <= 0 {
+		if duration > 0 {
+			timeout = duration + duration/2
+		} else {
+			timeout = 60 * time.Second
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	r, err := service.Profile(ctx, addr, name, duration)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return profile.Parse(r)
+}
@@ -0,0 +1,99 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/google/pprof/internal/plugin"
+)
+
+func TestProfileServiceFetcher(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/cppbench.cpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := &fakeProfileService{addr: "host:8080", profiles: map[string][]byte{"profile": data}}
+	f := setDefaults(&plugin.Options{
+		Fetch:           testFetcher{},
+		ProfileServices: map[string]plugin.ProfileService{"grpc": svc},
+	}).Fetch
+
+	p, src, err := f.Fetch("grpc://host:8080/profile", 10*time.Second, -1)
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if len(p.Sample) == 0 || src != "" {
+		t.Errorf("Fetch: got %d samples and source %q, want samples and no source", len(p.Sample), src)
+	}
+	if svc.duration != 10*time.Second {
+		t.Errorf("Fetch: service got duration %v, want 10s", svc.duration)
+	}
+
+	// Negative durations leave the duration to the service.
+	if _, _, err := f.Fetch("grpc://host:8080/profile", -1, -1); err != nil || svc.duration != 0 {
+		t.Errorf("Fetch: got duration %v, err %v, want 0 and no error", svc.duration, err)
+	}
+
+	for _, bad := range []string{"grpc://host:8080/heap", "grpc://other:8080/profile", "grpc://host:8080", "grpc:///profile"} {
+		if _, _, err := f.Fetch(bad, 0, 0); err == nil {
+			t.Errorf("Fetch(%s): want error", bad)
+		}
+	}
+
+	// The service is aborted once the timeout expires.
+	svc.block = true
+	if _, _, err := f.Fetch("grpc://host:8080/profile", 0, time.Millisecond); err == nil {
+		t.Errorf("Fetch: want timeout error")
+	}
+
+	// Other sources are left to the next fetcher.
+	if p, _, err := f.Fetch("cpu", 0, 0); err != nil || p == nil {
+		t.Errorf("Fetch(cpu): got %v, %v, want profile from next fetcher", p, err)
+	}
+}
+
+// fakeProfileService is a profile service served in process by the
+// program at addr, holding profiles in memory keyed by name. It
+// records the duration of the last request, and blocks until the
+// request is done if block is set.
+type fakeProfileService struct {
+	addr     string
+	profiles map[string][]byte
+	block    bool
+	duration time.Duration
+}
+
+func (s *fakeProfileService) Profile(ctx context.Context, addr, name string, duration time.Duration) (io.ReadCloser, error) {
+	if addr != s.addr {
+		return nil, fmt.Errorf("no service at %s", addr)
+	}
+	s.duration = duration
+	if s.block {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	data, ok := s.profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown profile %s", name)
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
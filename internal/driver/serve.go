@@ -0,0 +1,114 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/pprof/internal/plugin"
+)
+
+// serveSaved starts an HTTP server on addr that lists and serves the
+// profiles saved by pprof in its temporary directory. It only returns
+// if the server cannot be started or fails.
+func serveSaved(addr string, ui plugin.UI) error {
+	dir, err := setTmpDir(ui)
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", servingAddress(addr))
+	if err != nil {
+		return err
+	}
+	ui.PrintErr("Serving saved profiles from ", dir, " at http://", ln.Addr().String())
+	return http.Serve(ln, savedProfilesHandler(dir))
+}
+
+// servingAddress returns the address to bind the server to. If addr
+// does not specify a host, the server only listens on localhost.
+func servingAddress(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		// Assume addr is only a port.
+		host, port = "", addr
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// savedProfilesHandler returns a handler listing the profiles saved in
+// dir on its root page, and serving each of them for download. Only
+// files named like the profiles saved by pprof are exposed.
+func savedProfilesHandler(dir string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		if name == "" {
+			listSavedProfiles(w, dir)
+			return
+		}
+		if !isSavedProfile(name) {
+			http.NotFound(w, r)
+			return
+		}
+		path := filepath.Join(dir, name)
+		if fi, err := os.Stat(path); err != nil || !fi.Mode().IsRegular() {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeFile(w, r, path)
+	})
+}
+
+// listSavedProfiles writes an HTML page with links to the profiles
+// saved in dir.
+func listSavedProfiles(w http.ResponseWriter, dir string) {
+	names, err := filepath.Glob(filepath.Join(dir, "pprof.*"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintln(w, "<html><body><pre>")
+	for _, name := range names {
+		if fi, err := os.Stat(name); err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		if name = filepath.Base(name); !isSavedProfile(name) {
+			continue
+		}
+		fmt.Fprintf(w, "<a href=\"%s\">%s</a>\n", html.EscapeString((&url.URL{Path: name}).String()), html.EscapeString(name))
+	}
+	fmt.Fprintln(w, "</pre></body></html>")
+}
+
+// isSavedProfile reports whether name is the name of a profile saved
+// by pprof, with no directory components. Profiles still being written
+// are excluded.
+func isSavedProfile(name string) bool {
+	return strings.HasPrefix(name, "pprof.") && !strings.HasSuffix(name, ".tmp") && !strings.ContainsAny(name, `/\`)
+}
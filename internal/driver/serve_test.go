@@ -0,0 +1,93 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestServingAddress(t *testing.T) {
+	for _, tc := range []struct {
+		addr, want string
+	}{
+		{"8080", "localhost:8080"},
+		{":8080", "localhost:8080"},
+		{"0.0.0.0:8080", "0.0.0.0:8080"},
+		{"myhost:80", "myhost:80"},
+	} {
+		if got := servingAddress(tc.addr); got != tc.want {
+			t.Errorf("servingAddress(%s), want %s, got %s", tc.addr, tc.want, got)
+		}
+	}
+}
+
+func TestSavedProfilesHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pprof_serve")
+	if err != nil {
+		t.Fatalf("cannot create tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	const profileName = "pprof.main.samples.cpu.001.pb.gz"
+	if err := ioutil.WriteFile(filepath.Join(dir, profileName), []byte("profile"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "other"), []byte("other"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "pprof.dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(savedProfilesHandler(dir))
+	defer ts.Close()
+
+	for _, tc := range []struct {
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{"/", http.StatusOK, profileName},
+		{"/" + profileName, http.StatusOK, "profile"},
+		{"/other", http.StatusNotFound, ""},
+		{"/pprof.dir", http.StatusNotFound, ""},
+		{"/pprof.missing", http.StatusNotFound, ""},
+	} {
+		resp, err := http.Get(ts.URL + tc.path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", tc.path, err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("GET %s: %v", tc.path, err)
+		}
+		if resp.StatusCode != tc.wantStatus {
+			t.Errorf("GET %s, want status %d, got %d", tc.path, tc.wantStatus, resp.StatusCode)
+		}
+		if !strings.Contains(string(body), tc.wantBody) {
+			t.Errorf("GET %s, want body containing %q, got %q", tc.path, tc.wantBody, body)
+		}
+		if tc.path == "/" && strings.Contains(string(body), "pprof.dir") {
+			t.Errorf("GET /, listing includes directory: %q", body)
+		}
+	}
+}
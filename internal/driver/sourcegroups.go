@@ -0,0 +1,220 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sourceGroupPrefix starts the sources naming a group of sources.
+const sourceGroupPrefix = "@"
+
+// sourceListPrefix starts the sources naming a file listing sources,
+// one per line. Group names cannot contain a colon, so these never
+// name a group.
+const sourceListPrefix = sourceGroupPrefix + "file:"
+
+// sourceGroups expands sources of the form @name into the sources of
+// the group name, read from a file the first time a group is needed,
+// and sources of the form @file:path into the sources listed in path.
+type sourceGroups struct {
+	file   string
+	groups map[string][]string
+}
+
+// expand returns addrs with each group or list file replaced by its
+// sources, and each list of alternatives in braces expanded, and
+// scales, the scale factor of each of addrs, with the factor of each
+// group repeated for each of its sources.
+func (g *sourceGroups) expand(addrs []string, scales []float64) ([]string, []float64, error) {
+	var expanded []string
+	var expandedScales []float64
+	for i, addr := range addrs {
+		if !strings.HasPrefix(addr, sourceGroupPrefix) {
+			members, err := expandBraces(addr)
+			if err != nil {
+				return nil, nil, fmt.Errorf("source %s: %v", addr, err)
+			}
+			for _, m := range members {
+				expanded = append(expanded, m)
+				expandedScales = append(expandedScales, scales[i])
+			}
+			continue
+		}
+		if strings.HasPrefix(addr, sourceListPrefix) {
+			members, err := readSourceList(strings.TrimPrefix(addr, sourceListPrefix))
+			if err != nil {
+				return nil, nil, fmt.Errorf("source %s: %v", addr, err)
+			}
+			for _, m := range members {
+				expanded = append(expanded, m)
+				expandedScales = append(expandedScales, scales[i])
+			}
+			continue
+		}
+		if g.groups == nil {
+			if err := g.load(); err != nil {
+				return nil, nil, fmt.Errorf("source %s: %v", addr, err)
+			}
+		}
+		name := strings.TrimPrefix(addr, sourceGroupPrefix)
+		members, ok := g.groups[name]
+		if !ok {
+			return nil, nil, fmt.Errorf("source %s: no group %q in %s", addr, name, g.file)
+		}
+		for _, m := range members {
+			expanded = append(expanded, m)
+			expandedScales = append(expandedScales, scales[i])
+		}
+	}
+	return expanded, expandedScales, nil
+}
+
+// load reads the groups from g.file, or from $HOME/pprof/source_groups
+// if it is not set.
+func (g *sourceGroups) load() error {
+	if g.file == "" {
+		g.file = filepath.Join(os.Getenv("HOME"), "pprof", "source_groups")
+	}
+	f, err := os.Open(g.file)
+	if err != nil {
+		return fmt.Errorf("reading source groups: %v", err)
+	}
+	defer f.Close()
+	groups, err := parseSourceGroups(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", g.file, err)
+	}
+	g.groups = groups
+	return nil
+}
+
+// parseSourceGroups parses source groups, one per line of the form
+// "name: source1 source2 ...". Lines naming a group already seen add to
+// its sources. Blank lines and lines starting with # are ignored.
+func parseSourceGroups(r io.Reader) (map[string][]string, error) {
+	groups := make(map[string][]string)
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("line %d: want name: sources", n)
+		}
+		name := strings.TrimSpace(line[:i])
+		if name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("line %d: invalid group name %q", n, name)
+		}
+		for _, src := range strings.Fields(line[i+1:]) {
+			if strings.HasPrefix(src, sourceGroupPrefix) || src == stdinSource {
+				return nil, fmt.Errorf("line %d: group %s cannot include %s", n, name, src)
+			}
+			groups[name] = append(groups[name], src)
+		}
+		if _, ok := groups[name]; !ok {
+			groups[name] = nil
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// readSourceList reads the file at path, listing one source per line.
+// Blank lines and lines starting with # are ignored.
+func readSourceList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading source list: %v", err)
+	}
+	defer f.Close()
+	sources, err := parseSourceList(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return sources, nil
+}
+
+// parseSourceList parses a list of sources, one per line. Blank lines
+// and lines starting with # are ignored.
+func parseSourceList(r io.Reader) ([]string, error) {
+	var sources []string
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		src := strings.TrimSpace(s.Text())
+		if src == "" || strings.HasPrefix(src, "#") {
+			continue
+		}
+		if strings.HasPrefix(src, sourceGroupPrefix) || src == stdinSource || strings.ContainsAny(src, " \t") {
+			return nil, fmt.Errorf("line %d: invalid source %q", n, src)
+		}
+		sources = append(sources, src)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return sources, nil
+}
+
+// expandBraces returns the sources named by addr, with each list of
+// alternatives in braces replaced by each of them in turn, eg
+// host:8080/debug/pprof/{profile,heap} names the profile and heap
+// profiles of host:8080. Data URLs are not expanded.
+func expandBraces(addr string) ([]string, error) {
+	open := strings.Index(addr, "{")
+	if open < 0 || isDataURL(addr) {
+		if strings.Contains(addr, "}") && !isDataURL(addr) {
+			return nil, fmt.Errorf("unmatched }")
+		}
+		return []string{addr}, nil
+	}
+	n := strings.Index(addr[open:], "}")
+	if n < 0 {
+		return nil, fmt.Errorf("unmatched {")
+	}
+	end := open + n
+	var expanded []string
+	for _, alt := range strings.Split(addr[open+1:end], ",") {
+		if alt == "" || strings.Contains(alt, "{") {
+			return nil, fmt.Errorf("invalid alternatives %s", addr[open:end+1])
+		}
+		members, err := expandBraces(addr[:open] + alt + addr[end+1:])
+		if err != nil {
+			return nil, err
+		}
+		expanded = append(expanded, members...)
+	}
+	return expanded, nil
+}
+
+// hasBraces reports whether any of addrs lists alternatives in braces,
+// which usually name profiles of different types.
+func hasBraces(addrs []string) bool {
+	for _, addr := range addrs {
+		if strings.Contains(addr, "{") && !isDataURL(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,209 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/pprof/internal/proftest"
+)
+
+const testSourceGroups = `
+# Hosts serving the frontend.
+frontend: http://fe1:8080/debug/pprof/profile http://fe2:8080/debug/pprof/profile
+cache: http://cache1:8080/debug/pprof/heap
+frontend: http://fe3:8080/debug/pprof/profile
+empty:
+`
+
+func TestSourceGroups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pprof-groups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "source_groups")
+	if err := ioutil.WriteFile(file, []byte(testSourceGroups), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &source{
+		Sources:      []string{"@frontend", "local.pb.gz"},
+		Scales:       []float64{0.5, 2},
+		Base:         []string{"@cache"},
+		SourceGroups: file,
+	}
+	sources, err := profileSources(s, &proftest.TestUI{T: t})
+	if err != nil {
+		t.Fatalf("profileSources: %v", err)
+	}
+	var got []string
+	var scales []float64
+	for _, src := range sources {
+		got = append(got, src.addr)
+		scales = append(scales, src.scale)
+	}
+	want := []string{
+		"http://fe1:8080/debug/pprof/profile",
+		"http://fe2:8080/debug/pprof/profile",
+		"http://fe3:8080/debug/pprof/profile",
+		"local.pb.gz",
+		"http://cache1:8080/debug/pprof/heap",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("profileSources: got sources %q, want %q", got, want)
+	}
+	if wantScales := []float64{0.5, 0.5, 0.5, 2, -1}; !reflect.DeepEqual(scales, wantScales) {
+		t.Errorf("profileSources: got scales %v, want %v", scales, wantScales)
+	}
+
+	for _, tc := range []struct {
+		desc    string
+		s       *source
+		wantErr string
+	}{
+		{"unknown group", &source{Sources: []string{"@db"}, SourceGroups: file}, `no group "db"`},
+		{"missing file", &source{Sources: []string{"@db"}, SourceGroups: filepath.Join(dir, "missing")}, "reading source groups"},
+	} {
+		if _, err := profileSources(tc.s, &proftest.TestUI{T: t}); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%s: got error %v, want error containing %q", tc.desc, err, tc.wantErr)
+		}
+	}
+
+	// The file is only read if a source names a group.
+	s = &source{Sources: []string{"local.pb.gz"}, SourceGroups: filepath.Join(dir, "missing")}
+	if _, err := profileSources(s, &proftest.TestUI{T: t}); err != nil {
+		t.Errorf("profileSources without groups: %v", err)
+	}
+}
+
+func TestParseSourceGroups(t *testing.T) {
+	groups, err := parseSourceGroups(strings.NewReader(testSourceGroups))
+	if err != nil {
+		t.Fatalf("parseSourceGroups: %v", err)
+	}
+	if got := len(groups["frontend"]); got != 3 {
+		t.Errorf("got %d frontend sources, want 3", got)
+	}
+	if members, ok := groups["empty"]; !ok || len(members) != 0 {
+		t.Errorf("got empty group %q, %v, want defined with no sources", members, ok)
+	}
+
+	for _, bad := range []string{
+		"frontend http://fe1:8080",
+		": http://fe1:8080",
+		"front end: http://fe1:8080",
+		"all: @frontend",
+		"stdin: -",
+	} {
+		if _, err := parseSourceGroups(strings.NewReader(bad)); err == nil {
+			t.Errorf("parseSourceGroups(%q): want error", bad)
+		}
+	}
+}
+
+const testSourceList = `
+# Frontends, one per line.
+http://fe1:8080/debug/pprof/profile
+
+  fe2:8080
+	# Duplicates of the first source, once adjusted.
+fe1:8080/debug/pprof/profile
+`
+
+func TestSourceList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pprof-list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "urls.txt")
+	if err := ioutil.WriteFile(file, []byte(testSourceList), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &source{
+		Sources: []string{sourceListPrefix + file, "local.pb.gz"},
+		Scales:  []float64{0.5, 2},
+	}
+	sources, err := profileSources(s, &proftest.TestUI{T: t, Ignore: 1})
+	if err != nil {
+		t.Fatalf("profileSources: %v", err)
+	}
+	var got []string
+	var scales []float64
+	for _, src := range sources {
+		got = append(got, src.addr)
+		scales = append(scales, src.scale)
+	}
+	if want := []string{"http://fe1:8080/debug/pprof/profile", "fe2:8080", "local.pb.gz"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("profileSources: got sources %q, want %q", got, want)
+	}
+	if wantScales := []float64{0.5, 0.5, 2}; !reflect.DeepEqual(scales, wantScales) {
+		t.Errorf("profileSources: got scales %v, want %v", scales, wantScales)
+	}
+	if got, _ := adjustURL(sources[1].addr, 0, 0); got != "http://fe2:8080" {
+		t.Errorf("adjustURL(%s) = %s, want http://fe2:8080", sources[1].addr, got)
+	}
+
+	for _, tc := range []struct {
+		desc, list, wantErr string
+	}{
+		{"missing file", "", "reading source list"},
+		{"group", "@frontend\n", `line 1: invalid source "@frontend"`},
+		{"stdin", "\n-\n", `line 2: invalid source "-"`},
+		{"two sources", "fe1:8080 fe2:8080\n", "line 1: invalid source"},
+	} {
+		name := filepath.Join(dir, "missing")
+		if tc.list != "" {
+			name = filepath.Join(dir, "bad.txt")
+			if err := ioutil.WriteFile(name, []byte(tc.list), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		s := &source{Sources: []string{sourceListPrefix + name}}
+		if _, err := profileSources(s, &proftest.TestUI{T: t}); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%s: got error %v, want error containing %q", tc.desc, err, tc.wantErr)
+		}
+	}
+}
+
+func TestExpandBraces(t *testing.T) {
+	for _, tc := range []struct {
+		addr    string
+		want    []string
+		wantErr bool
+	}{
+		{"host:8080/debug/pprof/heap", []string{"host:8080/debug/pprof/heap"}, false},
+		{"host:8080/debug/pprof/{profile,heap,goroutine}", []string{"host:8080/debug/pprof/profile", "host:8080/debug/pprof/heap", "host:8080/debug/pprof/goroutine"}, false},
+		{"fe{1,2}:8080/{heap,allocs}", []string{"fe1:8080/heap", "fe1:8080/allocs", "fe2:8080/heap", "fe2:8080/allocs"}, false},
+		{"data:,{a,b}", []string{"data:,{a,b}"}, false},
+		{"host/{heap", nil, true},
+		{"host/heap}", nil, true},
+		{"host/{}", nil, true},
+		{"host/{heap,}", nil, true},
+		{"host/{a{b,c}}", nil, true},
+	} {
+		got, err := expandBraces(tc.addr)
+		if (err != nil) != tc.wantErr || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("expandBraces(%s): got %q, %v, want %q, error %v", tc.addr, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
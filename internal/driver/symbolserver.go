@@ -0,0 +1,77 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/pprof/internal/plugin"
+)
+
+// symbolServerTimeout is the timeout for downloads from symbol servers.
+const symbolServerTimeout = 60 * time.Second
+
+// symbolServerFile returns the path of the binary for buildID and
+// baseName, as served by the symbol server whose URL template is in
+// PPROF_SYMBOL_SERVER, with {buildid} and {basename} substituted.
+// Binaries are downloaded once into the symbol server cache, and only
+// looked up in the cache if offline is set. It returns "" if
+// PPROF_SYMBOL_SERVER is not set or the server does not have the
+// binary.
+func symbolServerFile(buildID, baseName string, proxy *url.URL, offline bool, ui plugin.UI) string {
+	template := os.Getenv("PPROF_SYMBOL_SERVER")
+	if template == "" || !buildIDRx.MatchString(buildID) {
+		return ""
+	}
+	if baseName == "" || baseName == "." || baseName == string(filepath.Separator) {
+		if strings.Contains(template, "{basename}") {
+			return ""
+		}
+		baseName = "binary"
+	}
+	path := filepath.Join(symbolServerCacheDir(), strings.ToLower(buildID), baseName)
+	if _, err := os.Stat(path); err == nil {
+		return path
+	}
+	if offline {
+		return ""
+	}
+	source := strings.NewReplacer(
+		"{buildid}", buildID,
+		"{basename}", url.PathEscape(baseName),
+	).Replace(template)
+	found, err := downloadFile(source, path, symbolServerTimeout, proxy)
+	if err != nil {
+		ui.PrintErr("symbol server ", source, ": ", err)
+		return ""
+	}
+	if !found {
+		return ""
+	}
+	return path
+}
+
+// symbolServerCacheDir returns the directory binaries downloaded from
+// the symbol server are cached in.
+func symbolServerCacheDir() string {
+	if dir := os.Getenv("PPROF_SYMBOL_CACHE_DIR"); dir != "" {
+		return dir
+	}
+	return filepath.Join(os.Getenv("HOME"), "pprof", "symbols")
+}
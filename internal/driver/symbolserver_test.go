@@ -0,0 +1,89 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/pprof/internal/proftest"
+	"github.com/google/pprof/profile"
+)
+
+func TestSymbolServer(t *testing.T) {
+	savedHTTPGet := httpGet
+	defer func() { httpGet = savedHTTPGet }()
+	httpGet = getURL
+
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch r.URL.Path {
+		case "/abcde10003/binary":
+			w.Write([]byte("abcde10003"))
+		case "/abcde10004/binary":
+			// The server has the wrong binary for this build id.
+			w.Write([]byte("abcde10005"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "symbolserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, env := range []string{"PPROF_SYMBOL_SERVER", "PPROF_SYMBOL_CACHE_DIR", "PPROF_BINARY_PATH", "DEBUGINFOD_URLS"} {
+		defer os.Setenv(env, os.Getenv(env))
+	}
+	os.Setenv("PPROF_SYMBOL_SERVER", ts.URL+"/{buildid}/{basename}")
+	os.Setenv("PPROF_SYMBOL_CACHE_DIR", dir)
+	os.Setenv("PPROF_BINARY_PATH", dir)
+	os.Setenv("DEBUGINFOD_URLS", "")
+
+	cached := filepath.Join(dir, "abcde10003", "binary")
+	for i, tc := range []struct {
+		buildID, want string
+		msgCount      int
+	}{
+		{"abcde10003", cached, 1},
+		// Cached binaries are not downloaded again.
+		{"abcde10003", cached, 1},
+		// Binaries with the wrong build id are rejected.
+		{"abcde10004", "/usr/bin/binary", 1},
+		{"abcde10006", "/usr/bin/binary", 0},
+	} {
+		p := &profile.Profile{
+			Mapping: []*profile.Mapping{{File: "/usr/bin/binary", BuildID: tc.buildID}},
+		}
+		locateBinaries(p, &source{}, "", binarySearchPath(), debugObj{}, &proftest.TestUI{T: t, Ignore: tc.msgCount})
+		if got := p.Mapping[0].File; got != tc.want {
+			t.Errorf("%d: %s: got file %s, want %s", i, tc.buildID, got, tc.want)
+		}
+	}
+	if requests != 3 {
+		t.Errorf("got %d requests to the symbol server, want 3", requests)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "abcde10004", "binary")); !os.IsNotExist(err) {
+		t.Errorf("binary with mismatched build id was kept in the cache: %v", err)
+	}
+}
@@ -16,6 +16,7 @@ package driver
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"sync"
@@ -24,7 +25,7 @@ import (
 // newTempFile returns a new output file in dir with the provided prefix and suffix.
 func newTempFile(dir, prefix, suffix string) (*os.File, error) {
 	for index := 1; index < 10000; index++ {
-		path := filepath.Join(dir, fmt.Sprintf("%s%03d%s", prefix, index, suffix))
+		path := tempFileName(dir, prefix, suffix, index)
 		if _, err := os.Stat(path); err != nil {
 			return os.Create(path)
 		}
@@ -33,6 +34,47 @@ func newTempFile(dir, prefix, suffix string) (*os.File, error) {
 	return nil, fmt.Errorf("could not create file of the form %s%03d%s", prefix, 1, suffix)
 }
 
+// saveFile creates a new file in dir named as by newTempFile, with the
+// contents written by write, and returns its name. The contents are
+// written to a .tmp sibling first, which is only renamed into place once
+// complete, so that a partial file is never observed under the name.
+func saveFile(dir, prefix, suffix string, write func(io.Writer) error) (string, error) {
+	for index := 1; index < 10000; index++ {
+		path := tempFileName(dir, prefix, suffix, index)
+		if _, err := os.Stat(path); err == nil {
+			continue
+		}
+		tmp, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) {
+			// Being written by another process.
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		err = write(tmp)
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), path)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+			return "", err
+		}
+		return path, nil
+	}
+	// Give up
+	return "", fmt.Errorf("could not create file of the form %s%03d%s", prefix, 1, suffix)
+}
+
+// tempFileName returns the name of the index-th candidate file in dir
+// with the provided prefix and suffix.
+func tempFileName(dir, prefix, suffix string, index int) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%03d%s", prefix, index, suffix))
+}
+
 var tempFiles []string
 var tempFilesMu = sync.Mutex{}
 
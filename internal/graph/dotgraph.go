@@ -47,6 +47,9 @@ type DotConfig struct {
 
 	FormatValue func(int64) string // A formatting function for values
 	Total       int64              // The total weight of the graph, used to compute percentages
+
+	ClusterBy   string // Group nodes into subgraph clusters by "package" or "dir"
+	ColorScheme string // Palette for node and edge colors, see dotColor
 }
 
 // Compose creates and writes a in the DOT format to the writer, using
@@ -77,14 +80,23 @@ func ComposeDot(w io.Writer, g *Graph, a *DotAttributes, c *DotConfig) {
 
 	edges := EdgeMap{}
 
-	// Add nodes and nodelets to DOT builder.
-	for _, n := range g.Nodes {
-		builder.addNode(n, nodeIDMap[n], maxFlat)
-		hasNodelets[n] = builder.addNodelets(n, nodeIDMap[n])
+	// Add nodes and nodelets to DOT builder, grouping them into clusters
+	// if requested.
+	for i, cl := range clusterNodes(g.Nodes, c.ClusterBy) {
+		if cl.name != "" {
+			builder.startCluster(i, cl.name)
+		}
+		for _, n := range cl.nodes {
+			builder.addNode(n, nodeIDMap[n], maxFlat)
+			hasNodelets[n] = builder.addNodelets(n, nodeIDMap[n])
 
-		// Collect all edges. Use a fake node to support multiple incoming edges.
-		for _, e := range n.Out {
-			edges[&Node{}] = e
+			// Collect all edges. Use a fake node to support multiple incoming edges.
+			for _, e := range n.Out {
+				edges[&Node{}] = e
+			}
+		}
+		if cl.name != "" {
+			builder.finish()
 		}
 	}
 
@@ -116,6 +128,13 @@ func (b *builder) finish() {
 	fmt.Fprintln(b, "}")
 }
 
+// startCluster opens a DOT subgraph cluster labeled with name. It must
+// be closed by a call to finish.
+func (b *builder) startCluster(id int, name string) {
+	fmt.Fprintf(b, "subgraph cluster_%d {\n", id)
+	fmt.Fprintf(b, "label=\"%s\" style=rounded color=\"#b2b2b2\"\n", escapeForDot(name))
+}
+
 // addLegend generates a legend in DOT format.
 func (b *builder) addLegend() {
 	labels := b.config.Labels
@@ -177,8 +196,8 @@ func (b *builder) addNode(node *Node, nodeID int, maxFlat float64) {
 	// Create DOT attribute for node.
 	attr := fmt.Sprintf(`label="%s" fontsize=%d shape=%s tooltip="%s (%s)" color="%s" fillcolor="%s"`,
 		label, fontSize, shape, node.Info.PrintableName(), cumValue,
-		dotColor(float64(node.CumValue())/float64(abs64(b.config.Total)), false),
-		dotColor(float64(node.CumValue())/float64(abs64(b.config.Total)), true))
+		dotColor(float64(node.CumValue())/float64(abs64(b.config.Total)), false, b.config.ColorScheme),
+		dotColor(float64(node.CumValue())/float64(abs64(b.config.Total)), true, b.config.ColorScheme))
 
 	// Add on extra attributes if provided.
 	if attrs != nil {
@@ -289,7 +308,7 @@ func (b *builder) addEdge(edge *Edge, from, to int, hasNodelets bool) {
 			attr = fmt.Sprintf(`%s penwidth=%d`, attr, width)
 		}
 		attr = fmt.Sprintf(`%s color="%s"`, attr,
-			dotColor(float64(edge.WeightValue())/float64(abs64(b.config.Total)), false))
+			dotColor(float64(edge.WeightValue())/float64(abs64(b.config.Total)), false, b.config.ColorScheme))
 	}
 	arrow := "->"
 	if edge.Residual {
@@ -311,13 +330,81 @@ func (b *builder) addEdge(edge *Edge, from, to int, hasNodelets bool) {
 	fmt.Fprintf(b, "N%d -> N%d [%s]\n", from, to, attr)
 }
 
+// nodeCluster is a group of nodes rendered together in a DOT subgraph.
+type nodeCluster struct {
+	name  string
+	nodes Nodes
+}
+
+// clusterNodes groups nodes according to clusterBy, which is either
+// "package", "dir" or empty. Clusters are returned in order of first
+// appearance of their nodes. Nodes that cannot be assigned to a cluster
+// are returned in a group with an empty name.
+func clusterNodes(nodes Nodes, clusterBy string) []nodeCluster {
+	var key func(*NodeInfo) string
+	switch clusterBy {
+	case "package":
+		key = func(ni *NodeInfo) string { return packageName(ni.Name) }
+	case "dir":
+		key = func(ni *NodeInfo) string {
+			if ni.File == "" {
+				return ""
+			}
+			return filepath.Dir(ni.File)
+		}
+	default:
+		return []nodeCluster{{"", nodes}}
+	}
+
+	var clusters []nodeCluster
+	index := make(map[string]int)
+	for _, n := range nodes {
+		k := key(&n.Info)
+		i, ok := index[k]
+		if !ok {
+			i = len(clusters)
+			index[k] = i
+			clusters = append(clusters, nodeCluster{name: k})
+		}
+		clusters[i].nodes = append(clusters[i].nodes, n)
+	}
+	return clusters
+}
+
+// packageName extracts the package or namespace from a symbol name.
+// For Go symbols, such as "github.com/google/pprof/driver.PProf", it
+// returns the import path; for C++ symbols, such as "std::vector<int>::size",
+// it returns the outermost namespace. It returns "" if no package can be
+// identified.
+func packageName(name string) string {
+	if i := strings.Index(name, "::"); i > 0 {
+		return name[:i]
+	}
+	slash := strings.LastIndex(name, "/") + 1
+	if i := strings.Index(name[slash:], "."); i > 0 {
+		return name[:slash+i]
+	}
+	return ""
+}
+
+// escapeForDot escapes backslashes and double quotes in str, so that it
+// can be used as a double-quoted DOT string.
+func escapeForDot(str string) string {
+	return strings.Replace(strings.Replace(str, `\`, `\\`, -1), `"`, `\"`, -1)
+}
+
 // dotColor returns a color for the given score (between -1.0 and
 // 1.0), with -1.0 colored red, 0.0 colored grey, and 1.0 colored
 // green. If isBackground is true, then a light (low-saturation)
 // color is returned (suitable for use as a background color);
 // otherwise, a darker color is returned (suitable for use as a
-// foreground color).
-func dotColor(score float64, isBackground bool) string {
+// foreground color). If scheme names one of colorPalettes, the colors
+// are taken from that palette instead.
+func dotColor(score float64, isBackground bool, scheme string) string {
+	if palette := colorPalettes[scheme]; palette != nil {
+		return paletteColor(score, isBackground, palette)
+	}
+
 	// A float between 0.0 and 1.0, indicating the extent to which
 	// colors should be shifted away from grey (to make positive and
 	// negative values easier to distinguish, and to make more use of
@@ -371,6 +458,75 @@ func dotColor(score float64, isBackground bool) string {
 	return fmt.Sprintf("#%02x%02x%02x", uint8(r*255.0), uint8(g*255.0), uint8(b*255.0))
 }
 
+// rgb is a color with red, green and blue components between 0.0 and 1.0.
+type rgb [3]float64
+
+// blend returns the color at fraction t of the way from c to d.
+func (c rgb) blend(d rgb, t float64) rgb {
+	return rgb{c[0] + (d[0]-c[0])*t, c[1] + (d[1]-c[1])*t, c[2] + (d[2]-c[2])*t}
+}
+
+func (c rgb) String() string {
+	return fmt.Sprintf("#%02x%02x%02x", uint8(c[0]*255.0), uint8(c[1]*255.0), uint8(c[2]*255.0))
+}
+
+// colorPalette describes an alternative color scheme. Scores from 0.0
+// to 1.0 are mapped along the positive color stops, and scores from
+// 0.0 to -1.0 along the negative ones.
+type colorPalette struct {
+	positive, negative []rgb
+}
+
+// colorPalettes are the alternative color schemes accepted by dotColor.
+var colorPalettes = map[string]*colorPalette{
+	// Shades of grey, suitable for printing.
+	"grayscale": {
+		positive: []rgb{{0.8, 0.8, 0.8}, {0.0, 0.0, 0.0}},
+		negative: []rgb{{0.8, 0.8, 0.8}, {0.0, 0.0, 0.0}},
+	},
+	// Perceptually uniform viridis color map, from light to dark.
+	"viridis": {
+		positive: []rgb{{0.99, 0.91, 0.15}, {0.37, 0.79, 0.38}, {0.13, 0.57, 0.55}, {0.23, 0.32, 0.55}, {0.27, 0.00, 0.33}},
+		negative: []rgb{{0.99, 0.91, 0.15}, {0.37, 0.79, 0.38}, {0.13, 0.57, 0.55}, {0.23, 0.32, 0.55}, {0.27, 0.00, 0.33}},
+	},
+	// Orange and blue from the Okabe-Ito palette, distinguishable with
+	// the common forms of color blindness.
+	"colorblind": {
+		positive: []rgb{{0.7, 0.7, 0.7}, {0.84, 0.37, 0.0}},
+		negative: []rgb{{0.7, 0.7, 0.7}, {0.0, 0.45, 0.70}},
+	},
+}
+
+// paletteColor returns the color for the given score (between -1.0
+// and 1.0) in an alternative color palette. Background colors are
+// lightened versions of the foreground colors.
+func paletteColor(score float64, isBackground bool, palette *colorPalette) string {
+	// Shift scores away from 0.0 the same way as the default scheme.
+	const shift = 0.7
+
+	if math.IsNaN(score) {
+		score = 0.0
+	}
+	stops := palette.positive
+	if score < 0.0 {
+		stops = palette.negative
+	}
+	score = math.Pow(math.Min(1.0, math.Abs(score)), 1.0-shift)
+
+	// Interpolate between the two stops surrounding the score.
+	pos := score * float64(len(stops)-1)
+	i := int(pos)
+	if i >= len(stops)-1 {
+		i = len(stops) - 2
+	}
+	c := stops[i].blend(stops[i+1], pos-float64(i))
+
+	if isBackground {
+		c = c.blend(rgb{1.0, 1.0, 1.0}, 0.85)
+	}
+	return c.String()
+}
+
 // percentage computes the percentage of total of a value, and encodes
 // it as a string. At least two digits of precision are printed.
 func percentage(value, total int64) string {
@@ -150,6 +150,56 @@ func TestComposeWithEmptyGraph(t *testing.T) {
 	compareGraphs(t, buf.Bytes(), want)
 }
 
+func TestComposeWithPackageClusters(t *testing.T) {
+	g := baseGraph()
+	a, c := baseAttrsAndConfig()
+
+	g.Nodes[0].Info.Name = "github.com/google/pprof/driver.(*T).src"
+	g.Nodes[1].Info.Name = "github.com/google/pprof/driver.dest"
+	c.ClusterBy = "package"
+
+	var buf bytes.Buffer
+	ComposeDot(&buf, g, a, c)
+
+	want, err := ioutil.ReadFile(path + "compose6.dot")
+	if err != nil {
+		t.Fatalf("error reading test file: %v", err)
+	}
+
+	compareGraphs(t, buf.Bytes(), want)
+}
+
+func TestComposeClusterLabelEscaping(t *testing.T) {
+	g := baseGraph()
+	a, c := baseAttrsAndConfig()
+
+	g.Nodes[0].Info.Name = `ns"1\x::src`
+	c.ClusterBy = "package"
+
+	var buf bytes.Buffer
+	ComposeDot(&buf, g, a, c)
+
+	if want := `label="ns\"1\\x" style=rounded`; !strings.Contains(buf.String(), want) {
+		t.Errorf("ComposeDot: want cluster %s, got:\n%s", want, buf.String())
+	}
+}
+
+func TestPackageName(t *testing.T) {
+	for _, tc := range []struct {
+		name, want string
+	}{
+		{"main.main", "main"},
+		{"github.com/google/pprof/driver.PProf", "github.com/google/pprof/driver"},
+		{"github.com/google/pprof/driver.(*T).m", "github.com/google/pprof/driver"},
+		{"std::vector<int>::size", "std"},
+		{"malloc", ""},
+	} {
+		if got := packageName(tc.name); got != tc.want {
+			t.Errorf("packageName(%q), want %q, got %q", tc.name, tc.want, got)
+		}
+	}
+}
+
 func baseGraph() *Graph {
 	src := &Node{
 		Info:        NodeInfo{Name: "src"},
@@ -209,6 +259,38 @@ func compareGraphs(t *testing.T, got, want []byte) {
 	}
 }
 
+func TestDotColorSchemes(t *testing.T) {
+	// The default scheme is used for unknown schemes.
+	for _, score := range []float64{-1, -0.5, 0, 0.5, 1} {
+		for _, bg := range []bool{false, true} {
+			if got, want := dotColor(score, bg, "unknown"), dotColor(score, bg, "default"); got != want {
+				t.Errorf("dotColor(%v, %v, unknown), want %s, got %s", score, bg, want, got)
+			}
+		}
+	}
+
+	for _, tc := range []struct {
+		scheme string
+		score  float64
+		bg     bool
+		want   string
+	}{
+		{"grayscale", 0, false, "#cccccc"},
+		{"grayscale", 1, false, "#000000"},
+		{"grayscale", -1, false, "#000000"},
+		{"grayscale", 1, true, "#d8d8d8"},
+		{"viridis", 0, false, "#fce826"},
+		{"viridis", 1, false, "#440054"},
+		{"colorblind", 0, false, "#b2b2b2"},
+		{"colorblind", 1, false, "#d65e00"},
+		{"colorblind", -1, false, "#0072b2"},
+	} {
+		if got := dotColor(tc.score, tc.bg, tc.scheme); got != tc.want {
+			t.Errorf("dotColor(%v, %v, %s), want %s, got %s", tc.score, tc.bg, tc.scheme, tc.want, got)
+		}
+	}
+}
+
 func TestMultilinePrintableName(t *testing.T) {
 	ni := &NodeInfo{
 		Name:    "test1.test2::test3",
@@ -215,7 +215,30 @@ func (rpt *Report) newGraph(nodes graph.NodeSet) *graph.Graph {
 		gopt.ObjNames = true
 	}
 
-	return graph.New(rpt.prof, gopt)
+	g := graph.New(rpt.prof, gopt)
+	if o.SampleRatio {
+		neutralizeZeroDivisors(g)
+	}
+	return g
+}
+
+// neutralizeZeroDivisors clears the values of the nodes and edges of a
+// ratio graph that have a zero divisor, so that they are rendered as
+// zero instead of as the undivided sample value.
+func neutralizeZeroDivisors(g *graph.Graph) {
+	for _, n := range g.Nodes {
+		if n.FlatDiv == 0 {
+			n.Flat = 0
+		}
+		if n.CumDiv == 0 {
+			n.Cum = 0
+		}
+		for _, e := range n.Out {
+			if e.WeightDiv == 0 {
+				e.Weight = 0
+			}
+		}
+	}
 }
 
 func formatTag(v int64, key string) string {
@@ -537,6 +560,7 @@ func printText(w io.Writer, rpt *Report) error {
 
 	fmt.Fprintf(w, "%10s %5s%% %5s%% %10s %5s%%\n",
 		"flat", "flat", "sum", "cum", "cum")
+	rpt.streamFlush(w)
 
 	var flatSum int64
 	for _, n := range g.Nodes {
@@ -567,10 +591,21 @@ func printText(w io.Writer, rpt *Report) error {
 			rpt.formatValue(cum),
 			percentage(cum, rpt.total),
 			name)
+		rpt.streamFlush(w)
 	}
 	return nil
 }
 
+// streamFlush flushes any output buffered by w if the report is being
+// streamed, so that rows are displayed as soon as they are formatted.
+func (rpt *Report) streamFlush(w io.Writer) {
+	if f, ok := w.(interface {
+		Flush() error
+	}); ok && rpt.options.Stream {
+		f.Flush()
+	}
+}
+
 // printTraces prints all traces from a profile.
 func printTraces(w io.Writer, rpt *Report) error {
 	fmt.Fprintln(w, strings.Join(ProfileLabels(rpt), "\n"))
@@ -831,6 +866,8 @@ func printDOT(w io.Writer, rpt *Report) error {
 		Labels:      labels,
 		FormatValue: rpt.formatValue,
 		Total:       rpt.total,
+		ClusterBy:   rpt.options.ClusterBy,
+		ColorScheme: rpt.options.ColorScheme,
 	}
 	graph.ComposeDot(w, g, &graph.DotAttributes{}, c)
 	return nil
@@ -867,6 +904,9 @@ func ProfileLabels(rpt *Report) []string {
 		}
 	}
 	label = append(label, prof.Comments...)
+	if prof.DocumentationURL != "" {
+		label = append(label, "Doc: "+prof.DocumentationURL)
+	}
 	if o.SampleType != "" {
 		label = append(label, "Type: "+o.SampleType)
 	}
@@ -971,8 +1011,12 @@ type Options struct {
 	SampleMeanDivisor func(s []int64) int64
 	SampleType        string
 	SampleUnit        string // Unit for the sample data from the profile.
+	SampleRatio       bool   // Values are ratios of SampleValue over SampleMeanDivisor.
 
-	OutputUnit string // Units for data formatting in report.
+	OutputUnit  string // Units for data formatting in report.
+	ClusterBy   string // Grouping of nodes into clusters for graph reports.
+	ColorScheme string // Color palette for graph reports.
+	Stream      bool   // Flush text report rows to the writer as they are formatted.
 
 	Symbol     *regexp.Regexp // Symbols to include on disassembly report.
 	SourcePath string         // Search path for source files.
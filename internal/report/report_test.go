@@ -18,6 +18,7 @@ import (
 	"bytes"
 	"io/ioutil"
 	"regexp"
+	"strings"
 	"testing"
 
 	"github.com/google/pprof/internal/binutils"
@@ -86,6 +87,57 @@ func TestSource(t *testing.T) {
 	}
 }
 
+// flushCounter is a writer that counts calls to Flush.
+type flushCounter struct {
+	bytes.Buffer
+	flushes int
+}
+
+func (f *flushCounter) Flush() error {
+	f.flushes++
+	return nil
+}
+
+func TestTextStream(t *testing.T) {
+	sampleValue1 := func(v []int64) int64 {
+		return v[1]
+	}
+
+	var want string
+	for _, stream := range []bool{false, true} {
+		rpt := New(testProfile.Copy(), &Options{
+			OutputFormat: Text,
+			Stream:       stream,
+
+			SampleValue: sampleValue1,
+			SampleUnit:  testProfile.SampleType[1].Unit,
+		})
+		var w flushCounter
+		if err := Generate(&w, rpt, nil); err != nil {
+			t.Fatalf("stream=%v: %v", stream, err)
+		}
+		if !stream {
+			if w.flushes != 0 {
+				t.Errorf("stream=%v: got %d flushes, want 0", stream, w.flushes)
+			}
+			want = w.String()
+			continue
+		}
+		if got := w.String(); got != want {
+			t.Errorf("stream=%v: got output\n%s\nwant\n%s", stream, got, want)
+		}
+		// Expect one flush for the header, plus one per row.
+		lines := strings.Split(strings.TrimSuffix(want, "\n"), "\n")
+		flushes := 1
+		for i := len(lines) - 1; i >= 0 && !strings.Contains(lines[i], "flat%"); i-- {
+			flushes++
+		}
+		if w.flushes != flushes {
+			t.Errorf("stream=%v: got %d flushes, want %d", stream, w.flushes, flushes)
+		}
+	}
+}
+
 var testM = []*profile.Mapping{
 	{
 		ID:              1,
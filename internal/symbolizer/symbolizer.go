@@ -24,6 +24,7 @@ import (
 	"net/url"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/google/pprof/internal/binutils"
 	"github.com/google/pprof/internal/plugin"
@@ -42,6 +43,11 @@ type Symbolizer struct {
 var symbolzSymbolize = symbolz.Symbolize
 var localSymbolize = doLocalSymbolize
 
+// localSymbolizeWorkers is the maximum number of mappings symbolized
+// concurrently by doLocalSymbolize, matching the number of profiles
+// fetched concurrently by default.
+var localSymbolizeWorkers = 64
+
 // Symbolize attempts to symbolize profile p. First uses binutils on
 // local binaries; if the source is a URL it attempts to get any
 // missed entries using symbolz.
@@ -125,17 +131,13 @@ func doLocalSymbolize(mode string, prof *profile.Profile, obj plugin.ObjTool, ui
 	}
 	defer mt.close()
 
+	stacks := mt.sourceLines(localSymbolizeWorkers)
+
 	functions := make(map[profile.Function]*profile.Function)
-	for _, l := range mt.prof.Location {
+	for li, l := range mt.prof.Location {
 		m := l.Mapping
-		segment := mt.segments[m]
-		if segment == nil {
-			// Nothing to do.
-			continue
-		}
-
-		stack, err := segment.SourceLine(l.Address)
-		if err != nil || len(stack) == 0 {
+		stack := stacks[li]
+		if len(stack) == 0 {
 			// No answers from addr2line.
 			continue
 		}
@@ -337,6 +339,51 @@ type mappingTable struct {
 	segments map[*profile.Mapping]plugin.ObjFile
 }
 
+// sourceLines returns the frames for the address of each location of
+// the profile, indexed like its locations. Each mapping has its own
+// object file, so up to workers mappings are looked up concurrently.
+func (mt *mappingTable) sourceLines(workers int) [][]plugin.Frame {
+	var mappings []*profile.Mapping
+	locations := make(map[*profile.Mapping][]int)
+	for li, l := range mt.prof.Location {
+		if mt.segments[l.Mapping] == nil {
+			// Nothing to do.
+			continue
+		}
+		if locations[l.Mapping] == nil {
+			mappings = append(mappings, l.Mapping)
+		}
+		locations[l.Mapping] = append(locations[l.Mapping], li)
+	}
+
+	if workers < 1 {
+		workers = 1
+	}
+	stacks := make([][]plugin.Frame, len(mt.prof.Location))
+	work := make(chan *profile.Mapping)
+	var wg sync.WaitGroup
+	for i := 0; i < workers && i < len(mappings); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for m := range work {
+				segment := mt.segments[m]
+				for _, li := range locations[m] {
+					if stack, err := segment.SourceLine(mt.prof.Location[li].Address); err == nil {
+						stacks[li] = stack
+					}
+				}
+			}
+		}()
+	}
+	for _, m := range mappings {
+		work <- m
+	}
+	close(work)
+	wg.Wait()
+	return stacks
+}
+
 // Close releases any external processes being used for the mapping.
 func (mt *mappingTable) close() {
 	for _, segment := range mt.segments {
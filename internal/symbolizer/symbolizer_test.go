@@ -19,6 +19,7 @@ import (
 	"regexp"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/pprof/internal/plugin"
 	"github.com/google/pprof/internal/proftest"
@@ -182,6 +183,79 @@ func TestLocalSymbolization(t *testing.T) {
 	}
 }
 
+func TestParallelLocalSymbolization(t *testing.T) {
+	defer func(workers int) { localSymbolizeWorkers = workers }(localSymbolizeWorkers)
+
+	var want string
+	for _, workers := range []int{1, 4, 64} {
+		localSymbolizeWorkers = workers
+		// Symbolize repeatedly to exercise different schedules.
+		for i := 0; i < 5; i++ {
+			prof := manyMappingsProfile(100)
+			if err := localSymbolize("", prof, mockObjTool{}, &proftest.TestUI{T: t}); err != nil {
+				t.Fatalf("localSymbolize(): %v", err)
+			}
+			got := prof.String()
+			if want == "" {
+				want = got
+				continue
+			}
+			if got != want {
+				t.Fatalf("localSymbolize() with %d workers: got\n%s\nwant serial result\n%s", workers, got, want)
+			}
+		}
+	}
+}
+
+func BenchmarkLocalSymbolization(b *testing.B) {
+	defer func(workers int) { localSymbolizeWorkers = workers }(localSymbolizeWorkers)
+	// Model the round trip to an external addr2line process.
+	obj := mockObjTool{delay: 10 * time.Microsecond}
+	for _, workers := range []int{1, localSymbolizeWorkers} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			localSymbolizeWorkers = workers
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				prof := manyMappingsProfile(1000)
+				b.StartTimer()
+				if err := localSymbolize("", prof, obj, &proftest.TestUI{}); err != nil {
+					b.Fatalf("localSymbolize(): %v", err)
+				}
+			}
+		})
+	}
+}
+
+// manyMappingsProfile returns a profile with n mappings, each with a
+// location at every address in mockAddresses.
+func manyMappingsProfile(n int) *profile.Profile {
+	p := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "cpu", Unit: "cycles"}},
+	}
+	for i := 0; i < n; i++ {
+		m := &profile.Mapping{
+			ID:    uint64(i + 1),
+			Start: uint64(i) << 16,
+			Limit: uint64(i+1) << 16,
+			File:  fmt.Sprintf("mapping%d", i),
+		}
+		p.Mapping = append(p.Mapping, m)
+		for _, addr := range []uint64{1000, 2000, 3000, 4000, 5000} {
+			l := &profile.Location{
+				ID:      uint64(len(p.Location) + 1),
+				Mapping: m,
+				Address: addr,
+			}
+			p.Location = append(p.Location, l)
+			p.Sample = append(p.Sample, &profile.Sample{
+				Location: []*profile.Location{l},
+				Value:    []int64{int64(l.ID)},
+			})
+		}
+	}
+	return p
+}
+
 func checkSymbolizedLocation(a uint64, got []profile.Line) error {
 	want, ok := mockAddresses[a]
 	if !ok {
@@ -214,10 +288,12 @@ var mockAddresses = map[uint64][]plugin.Frame{
 	5000: []plugin.Frame{{"fun51", "file51.src", 50}, {"fun52", "file52.src", 50}, {"fun53", "file53.src", 50}, {"fun54", "file54.src", 50}, {"fun55", "file55.src", 50}},
 }
 
-type mockObjTool struct{}
+type mockObjTool struct {
+	delay time.Duration
+}
 
-func (mockObjTool) Open(file string, start, limit, offset uint64) (plugin.ObjFile, error) {
-	return mockObjFile{frames: mockAddresses}, nil
+func (mo mockObjTool) Open(file string, start, limit, offset uint64) (plugin.ObjFile, error) {
+	return mockObjFile{frames: mockAddresses, delay: mo.delay}, nil
 }
 
 func (mockObjTool) Disasm(file string, start, end uint64) ([]plugin.Inst, error) {
@@ -226,6 +302,7 @@ func (mockObjTool) Disasm(file string, start, end uint64) ([]plugin.Inst, error)
 
 type mockObjFile struct {
 	frames map[uint64][]plugin.Frame
+	delay  time.Duration
 }
 
 func (mockObjFile) Name() string {
@@ -241,6 +318,9 @@ func (mockObjFile) BuildID() string {
 }
 
 func (mf mockObjFile) SourceLine(addr uint64) ([]plugin.Frame, error) {
+	if mf.delay > 0 {
+		time.Sleep(mf.delay)
+	}
 	return mf.frames[addr], nil
 }
 
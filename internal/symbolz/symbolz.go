@@ -44,11 +44,7 @@ func Symbolize(sources plugin.MappingSources, syms func(string, string) ([]byte,
 		if m.HasFunctions {
 			continue
 		}
-		mappingSources := sources[m.File]
-		if m.BuildID != "" {
-			mappingSources = append(mappingSources, sources[m.BuildID]...)
-		}
-		for _, source := range mappingSources {
+		for _, source := range sources.Lookup(m) {
 			if symz := symbolz(source.Source); symz != "" {
 				if err := symbolizeMapping(symz, int64(source.Start)-int64(m.Start), syms, m, p); err != nil {
 					return err
@@ -60,10 +60,7 @@ func TestSymbolize(t *testing.T) {
 	}
 
 	s := plugin.MappingSources{
-		"buildid": []struct {
-			Source string
-			Start  uint64
-		}{
+		"buildid": []plugin.MappingSource{
 			{Source: "http://localhost:80/profilez"},
 		},
 	}
@@ -73,6 +73,40 @@ func (p *Profile) FilterSamplesByName(focus, ignore, hide, show *regexp.Regexp)
 	return
 }
 
+// FilterSamplesByMapping filters the samples in a profile and only
+// keeps samples with a location in a mapping whose file name matches
+// only. If leaf is set, only the leaf location of each sample is
+// considered; otherwise any frame qualifies the sample.
+// Returns true if the regexp matched at least one mapping.
+func (p *Profile) FilterSamplesByMapping(only *regexp.Regexp, leaf bool) (om bool) {
+	if only == nil {
+		return false
+	}
+	matched := make(map[uint64]bool)
+	for _, m := range p.Mapping {
+		if only.MatchString(m.File) {
+			om = true
+			matched[m.ID] = true
+		}
+	}
+
+	s := make([]*Sample, 0, len(p.Sample))
+	for _, sample := range p.Sample {
+		locs := sample.Location
+		if leaf && len(locs) > 0 {
+			locs = locs[:1]
+		}
+		for _, loc := range locs {
+			if loc.Mapping != nil && matched[loc.Mapping.ID] {
+				s = append(s, sample)
+				break
+			}
+		}
+	}
+	p.Sample = s
+	return
+}
+
 // FilterTagsByName filters the tags in a profile and only keeps
 // tags that match show and not hide.
 func (p *Profile) FilterTagsByName(show, hide *regexp.Regexp) (sm, hm bool) {
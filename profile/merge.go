@@ -34,8 +34,10 @@ func (p *Profile) Compact() *Profile {
 // profile is compacted to eliminate unused samples, locations,
 // functions and mappings. Profiles must have identical profile sample
 // and period types or the merge will fail. profile.Period of the
-// resulting profile will be the maximum of all profiles, and
-// profile.TimeNanos will be the earliest nonzero one.
+// resulting profile will be the maximum of all profiles,
+// profile.TimeNanos will be the earliest nonzero one, and
+// profile.DefaultSampleType and profile.DocumentationURL will be the
+// first nonempty ones.
 func Merge(srcs []*Profile) (*Profile, error) {
 	if len(srcs) == 0 {
 		return nil, fmt.Errorf("no profiles to merge")
@@ -382,9 +384,9 @@ func combineHeaders(srcs []*Profile) (*Profile, error) {
 
 	var timeNanos, durationNanos, period int64
 	var comments []string
-	var defaultSampleType string
+	var defaultSampleType, docURL string
 	for _, s := range srcs {
-		if timeNanos == 0 || s.TimeNanos < timeNanos {
+		if s.TimeNanos != 0 && (timeNanos == 0 || s.TimeNanos < timeNanos) {
 			timeNanos = s.TimeNanos
 		}
 		durationNanos += s.DurationNanos
@@ -395,6 +397,9 @@ func combineHeaders(srcs []*Profile) (*Profile, error) {
 		if defaultSampleType == "" {
 			defaultSampleType = s.DefaultSampleType
 		}
+		if docURL == "" {
+			docURL = s.DocumentationURL
+		}
 	}
 
 	p := &Profile{
@@ -410,6 +415,7 @@ func combineHeaders(srcs []*Profile) (*Profile, error) {
 
 		Comments:          comments,
 		DefaultSampleType: defaultSampleType,
+		DocumentationURL:  docURL,
 	}
 	copy(p.SampleType, srcs[0].SampleType)
 	return p, nil
@@ -45,11 +45,15 @@ type Profile struct {
 	PeriodType    *ValueType
 	Period        int64
 
+	// DocumentationURL links to documentation about the profile.
+	DocumentationURL string
+
 	commentX           []int64
 	dropFramesX        int64
 	keepFramesX        int64
 	stringTable        []string
 	defaultSampleTypeX int64
+	docURLX            int64
 }
 
 // ValueType corresponds to Profile.ValueType
@@ -476,6 +476,65 @@ func TestMergeAll(t *testing.T) {
 	}
 }
 
+func TestMergeDocURL(t *testing.T) {
+	const url = "https://example.com/runbook"
+
+	for _, tc := range []struct {
+		urls []string
+		want string
+	}{
+		{[]string{"", ""}, ""},
+		{[]string{url, ""}, url},
+		{[]string{"", url}, url},
+		{[]string{url, url}, url},
+		{[]string{url, url + "/other"}, url},
+		{[]string{"", url + "/other", url}, url + "/other"},
+	} {
+		var profs []*Profile
+		for _, u := range tc.urls {
+			p := testProfile.Copy()
+			p.DocumentationURL = u
+			// Round-trip through the encoder to exercise doc_url decoding.
+			profs = append(profs, p.Copy())
+		}
+		prof, err := Merge(profs)
+		if err != nil {
+			t.Errorf("merge of %q: %v", tc.urls, err)
+			continue
+		}
+		if got := prof.DocumentationURL; got != tc.want {
+			t.Errorf("merge of %q, want %q, got %q", tc.urls, tc.want, got)
+		}
+	}
+}
+
+func TestMergeTimeNanos(t *testing.T) {
+	for _, tc := range []struct {
+		times []int64
+		want  int64
+	}{
+		{[]int64{0, 0}, 0},
+		{[]int64{20, 10}, 10},
+		{[]int64{10, 0, 20}, 10},
+		{[]int64{0, 20, 10}, 10},
+	} {
+		var profs []*Profile
+		for _, tn := range tc.times {
+			p := testProfile.Copy()
+			p.TimeNanos = tn
+			profs = append(profs, p)
+		}
+		prof, err := Merge(profs)
+		if err != nil {
+			t.Errorf("merge of times %v: %v", tc.times, err)
+			continue
+		}
+		if prof.TimeNanos != tc.want {
+			t.Errorf("merge of times %v, want %d, got %d", tc.times, tc.want, prof.TimeNanos)
+		}
+	}
+}
+
 func TestFilter(t *testing.T) {
 	// Perform several forms of filtering on the test profile.
 
@@ -507,6 +566,30 @@ func TestFilter(t *testing.T) {
 	}
 }
 
+func TestMappingFilter(t *testing.T) {
+	for tx, tc := range []struct {
+		only    *regexp.Regexp
+		leaf    bool
+		om      bool
+		samples int
+	}{
+		{regexp.MustCompile("notfound"), false, false, 0},
+		{regexp.MustCompile("lib.so"), false, true, 5},
+		{regexp.MustCompile("lib.so"), true, true, 1},
+		{regexp.MustCompile("main"), false, true, 4},
+		{regexp.MustCompile("main"), true, true, 4},
+	} {
+		prof := testProfile.Copy()
+		om := prof.FilterSamplesByMapping(tc.only, tc.leaf)
+		if om != tc.om {
+			t.Errorf("Filter #%d, got om=%v, want %v", tx, om, tc.om)
+		}
+		if got := len(prof.Sample); got != tc.samples {
+			t.Errorf("Filter #%d, got %d samples, want %d", tx, got, tc.samples)
+		}
+	}
+}
+
 func TestTagFilter(t *testing.T) {
 	// Perform several forms of tag filtering on the test profile.
 